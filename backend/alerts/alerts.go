@@ -0,0 +1,75 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// LowStockAlert วัตถุดิบที่สต๊อกลดต่ำกว่าขั้นต่ำ
+type LowStockAlert struct {
+	IngredientID   string    `json:"ingredient_id"`
+	Name           string    `json:"name"`
+	Unit           string    `json:"unit"`
+	CurrentStock   float64   `json:"current_stock"`
+	AvailableStock float64   `json:"available_stock"` // ขายได้จริง ไม่รวมส่วนที่จองไว้
+	MinStock       float64   `json:"min_stock"`
+	Reference      *string   `json:"reference"` // เช่น OrderID ที่ทำให้สต๊อกต่ำ
+	TriggeredAt    time.Time `json:"triggered_at"`
+}
+
+// Notifier ช่องทางแจ้งเตือนสต๊อกต่ำ
+type Notifier interface {
+	NotifyLowStock(alert LowStockAlert) error
+}
+
+// LogNotifier พิมพ์การแจ้งเตือนลง log
+type LogNotifier struct{}
+
+// NotifyLowStock พิมพ์การแจ้งเตือนลง log
+func (LogNotifier) NotifyLowStock(alert LowStockAlert) error {
+	log.Printf("⚠️ Low stock: %s เหลือขายได้ %.2f %s (ขั้นต่ำ %.2f)", alert.Name, alert.AvailableStock, alert.Unit, alert.MinStock)
+	return nil
+}
+
+// WebhookNotifier ส่งการแจ้งเตือนเป็น JSON ไปยัง URL ที่กำหนด
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NotifyLowStock POST การแจ้งเตือนไปยัง webhook
+func (w WebhookNotifier) NotifyLowStock(alert LowStockAlert) error {
+	body, err := json.Marshal(map[string]interface{}{"event": "low_stock", "data": alert})
+	if err != nil {
+		return err
+	}
+
+	client := w.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	resp, err := client.Post(w.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// NewFromEnv เลือกช่องทางแจ้งเตือนตาม LOW_STOCK_WEBHOOK_URL (ไม่กำหนด = log)
+func NewFromEnv() Notifier {
+	if url := os.Getenv("LOW_STOCK_WEBHOOK_URL"); url != "" {
+		return WebhookNotifier{URL: url}
+	}
+	return LogNotifier{}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -59,7 +60,25 @@ func Migrate() {
 		&models.Ingredient{},
 		&models.Recipe{},
 		&models.RecipeIngredient{},
+		&models.RecipeVersion{},
+		&models.RecipeVersionIngredient{},
 		&models.StockMovement{},
+		&models.StockReservation{},
+		&models.IngredientCostLayer{},
+		&models.UnitOfMeasure{},
+		&models.IngredientUnitConversion{},
+		&models.PrepRecipe{},
+		&models.PrepRecipeComponent{},
+		&models.ProductionBatch{},
+		&models.Supplier{},
+		&models.SupplierPrice{},
+		&models.PurchaseOrder{},
+		&models.PurchaseOrderLine{},
+		&models.Stocktake{},
+		&models.StocktakeLine{},
+		&models.StocktakeCount{},
+		&models.WasteEntry{},
+		&models.DocumentSequence{},
 		// Promotion System
 		&models.Promotion{},
 		&models.Coupon{},
@@ -75,6 +94,13 @@ func Migrate() {
 		&models.RewardRedemption{},
 		&models.PointRule{},
 		&models.TierUpgrade{},
+		&models.MemberTier{},
+		&models.StampCard{},
+		&models.StampHistory{},
+		&models.LoyaltyAward{},
+		&models.MemberOTP{},
+		&models.MemberConsentLog{},
+		&models.MemberMerge{},
 		// Cost Management
 		&models.ProductCost{},
 		&models.DailyProfitReport{},
@@ -89,6 +115,13 @@ func Migrate() {
 }
 
 func Seed() {
+	seedUnits()
+	// ทำหลังสุดเพื่อให้ทั้งสูตรเดิมและสูตรที่เพิ่ง seed ได้เวอร์ชันแรก
+	defer seedRecipeVersions()
+	// สมาชิกที่สมัครก่อนมีระบบแนะนำเพื่อนยังไม่มีรหัสแนะนำ
+	defer seedReferralCodes()
+	defer normalizeMemberPhones()
+
 	// Check if categories already exist
 	var categoryCount int64
 	DB.Model(&models.Category{}).Count(&categoryCount)
@@ -112,15 +145,49 @@ func Seed() {
 
 	// Seed Ingredients
 	ingredients := []models.Ingredient{
-		{Name: "เมล็ดกาแฟ", Unit: "กรัม", CostPerUnit: 0.50, CurrentStock: 5000, MinStock: 500, MaxStock: floatPtr(10000), Supplier: stringPtr("บริษัท กาแฟไทย")},
-		{Name: "นมสด", Unit: "มล.", CostPerUnit: 0.02, CurrentStock: 10000, MinStock: 1000, MaxStock: floatPtr(20000), Supplier: stringPtr("ฟาร์มนม")},
-		{Name: "น้ำตาล", Unit: "กรัม", CostPerUnit: 0.01, CurrentStock: 2000, MinStock: 200, MaxStock: floatPtr(5000), Supplier: stringPtr("โรงงานน้ำตาล")},
-		{Name: "ผงโกโก้", Unit: "กรัม", CostPerUnit: 0.08, CurrentStock: 1000, MinStock: 100, MaxStock: floatPtr(2000), Supplier: stringPtr("บริษัท โกโก้")},
+		{Name: "เมล็ดกาแฟ", Unit: "กรัม", PurchaseUnit: stringPtr("กิโลกรัม"), CostPerUnit: 0.50, CurrentStock: 5000, MinStock: 500, MaxStock: floatPtr(10000), Supplier: stringPtr("บริษัท กาแฟไทย")},
+		{Name: "นมสด", Unit: "มล.", PurchaseUnit: stringPtr("ลิตร"), CostPerUnit: 0.02, CurrentStock: 10000, MinStock: 1000, MaxStock: floatPtr(20000), Supplier: stringPtr("ฟาร์มนม")},
+		{Name: "น้ำตาล", Unit: "กรัม", PurchaseUnit: stringPtr("กิโลกรัม"), CostPerUnit: 0.01, CurrentStock: 2000, MinStock: 200, MaxStock: floatPtr(5000), Supplier: stringPtr("โรงงานน้ำตาล")},
+		{Name: "ผงโกโก้", Unit: "กรัม", PurchaseUnit: stringPtr("กิโลกรัม"), CostPerUnit: 0.08, CurrentStock: 1000, MinStock: 100, MaxStock: floatPtr(2000), Supplier: stringPtr("บริษัท โกโก้")},
 		{Name: "น้ำ", Unit: "มล.", CostPerUnit: 0.001, CurrentStock: 50000, MinStock: 5000, MaxStock: floatPtr(100000), Supplier: stringPtr("ประปา")},
 	}
 
 	for i := range ingredients {
 		DB.Create(&ingredients[i])
+
+		// สต๊อกยกมาเป็นชั้นต้นทุนแรก
+		DB.Create(&models.IngredientCostLayer{
+			IngredientID: ingredients[i].ID,
+			ReceivedAt:   time.Now(),
+			Quantity:     ingredients[i].CurrentStock,
+			Remaining:    ingredients[i].CurrentStock,
+			UnitCost:     ingredients[i].CostPerUnit,
+		})
+	}
+
+	// Seed Suppliers จากชื่อผู้จำหน่ายของวัตถุดิบ พร้อมรายการราคา
+	suppliers := make(map[string]*models.Supplier)
+	for i := range ingredients {
+		if ingredients[i].Supplier == nil {
+			continue
+		}
+
+		name := *ingredients[i].Supplier
+		supplier, ok := suppliers[name]
+		if !ok {
+			supplier = &models.Supplier{Name: name, LeadTimeDays: 3, PaymentTerms: stringPtr("เงินสด"), IsActive: true}
+			DB.Create(supplier)
+			suppliers[name] = supplier
+		}
+
+		DB.Model(&ingredients[i]).Update("supplier_id", supplier.ID)
+		DB.Create(&models.SupplierPrice{
+			SupplierID:    supplier.ID,
+			IngredientID:  ingredients[i].ID,
+			UnitPrice:     ingredients[i].CostPerUnit,
+			EffectiveDate: time.Now(),
+			IsActive:      true,
+		})
 	}
 
 	// Seed Products with cost
@@ -175,6 +242,22 @@ func Seed() {
 		DB.Create(&recipeIngredients[i])
 	}
 
+	// ต้นทุนวัตถุดิบตามสูตร
+	ingredientCost := make(map[string]float64)
+	for _, ingredient := range ingredients {
+		ingredientCost[ingredient.ID] = ingredient.CostPerUnit
+	}
+	recipeCost := make(map[string]float64)
+	for _, item := range recipeIngredients {
+		recipeCost[item.RecipeID] += item.Quantity * ingredientCost[item.IngredientID]
+	}
+	for _, recipe := range recipes {
+		DB.Model(&models.Product{}).Where("id = ?", recipe.ProductID).Updates(map[string]interface{}{
+			"recipe_cost":            recipeCost[recipe.ID],
+			"recipe_cost_updated_at": time.Now(),
+		})
+	}
+
 	// Create sample promotions
 	var promotionCount int64
 	DB.Model(&models.Promotion{}).Count(&promotionCount)
@@ -336,6 +419,14 @@ func Seed() {
 				EarnPoints:  intPtr(50),
 				IsActive:    true,
 			},
+			{
+				BaseModel:   models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
+				Name:        "คะแนนแนะนำเพื่อน",
+				Description: stringPtr("ผู้แนะนำและเพื่อนที่สมัครได้คะแนนเมื่อเพื่อนซื้อครั้งแรก"),
+				Type:        "REFERRAL",
+				EarnPoints:  intPtr(30),
+				IsActive:    true,
+			},
 			{
 				BaseModel:       models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
 				Name:            "คะแนนสมาชิกทอง",
@@ -356,13 +447,14 @@ func Seed() {
 		// สร้างรางวัล
 		rewards := []models.Reward{
 			{
-				BaseModel:   models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
-				Name:        "กาแฟฟรี 1 แก้ว",
-				Description: stringPtr("แลกกาแฟเอสเพรสโซ 1 แก้วฟรี"),
-				Type:        "FREE_ITEM",
-				PointCost:   50,
-				IsActive:    true,
-				UsageLimit:  intPtr(1), // ใช้ได้ 1 ครั้งต่อคน
+				BaseModel:     models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
+				Name:          "กาแฟฟรี 1 แก้ว",
+				Description:   stringPtr("แลกกาแฟเอสเพรสโซ 1 แก้วฟรี"),
+				Type:          "FREE_ITEM",
+				PointCost:     50,
+				FreeProductID: &products[0].ID, // เอสเปรสโซ
+				IsActive:      true,
+				UsageLimit:    intPtr(1), // ใช้ได้ 1 ครั้งต่อคน
 			},
 			{
 				BaseModel:      models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
@@ -374,14 +466,17 @@ func Seed() {
 				IsActive:       true,
 			},
 			{
-				BaseModel:   models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
-				Name:        "ซื้อ 10 แถม 1",
-				Description: stringPtr("ซื้อกาแฟครบ 10 แก้ว แถม 1 แก้วฟรี"),
-				Type:        "BUY_X_GET_Y",
-				PointCost:   0, // ไม่ต้องใช้คะแนน
-				BuyQuantity: intPtr(10),
-				GetQuantity: intPtr(1),
-				IsActive:    true,
+				BaseModel:     models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
+				Name:          "ซื้อ 10 แถม 1",
+				Description:   stringPtr("ซื้อกาแฟครบ 10 แก้ว แถม 1 แก้วฟรี"),
+				Type:          "BUY_X_GET_Y",
+				PointCost:     0, // ไม่ต้องใช้คะแนน
+				FreeProductID: &products[0].ID,
+				BuyQuantity:   intPtr(10),
+				GetQuantity:   intPtr(1),
+				IsActive:      true,
+				// สะสมแสตมป์จากเครื่องดื่มกาแฟทุกเมนู
+				ApplicableProducts: []string{products[0].ID, products[1].ID, products[2].ID, products[3].ID, products[4].ID, products[5].ID},
 			},
 		}
 
@@ -428,6 +523,22 @@ func Seed() {
 		}
 	}
 
+	// Seed Member Tiers
+	var tierCount int64
+	DB.Model(&models.MemberTier{}).Count(&tierCount)
+	if tierCount == 0 {
+		tiers := []models.MemberTier{
+			{Name: "BRONZE", DisplayName: stringPtr("บรอนซ์"), Rank: 1, QualificationMonths: 12, EarnMultiplier: 1, IsActive: true},
+			{Name: "SILVER", DisplayName: stringPtr("ซิลเวอร์"), Rank: 2, QualifyingSpend: 5000, QualifyingOrders: 20, QualificationMonths: 12, UpgradeBonus: 50, EarnMultiplier: 1, IsActive: true},
+			{Name: "GOLD", DisplayName: stringPtr("โกลด์"), Rank: 3, QualifyingSpend: 20000, QualifyingOrders: 50, QualificationMonths: 12, UpgradeBonus: 100, EarnMultiplier: 1, IsActive: true},
+			{Name: "PLATINUM", DisplayName: stringPtr("แพลทินัม"), Rank: 4, QualifyingSpend: 50000, QualifyingOrders: 100, QualificationMonths: 12, UpgradeBonus: 200, EarnMultiplier: 1, IsActive: true},
+		}
+
+		for i := range tiers {
+			DB.Create(&tiers[i])
+		}
+	}
+
 	// Seed Product Costs (only if products exist)
 	var productCount int64
 	DB.Model(&models.Product{}).Count(&productCount)
@@ -440,12 +551,22 @@ func Seed() {
 			DB.Find(&allProducts)
 
 			for _, product := range allProducts {
+				// ใช้ต้นทุนวัตถุดิบตามสูตร ถ้าไม่มีสูตรประมาณ 60% ของต้นทุน
+				rawMaterialCost := product.Cost * 0.6
+				if product.RecipeCost != nil {
+					rawMaterialCost = *product.RecipeCost
+				}
+				remaining := product.Cost - rawMaterialCost
+				if remaining < 0 {
+					remaining = 0
+				}
+
 				productCost := models.ProductCost{
 					ProductID:       product.ID,
 					CostPerUnit:     product.Cost,
-					RawMaterialCost: floatPtr(product.Cost * 0.6), // 60% วัตถุดิบ
-					LaborCost:       floatPtr(product.Cost * 0.3), // 30% แรงงาน
-					OverheadCost:    floatPtr(product.Cost * 0.1), // 10% ค่าใช้จ่ายทั่วไป
+					RawMaterialCost: floatPtr(rawMaterialCost),
+					LaborCost:       floatPtr(remaining * 0.75), // ส่วนที่เหลือ 3:1 แรงงาน
+					OverheadCost:    floatPtr(remaining * 0.25), // ค่าใช้จ่ายทั่วไป
 					EffectiveDate:   time.Now(),
 					IsActive:        true,
 					Notes:           stringPtr("ต้นทุนเริ่มต้น"),
@@ -458,6 +579,100 @@ func Seed() {
 	log.Println("Database seeded successfully")
 }
 
+// seedUnits สร้างทะเบียนหน่วยวัดพื้นฐาน แยกจาก Seed เพื่อให้ฐานข้อมูลเดิมได้หน่วยด้วย
+func seedUnits() {
+	var count int64
+	DB.Model(&models.UnitOfMeasure{}).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	units := []models.UnitOfMeasure{
+		{Code: "g", Name: "กรัม", Dimension: models.UnitDimensionMass, ToBase: 1},
+		{Code: "kg", Name: "กิโลกรัม", Dimension: models.UnitDimensionMass, ToBase: 1000},
+		{Code: "ml", Name: "มล.", Dimension: models.UnitDimensionVolume, ToBase: 1},
+		{Code: "L", Name: "ลิตร", Dimension: models.UnitDimensionVolume, ToBase: 1000},
+		{Code: "tsp", Name: "ช้อนชา", Dimension: models.UnitDimensionVolume, ToBase: 5},
+		{Code: "tbsp", Name: "ช้อนโต๊ะ", Dimension: models.UnitDimensionVolume, ToBase: 15},
+		{Code: "each", Name: "ชิ้น", Dimension: models.UnitDimensionCount, ToBase: 1},
+		{Code: "dozen", Name: "โหล", Dimension: models.UnitDimensionCount, ToBase: 12},
+		{Code: "pack12", Name: "แพ็ค 12", Dimension: models.UnitDimensionCount, ToBase: 12},
+	}
+
+	for i := range units {
+		DB.Create(&units[i])
+	}
+}
+
+// seedRecipeVersions สร้างเวอร์ชันแรกให้สูตรที่ยังไม่มีเวอร์ชัน จากส่วนผสมปัจจุบันของสูตร
+func seedRecipeVersions() {
+	var recipes []models.Recipe
+	DB.Preload("Product").Preload("Ingredients").Where("active_version_id IS NULL").Find(&recipes)
+
+	for _, recipe := range recipes {
+		effectiveFrom := recipe.CreatedAt
+		version := models.RecipeVersion{
+			RecipeID:      recipe.ID,
+			VersionNumber: 1,
+			Status:        models.RecipeVersionStatusActive,
+			Instructions:  recipe.Instructions,
+			PrepTime:      recipe.PrepTime,
+			Notes:         stringPtr("เวอร์ชันแรก"),
+			EffectiveFrom: &effectiveFrom,
+			RecipeCost:    recipe.Product.RecipeCost,
+		}
+		DB.Create(&version)
+
+		for _, item := range recipe.Ingredients {
+			DB.Create(&models.RecipeVersionIngredient{
+				RecipeVersionID: version.ID,
+				IngredientID:    item.IngredientID,
+				Quantity:        item.Quantity,
+				Unit:            item.Unit,
+			})
+		}
+
+		DB.Model(&models.Recipe{}).Where("id = ?", recipe.ID).Update("active_version_id", version.ID)
+	}
+}
+
+// seedReferralCodes สร้างรหัสแนะนำให้สมาชิกที่ยังไม่มี รูปแบบเดียวกับตอนสมัครสมาชิก
+func seedReferralCodes() {
+	var memberIDs []string
+	DB.Model(&models.Member{}).Where("referral_code IS NULL").Pluck("id", &memberIDs)
+
+	for _, id := range memberIDs {
+		code := "REF" + strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:6])
+		DB.Model(&models.Member{}).Where("id = ? AND referral_code IS NULL", id).Update("referral_code", code)
+	}
+}
+
+// normalizeMemberPhones ปรับเบอร์โทรสมาชิกเดิมให้เป็นรูปแบบเดียวกับที่ค้นหา (ตัดช่องว่างและขีด)
+// เบอร์ที่ปรับแล้วซ้ำกับสมาชิกอื่นจะคงไว้ตามเดิม ให้รวมบัญชีผ่าน /members/duplicates
+func normalizeMemberPhones() {
+	var members []models.Member
+	DB.Select("id", "phone").
+		Where("phone IS NOT NULL AND (phone LIKE ? OR phone LIKE ? OR phone <> TRIM(phone))", "% %", "%-%").
+		Find(&members)
+
+	for _, member := range members {
+		phone := strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(*member.Phone))
+
+		var count int64
+		DB.Model(&models.Member{}).Where("phone = ? AND id <> ?", phone, member.ID).Count(&count)
+		if count > 0 {
+			log.Printf("Member %s phone duplicates another member after normalizing, left unchanged", member.ID)
+			continue
+		}
+
+		var value interface{} = phone
+		if phone == "" {
+			value = nil
+		}
+		DB.Model(&models.Member{}).Where("id = ?", member.ID).Update("phone", value)
+	}
+}
+
 // Helper functions
 func stringPtr(s string) *string {
 	return &s
@@ -43,10 +43,14 @@ func UpdateProductCost(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid input"})
 	}
 
-	// ปิดการใช้งานต้นทุนเก่า
-	database.DB.Model(&models.ProductCost{}).
-		Where("product_id = ? AND is_active = ?", productID, true).
-		Update("is_active", false)
+	// ถ้าไม่ได้ระบุต้นทุนวัตถุดิบ ใช้ต้นทุนตามสูตร
+	if input.RawMaterialCost == nil {
+		recipeCost, err := calculateRecipeCost(database.DB, productID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		input.RawMaterialCost = recipeCost
+	}
 
 	// สร้างต้นทุนใหม่
 	newCost := models.ProductCost{
@@ -60,15 +64,15 @@ func UpdateProductCost(c *fiber.Ctx) error {
 		IsActive:        true,
 	}
 
-	result := database.DB.Create(&newCost)
-	if result.Error != nil {
-		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	// ปิดการใช้งานต้นทุนเก่าและอัปเดตต้นทุนในตาราง Product
+	tx := database.DB.Begin()
+	if err := saveProductCost(tx, &newCost); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
-
-	// อัปเดตต้นทุนในตาราง Product
-	database.DB.Model(&models.Product{}).
-		Where("id = ?", productID).
-		Update("cost", input.CostPerUnit)
 
 	return c.JSON(newCost)
 }
@@ -124,7 +128,7 @@ func generateDailyProfitReport(reportDate time.Time) (*models.DailyProfitReport,
 	for _, order := range orders {
 		for _, item := range order.Items {
 			totalRevenue += item.Price * float64(item.Quantity)
-			totalCost += item.Product.Cost * float64(item.Quantity)
+			totalCost += orderItemUnitCost(item) * float64(item.Quantity)
 			totalItems += item.Quantity
 			productSales[item.Product.Name] += item.Quantity
 		}
@@ -183,38 +187,50 @@ func GetProductProfitReport(c *fiber.Ctx) error {
 	startDate := reportDate
 	endDate := reportDate.Add(24 * time.Hour)
 
-	// ดึงข้อมูลการขายแต่ละสินค้า
-	var orderItems []models.OrderItem
-	database.DB.
-		Select("product_id, SUM(quantity) as total_quantity, SUM(price * quantity) as total_revenue").
-		Joins("JOIN orders ON orders.id = order_items.order_id").
-		Preload("Product").
-		Where("orders.created_at >= ? AND orders.created_at < ? AND orders.status = ?",
-			startDate, endDate, models.OrderStatusCompleted).
-		Group("product_id").
-		Find(&orderItems)
+	// ดึงข้อมูลการขายแต่ละสินค้า ใช้ต้นทุน ณ เวลาที่ขาย
+	var productSales []struct {
+		ProductID string
+		Quantity  int
+		Revenue   float64
+		TotalCost float64
+	}
+	database.DB.Raw(`
+		SELECT 
+			oi.product_id,
+			SUM(oi.quantity) as quantity,
+			SUM(oi.price * oi.quantity) as revenue,
+			SUM(COALESCE(oi.unit_cost, p.cost) * oi.quantity) as total_cost
+		FROM order_items oi
+		JOIN orders o ON o.id = oi.order_id
+		JOIN products p ON p.id = oi.product_id
+		WHERE o.created_at >= ? AND o.created_at < ? AND o.status = ? AND oi.deleted_at IS NULL
+		GROUP BY oi.product_id
+	`, startDate, endDate, models.OrderStatusCompleted).Scan(&productSales)
 
 	var reports []models.ProductProfitReport
 
-	for _, item := range orderItems {
-		revenue := item.Price * float64(item.Quantity)
-		totalCost := item.Product.Cost * float64(item.Quantity)
+	for _, sale := range productSales {
+		var product models.Product
+		database.DB.Unscoped().First(&product, "id = ?", sale.ProductID)
+
+		revenue := sale.Revenue
+		totalCost := sale.TotalCost
 		grossProfit := revenue - totalCost
 		profitPerUnit := 0.0
 		profitMargin := 0.0
 
-		if item.Quantity > 0 {
-			profitPerUnit = grossProfit / float64(item.Quantity)
+		if sale.Quantity > 0 {
+			profitPerUnit = grossProfit / float64(sale.Quantity)
 		}
 		if revenue > 0 {
 			profitMargin = (grossProfit / revenue) * 100
 		}
 
 		report := models.ProductProfitReport{
-			ProductID:     item.ProductID,
-			Product:       item.Product,
+			ProductID:     sale.ProductID,
+			Product:       product,
 			ReportDate:    reportDate,
-			QuantitySold:  item.Quantity,
+			QuantitySold:  sale.Quantity,
 			Revenue:       revenue,
 			TotalCost:     totalCost,
 			GrossProfit:   grossProfit,
@@ -229,6 +245,14 @@ func GetProductProfitReport(c *fiber.Ctx) error {
 	return c.JSON(reports)
 }
 
+// orderItemUnitCost ต้นทุนต่อหน่วยของรายการ ใช้ต้นทุน ณ เวลาที่ขายถ้ามี
+func orderItemUnitCost(item models.OrderItem) float64 {
+	if item.UnitCost != nil {
+		return *item.UnitCost
+	}
+	return item.Product.Cost
+}
+
 // GetProfitAnalytics ดึงข้อมูลวิเคราะห์กำไร
 func GetProfitAnalytics(c *fiber.Ctx) error {
 	// ช่วงวันที่ (ค่าเริ่มต้น 7 วันล่าสุด)
@@ -249,8 +273,8 @@ func GetProfitAnalytics(c *fiber.Ctx) error {
 	database.DB.Raw(`
 		SELECT 
 			COALESCE(SUM(oi.price * oi.quantity), 0) as total_revenue,
-			COALESCE(SUM(p.cost * oi.quantity), 0) as total_cost,
-			COALESCE(SUM(oi.price * oi.quantity) - SUM(p.cost * oi.quantity), 0) as total_profit,
+			COALESCE(SUM(COALESCE(oi.unit_cost, p.cost) * oi.quantity), 0) as total_cost,
+			COALESCE(SUM(oi.price * oi.quantity) - SUM(COALESCE(oi.unit_cost, p.cost) * oi.quantity), 0) as total_profit,
 			COUNT(DISTINCT o.id) as total_orders
 		FROM orders o
 		JOIN order_items oi ON o.id = oi.order_id
@@ -274,12 +298,12 @@ func GetProfitAnalytics(c *fiber.Ctx) error {
 	database.DB.Raw(`
 		SELECT 
 			DATE(o.created_at) as date,
-			COALESCE(SUM(oi.price * oi.quantity) - SUM(p.cost * oi.quantity), 0) as profit,
+			COALESCE(SUM(oi.price * oi.quantity) - SUM(COALESCE(oi.unit_cost, p.cost) * oi.quantity), 0) as profit,
 			COALESCE(SUM(oi.price * oi.quantity), 0) as revenue,
-			COALESCE(SUM(p.cost * oi.quantity), 0) as cost,
+			COALESCE(SUM(COALESCE(oi.unit_cost, p.cost) * oi.quantity), 0) as cost,
 			CASE 
 				WHEN SUM(oi.price * oi.quantity) > 0 
-				THEN ((SUM(oi.price * oi.quantity) - SUM(p.cost * oi.quantity)) / SUM(oi.price * oi.quantity)) * 100
+				THEN ((SUM(oi.price * oi.quantity) - SUM(COALESCE(oi.unit_cost, p.cost) * oi.quantity)) / SUM(oi.price * oi.quantity)) * 100
 				ELSE 0 
 			END as margin
 		FROM orders o
@@ -302,16 +326,16 @@ func GetProfitAnalytics(c *fiber.Ctx) error {
 	database.DB.Raw(`
 		SELECT 
 			p.name as product_name,
-			COALESCE(SUM(oi.price * oi.quantity) - SUM(p.cost * oi.quantity), 0) as total_profit,
+			COALESCE(SUM(oi.price * oi.quantity) - SUM(COALESCE(oi.unit_cost, p.cost) * oi.quantity), 0) as total_profit,
 			COALESCE(SUM(oi.quantity), 0) as quantity_sold,
 			CASE 
 				WHEN SUM(oi.quantity) > 0 
-				THEN (SUM(oi.price * oi.quantity) - SUM(p.cost * oi.quantity)) / SUM(oi.quantity)
+				THEN (SUM(oi.price * oi.quantity) - SUM(COALESCE(oi.unit_cost, p.cost) * oi.quantity)) / SUM(oi.quantity)
 				ELSE 0 
 			END as profit_per_unit,
 			CASE 
 				WHEN SUM(oi.price * oi.quantity) > 0 
-				THEN ((SUM(oi.price * oi.quantity) - SUM(p.cost * oi.quantity)) / SUM(oi.price * oi.quantity)) * 100
+				THEN ((SUM(oi.price * oi.quantity) - SUM(COALESCE(oi.unit_cost, p.cost) * oi.quantity)) / SUM(oi.price * oi.quantity)) * 100
 				ELSE 0 
 			END as profit_margin
 		FROM products p
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// costSnapshot ต้นทุนของสินค้า ณ เวลาหนึ่ง สำหรับบันทึกลงรายการออเดอร์
+type costSnapshot struct {
+	UnitCost        float64
+	RawMaterialCost *float64
+	LaborCost       *float64
+	OverheadCost    *float64
+	ProductCostID   *string
+}
+
+// applyTo บันทึกต้นทุนลงรายการออเดอร์
+func (s costSnapshot) applyTo(item *models.OrderItem) {
+	unitCost := s.UnitCost
+	item.UnitCost = &unitCost
+	item.RawMaterialCost = s.RawMaterialCost
+	item.LaborCost = s.LaborCost
+	item.OverheadCost = s.OverheadCost
+	item.ProductCostID = s.ProductCostID
+}
+
+// BackfillOrderItemCosts บันทึกต้นทุนย้อนหลังให้รายการออเดอร์เดิมที่ยังไม่มีต้นทุน
+// โดยใช้ ProductCost ที่มีผล ณ เวลาที่สั่ง
+func BackfillOrderItemCosts(c *fiber.Ctx) error {
+	const batchSize = 500
+
+	var allCosts []models.ProductCost
+	database.DB.Order("product_id ASC, effective_date ASC").Find(&allCosts)
+
+	costsByProduct := make(map[string][]models.ProductCost)
+	for _, cost := range allCosts {
+		costsByProduct[cost.ProductID] = append(costsByProduct[cost.ProductID], cost)
+	}
+
+	products := make(map[string]models.Product)
+	updated := 0
+	lastID := ""
+	var firstSold, lastSold time.Time
+
+	for {
+		var items []models.OrderItem
+		result := database.DB.Preload("Order", func(db *gorm.DB) *gorm.DB { return db.Unscoped() }).
+			Where("unit_cost IS NULL AND id > ?", lastID).
+			Order("id ASC").
+			Limit(batchSize).
+			Find(&items)
+		if result.Error != nil {
+			return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+		}
+		if len(items) == 0 {
+			break
+		}
+
+		err := database.DB.Transaction(func(tx *gorm.DB) error {
+			for _, item := range items {
+				product, ok := products[item.ProductID]
+				if !ok {
+					tx.Unscoped().First(&product, "id = ?", item.ProductID)
+					products[item.ProductID] = product
+				}
+
+				soldAt := item.Order.CreatedAt
+				if soldAt.IsZero() {
+					soldAt = item.CreatedAt
+				}
+
+				if firstSold.IsZero() || soldAt.Before(firstSold) {
+					firstSold = soldAt
+				}
+				if soldAt.After(lastSold) {
+					lastSold = soldAt
+				}
+
+				snapshot := snapshotFromCosts(costsByProduct[item.ProductID], product, soldAt)
+				snapshot.applyTo(&item)
+
+				err := tx.Model(&models.OrderItem{}).Where("id = ?", item.ID).Updates(map[string]interface{}{
+					"unit_cost":         item.UnitCost,
+					"raw_material_cost": item.RawMaterialCost,
+					"labor_cost":        item.LaborCost,
+					"overhead_cost":     item.OverheadCost,
+					"product_cost_id":   item.ProductCostID,
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		updated += len(items)
+		lastID = items[len(items)-1].ID
+	}
+
+	// รายงานรายวันที่สร้างไว้แล้วใช้ต้นทุนเดิม ลบเฉพาะวันที่มีรายการถูกบันทึกต้นทุนย้อนหลังเพื่อสร้างใหม่
+	var reportsDeleted int64
+	if updated > 0 && c.QueryBool("regenerate_reports", false) {
+		from := time.Date(firstSold.Year(), firstSold.Month(), firstSold.Day(), 0, 0, 0, 0, firstSold.Location())
+		to := time.Date(lastSold.Year(), lastSold.Month(), lastSold.Day(), 0, 0, 0, 0, lastSold.Location()).AddDate(0, 0, 1)
+		result := database.DB.Unscoped().
+			Where("report_date >= ? AND report_date < ?", from, to).
+			Delete(&models.DailyProfitReport{})
+		if result.Error != nil {
+			return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+		}
+		reportsDeleted = result.RowsAffected
+	}
+
+	return c.JSON(fiber.Map{"updated_items": updated, "reports_deleted": reportsDeleted})
+}
+
+// currentCostSnapshot ต้นทุนของสินค้าสำหรับออเดอร์ที่กำลังสร้าง
+func currentCostSnapshot(tx *gorm.DB, product models.Product, at time.Time) costSnapshot {
+	var costs []models.ProductCost
+	tx.Where("product_id = ?", product.ID).Order("effective_date ASC").Find(&costs)
+
+	snapshot := snapshotFromCosts(costs, product, at)
+
+	// ต้นทุนในตาราง Product ถูกแก้โดยไม่ได้บันทึก ProductCost ใช้ค่าปัจจุบันโดยไม่มีรายละเอียด
+	if snapshot.UnitCost != product.Cost {
+		return costSnapshot{UnitCost: product.Cost}
+	}
+
+	return snapshot
+}
+
+// snapshotFromCosts หา ProductCost ที่มีผล ณ เวลาที่กำหนด (costs เรียงตาม effective_date)
+// ถ้าก่อนหน้านั้นไม่มีบันทึกต้นทุน ใช้บันทึกแรกสุด และถ้าไม่มีเลยใช้ Product.Cost
+func snapshotFromCosts(costs []models.ProductCost, product models.Product, at time.Time) costSnapshot {
+	if len(costs) == 0 {
+		return costSnapshot{UnitCost: product.Cost}
+	}
+
+	effective := costs[0]
+	for _, cost := range costs {
+		if cost.EffectiveDate.After(at) {
+			break
+		}
+		effective = cost
+	}
+
+	id := effective.ID
+	return costSnapshot{
+		UnitCost:        effective.CostPerUnit,
+		RawMaterialCost: effective.RawMaterialCost,
+		LaborCost:       effective.LaborCost,
+		OverheadCost:    effective.OverheadCost,
+		ProductCostID:   &id,
+	}
+}
@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// nextDocumentNumber ออกเลขที่เอกสารถัดไปของวัน เช่น PO250101001 ต้องเรียกภายใน transaction เดียวกับการสร้างเอกสาร
+// ลำดับเก็บใน DocumentSequence และล็อกไว้จนจบ transaction เอกสารที่สร้างพร้อมกันจึงได้เลขไม่ซ้ำ
+// model คือตารางของเอกสาร ใช้นับเอกสารของวันที่สร้างไว้ก่อนมีลำดับ เพื่อเริ่มนับต่อจากนั้น
+func nextDocumentNumber(tx *gorm.DB, prefix string, model interface{}, now time.Time) (string, error) {
+	period := now.Format("060102")
+
+	var sequence models.DocumentSequence
+	if err := tx.Where("prefix = ? AND period = ?", prefix, period).Limit(1).Find(&sequence).Error; err != nil {
+		return "", err
+	}
+	if sequence.ID == "" {
+		start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		var existing int64
+		if err := tx.Unscoped().Model(model).Where("created_at >= ?", start).Count(&existing).Error; err != nil {
+			return "", err
+		}
+
+		// สร้างแถวของวันนอก transaction ถ้าล็อกแถวที่ยังไม่มี MySQL จะล็อกช่วงว่าง
+		// แล้ว transaction ที่สร้างพร้อมกันจะรอกันเองจน deadlock สร้างซ้ำได้แถวเดียวตามดัชนี unique
+		err := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.DocumentSequence{
+			Prefix:    prefix,
+			Period:    period,
+			LastValue: int(existing),
+		}).Error
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&sequence, "prefix = ? AND period = ?", prefix, period).Error
+	if err != nil {
+		return "", err
+	}
+
+	next := sequence.LastValue + 1
+	if err := tx.Model(&sequence).Update("last_value", next).Error; err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%s%03d", prefix, period, next), nil
+}
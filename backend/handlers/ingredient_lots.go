@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"coffee-pula-backend/alerts"
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// StartInventoryJobs เริ่มงานเบื้องหลังของระบบสต๊อก ตัดล็อตที่หมดอายุเป็นของเสียทุกชั่วโมง
+// คืนสต๊อกที่จองเกินเวลาทุกนาที และคำนวณสถานะหมดของเมนูเมื่อสต๊อกเปลี่ยน
+func StartInventoryJobs() {
+	go watchMenuAvailability()
+
+	go func() {
+		runInventoryJobs()
+
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			runInventoryJobs()
+		}
+	}()
+
+	// การจองสต๊อกหมดเวลาเป็นนาที ตรวจถี่กว่างานอื่น
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			runReservationJobs()
+		}
+	}()
+}
+
+func runInventoryJobs() {
+	expired, err := expireIngredientLots(database.DB, time.Now())
+	if err != nil {
+		log.Println("Expired lot write-off failed:", err)
+	} else if len(expired) > 0 {
+		log.Printf("Wrote off %d expired lots", len(expired))
+	}
+
+	// คำนวณทุกรอบเผื่อสต๊อกถูกแก้จากทางอื่น
+	scheduleMenuRefresh()
+}
+
+// GetIngredientLots ดึงล็อตของวัตถุดิบที่ยังเหลือ เรียงตามลำดับที่จะถูกตัดออก
+func GetIngredientLots(c *fiber.Ctx) error {
+	query := database.DB.Preload("Ingredient")
+
+	if ingredientID := c.Query("ingredient_id"); ingredientID != "" {
+		query = query.Where("ingredient_id = ?", ingredientID)
+	}
+	if !c.QueryBool("include_empty", false) {
+		query = query.Where("remaining > 0")
+	}
+
+	var lots []models.IngredientCostLayer
+	result := query.Order("ingredient_id ASC, expiry_date IS NULL, expiry_date ASC, received_at ASC").Find(&lots)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(lots)
+}
+
+// GetExpiringLots รายงานล็อตที่จะหมดอายุภายใน N วัน รวมล็อตที่หมดอายุแล้วแต่ยังไม่ได้ตัดออก
+func GetExpiringLots(c *fiber.Ctx) error {
+	days := c.QueryInt("days", 3)
+	if days < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "days must not be negative"})
+	}
+
+	now := time.Now()
+	until := now.AddDate(0, 0, days)
+
+	var lots []models.IngredientCostLayer
+	result := database.DB.Preload("Ingredient").
+		Where("remaining > 0 AND expiry_date IS NOT NULL AND expiry_date <= ?", until).
+		Order("expiry_date ASC").
+		Find(&lots)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	type expiringLot struct {
+		LotID          string    `json:"lot_id"`
+		LotNumber      *string   `json:"lot_number"`
+		IngredientID   string    `json:"ingredient_id"`
+		IngredientName string    `json:"ingredient_name"`
+		Unit           string    `json:"unit"`
+		Remaining      float64   `json:"remaining"`
+		Value          float64   `json:"value"`
+		ReceivedAt     time.Time `json:"received_at"`
+		ExpiryDate     time.Time `json:"expiry_date"`
+		DaysLeft       int       `json:"days_left"` // ติดลบ = หมดอายุแล้ว
+		Expired        bool      `json:"expired"`
+	}
+
+	report := make([]expiringLot, 0, len(lots))
+	totalValue := 0.0
+	for _, lot := range lots {
+		row := expiringLot{
+			LotID:        lot.ID,
+			LotNumber:    lot.LotNumber,
+			IngredientID: lot.IngredientID,
+			Remaining:    lot.Remaining,
+			Value:        roundBaht(lot.Remaining * lot.UnitCost),
+			ReceivedAt:   lot.ReceivedAt,
+			ExpiryDate:   *lot.ExpiryDate,
+			DaysLeft:     int(math.Floor(lot.ExpiryDate.Sub(now).Hours() / 24)),
+			Expired:      lot.ExpiryDate.Before(now),
+		}
+		if lot.Ingredient != nil {
+			row.IngredientName = lot.Ingredient.Name
+			row.Unit = lot.Ingredient.Unit
+		}
+
+		totalValue += row.Value
+		report = append(report, row)
+	}
+
+	return c.JSON(fiber.Map{
+		"days":        days,
+		"total_value": roundBaht(totalValue),
+		"lots":        report,
+	})
+}
+
+// ExpireLots ตัดล็อตที่หมดอายุแล้วเป็นของเสียทันที ไม่ต้องรองานเบื้องหลัง
+func ExpireLots(c *fiber.Ctx) error {
+	entries, err := expireIngredientLots(database.DB, time.Now())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	totalCost := 0.0
+	for _, entry := range entries {
+		totalCost += entry.TotalCost
+	}
+
+	return c.JSON(fiber.Map{
+		"expired_lots": len(entries),
+		"total_cost":   roundBaht(totalCost),
+		"entries":      entries,
+	})
+}
+
+// expireIngredientLots บันทึกของเสียเหตุผล EXPIRED สำหรับทุกล็อตที่หมดอายุแล้ว ล็อตละหนึ่ง transaction
+func expireIngredientLots(db *gorm.DB, now time.Time) ([]models.WasteEntry, error) {
+	var lots []models.IngredientCostLayer
+	err := db.Where("remaining > 0 AND expiry_date IS NOT NULL AND expiry_date < ?", now).
+		Order("expiry_date ASC").
+		Find(&lots).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []models.WasteEntry
+	var lowStock []alerts.LowStockAlert
+
+	for _, lot := range lots {
+		var entry *models.WasteEntry
+		var alert *alerts.LowStockAlert
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			ingredient, err := lockIngredient(tx, lot.IngredientID)
+			if err != nil {
+				return err
+			}
+
+			// อ่านล็อตใหม่หลังล็อกวัตถุดิบ อาจถูกตัดไปแล้วระหว่างนี้
+			var current models.IngredientCostLayer
+			if err := tx.First(&current, "id = ?", lot.ID).Error; err != nil {
+				return err
+			}
+			if current.Remaining <= 0 {
+				return nil
+			}
+
+			// สต๊อกรวมอาจน้อยกว่าที่ล็อตเหลือถ้าเคยปรับยอดโดยไม่ผ่านล็อต ตัดเท่าที่มี
+			if ingredient.CurrentStock <= 0 {
+				return tx.Model(&current).Update("remaining", 0).Error
+			}
+			// ส่วนที่จองให้ออเดอร์ไว้ตัดไม่ได้ ที่เหลือจะถูกตัดในรอบถัดไปหลังออเดอร์ปิดหรือยกเลิก
+			quantity := math.Min(current.Remaining, availableStock(ingredient))
+			if quantity <= 0 {
+				return nil
+			}
+
+			lotLabel := current.ID
+			if current.LotNumber != nil {
+				lotLabel = *current.LotNumber
+			}
+			notes := fmt.Sprintf("ล็อต %s หมดอายุ %s", lotLabel, current.ExpiryDate.Format("2006-01-02"))
+
+			entry = &models.WasteEntry{
+				Reason:       models.WasteReasonExpired,
+				IngredientID: &ingredient.ID,
+				Quantity:     quantity,
+				RecordedBy:   stringPtr("system"),
+				Notes:        &notes,
+				WastedAt:     now,
+			}
+			if err := tx.Create(entry).Error; err != nil {
+				return err
+			}
+
+			reason := fmt.Sprintf("ของเสีย (%s)", wasteReasonLabels[models.WasteReasonExpired])
+			movement, err := issueStock(tx, ingredient, models.StockMovementTypeWaste, stockEntry{
+				Quantity:  quantity,
+				Reason:    &reason,
+				Reference: &entry.ID,
+				LotID:     &current.ID,
+			})
+			if err != nil {
+				return err
+			}
+
+			entry.TotalCost = *movement.TotalCost
+			if err := tx.Model(entry).Update("total_cost", entry.TotalCost).Error; err != nil {
+				return err
+			}
+
+			// ส่วนที่สต๊อกรวมไม่พอตัด ปิดล็อตทิ้งเพื่อไม่ให้ถูกหยิบไปขาย
+			if err := tx.Model(&current).Update("remaining", 0).Error; err != nil {
+				return err
+			}
+
+			alert = lowStockAlert(ingredient, quantity, &entry.ID)
+			return nil
+		})
+		if err != nil {
+			return entries, err
+		}
+
+		if entry != nil {
+			entries = append(entries, *entry)
+		}
+		if alert != nil {
+			lowStock = append(lowStock, *alert)
+		}
+	}
+
+	notifyLowStock(lowStock)
+	if len(entries) > 0 {
+		scheduleMenuRefresh()
+	}
+
+	return entries, nil
+}
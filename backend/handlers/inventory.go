@@ -3,6 +3,9 @@ package handlers
 import (
 	"coffee-pula-backend/database"
 	"coffee-pula-backend/models"
+	"math"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -30,16 +33,109 @@ func CreateIngredient(c *fiber.Ctx) error {
 		})
 	}
 	
-	result := database.DB.Create(&ingredient)
-	if result.Error != nil {
+	if ingredient.CostingMethod == "" {
+		ingredient.CostingMethod = models.CostingMethodAverage
+	}
+	
+	// Start transaction
+	tx := database.DB.Begin()
+	
+	if err := tx.Create(&ingredient).Error; err != nil {
+		tx.Rollback()
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to create ingredient",
 		})
 	}
 	
+	// วัตถุดิบใหม่ยังไม่มีหน่วยเฉพาะ หน่วยสั่งซื้อและหน่วยในสูตรต้องแปลงผ่านทะเบียนหน่วยได้
+	for _, unit := range []*string{ingredient.PurchaseUnit, ingredient.RecipeUnit} {
+		if _, err := unitFactor(tx, &ingredient, unit); err != nil {
+			tx.Rollback()
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	
+	// สต๊อกยกมาเป็นชั้นต้นทุนแรก
+	if ingredient.CurrentStock > 0 {
+		layer := models.IngredientCostLayer{
+			IngredientID: ingredient.ID,
+			ReceivedAt:   time.Now(),
+			Quantity:     ingredient.CurrentStock,
+			Remaining:    ingredient.CurrentStock,
+			UnitCost:     ingredient.CostPerUnit,
+		}
+		if err := tx.Create(&layer).Error; err != nil {
+			tx.Rollback()
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to create cost layer",
+			})
+		}
+	}
+	
+	// Commit transaction
+	tx.Commit()
+	
 	return c.Status(201).JSON(ingredient)
 }
 
+// UpdateIngredient - แก้ไขวัตถุดิบ (สต๊อกปรับผ่าน AdjustStock เท่านั้น)
+func UpdateIngredient(c *fiber.Ctx) error {
+	ingredientID := c.Params("id")
+	
+	var ingredient models.Ingredient
+	if err := database.DB.First(&ingredient, "id = ?", ingredientID).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Ingredient not found",
+		})
+	}
+	
+	var updateData models.Ingredient
+	if err := c.BodyParser(&updateData); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	
+	// Start transaction
+	tx := database.DB.Begin()
+	
+	// ยอดสต๊อก ยอดจอง และต้นทุนเปลี่ยนได้ผ่านการเคลื่อนไหวสต๊อกเท่านั้น
+	if err := tx.Model(&ingredient).Omit("id", "current_stock", "reserved_stock", "cost_per_unit", "costing_method").Updates(updateData).Error; err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to update ingredient",
+		})
+	}
+	
+	// หน่วยสั่งซื้อและหน่วยในสูตรต้องแปลงเป็นหน่วยสต๊อกได้
+	tx.First(&ingredient, "id = ?", ingredientID)
+	for _, unit := range []*string{ingredient.PurchaseUnit, ingredient.RecipeUnit} {
+		if _, err := unitFactor(tx, &ingredient, unit); err != nil {
+			tx.Rollback()
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	
+	// หน่วยของวัตถุดิบอาจเปลี่ยน คำนวณต้นทุนตามสูตรของสินค้าที่ใช้วัตถุดิบนี้ใหม่
+	if err := recomputeRecipeCostsForIngredient(tx, ingredientID); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to calculate recipe cost",
+		})
+	}
+	
+	// Commit transaction
+	tx.Commit()
+	
+	database.DB.First(&ingredient, "id = ?", ingredientID)
+	
+	return c.JSON(ingredient)
+}
+
 // GetStockMovements - ดึงข้อมูลการเคลื่อนไหวสต๊อก
 func GetStockMovements(c *fiber.Ctx) error {
 	var movements []models.StockMovement
@@ -57,10 +153,14 @@ func GetStockMovements(c *fiber.Ctx) error {
 // AdjustStock - ปรับปรุงสต๊อกวัตถุดิบ
 func AdjustStock(c *fiber.Ctx) error {
 	var request struct {
-		IngredientID string                `json:"ingredient_id"`
+		IngredientID string                   `json:"ingredient_id"`
 		Type         models.StockMovementType `json:"type"`
-		Quantity     float64               `json:"quantity"`
-		Reason       *string               `json:"reason"`
+		Quantity     float64                  `json:"quantity"`
+		UnitCost     *float64                 `json:"unit_cost"` // ราคาซื้อต่อหน่วย (รับเข้า)
+		Unit         *string                  `json:"unit"`      // หน่วยของ quantity และ unit_cost (ไม่ระบุ = หน่วยสต๊อก)
+		Reason       *string                  `json:"reason"`
+		LotNumber    *string                  `json:"lot_number"`  // ล็อตที่รับเข้า
+		ExpiryDate   *time.Time               `json:"expiry_date"` // วันหมดอายุของล็อตที่รับเข้า
 	}
 	
 	if err := c.BodyParser(&request); err != nil {
@@ -69,63 +169,86 @@ func AdjustStock(c *fiber.Ctx) error {
 		})
 	}
 	
+	if request.Quantity < 0 || (request.UnitCost != nil && *request.UnitCost < 0) {
+		return c.Status(400).JSON(fiber.Map{
+			"error": "quantity and unit_cost must not be negative",
+		})
+	}
+	
 	// Start transaction
 	tx := database.DB.Begin()
 	
 	// Get current ingredient
-	var ingredient models.Ingredient
-	if err := tx.First(&ingredient, "id = ?", request.IngredientID).Error; err != nil {
+	ingredient, err := lockIngredient(tx, request.IngredientID)
+	if err != nil {
 		tx.Rollback()
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Ingredient not found",
 		})
 	}
 	
-	// Calculate new stock
-	var newStock float64
+	// แปลงเป็นหน่วยสต๊อก ราคาต่อหน่วยแปลงกลับด้าน
+	factor, err := unitFactor(tx, ingredient, request.Unit)
+	if err != nil {
+		tx.Rollback()
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	
+	entry := stockEntry{
+		Quantity:   request.Quantity * factor,
+		Reason:     request.Reason,
+		LotNumber:  request.LotNumber,
+		ExpiryDate: request.ExpiryDate,
+	}
+	if request.UnitCost != nil {
+		unitCost := roundCost(*request.UnitCost / factor)
+		entry.UnitCost = &unitCost
+	}
+	
+	var movement *models.StockMovement
 	switch request.Type {
 	case models.StockMovementTypeIn:
-		newStock = ingredient.CurrentStock + request.Quantity
+		movement, err = receiveStock(tx, ingredient, models.StockMovementTypeIn, entry)
 	case models.StockMovementTypeOut:
-		newStock = ingredient.CurrentStock - request.Quantity
-		if newStock < 0 {
-			tx.Rollback()
-			return c.Status(400).JSON(fiber.Map{
-				"error": "Insufficient stock",
-			})
-		}
+		movement, err = issueStock(tx, ingredient, models.StockMovementTypeOut, entry)
 	case models.StockMovementTypeAdjust:
-		newStock = request.Quantity
-	}
-	
-	// Update ingredient stock
-	if err := tx.Model(&ingredient).Update("current_stock", newStock).Error; err != nil {
+		// ปรับยอดให้เท่ากับที่ระบุ บันทึกเฉพาะส่วนต่าง
+		delta := entry.Quantity - ingredient.CurrentStock
+		entry.Quantity = math.Abs(delta)
+		if delta > 0 {
+			movement, err = receiveStock(tx, ingredient, models.StockMovementTypeAdjust, entry)
+		} else if delta < 0 {
+			movement, err = issueStock(tx, ingredient, models.StockMovementTypeAdjust, entry)
+		}
+	default:
 		tx.Rollback()
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Failed to update stock",
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Invalid movement type",
 		})
 	}
 	
-	// Record stock movement
-	movement := models.StockMovement{
-		IngredientID: request.IngredientID,
-		Type:         request.Type,
-		Quantity:     request.Quantity,
-		Reason:       request.Reason,
+	if err == errInsufficientStock {
+		tx.Rollback()
+		return c.Status(400).JSON(fiber.Map{
+			"error": "Insufficient stock (reserved stock and expired lots cannot be issued)",
+		})
 	}
-	
-	if err := tx.Create(&movement).Error; err != nil {
+	if err != nil {
 		tx.Rollback()
 		return c.Status(500).JSON(fiber.Map{
-			"error": "Failed to record movement",
+			"error": "Failed to update stock",
 		})
 	}
 	
 	// Commit transaction
 	tx.Commit()
 	
+	scheduleMenuRefresh()
+	
 	// Return updated ingredient
-	database.DB.First(&ingredient, "id = ?", request.IngredientID)
+	database.DB.First(ingredient, "id = ?", request.IngredientID)
 	
 	return c.JSON(fiber.Map{
 		"ingredient": ingredient,
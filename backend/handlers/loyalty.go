@@ -3,12 +3,15 @@ package handlers
 import (
 	"coffee-pula-backend/database"
 	"coffee-pula-backend/models"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
 )
 
 // GetMembers ดึงรายการสมาชิก
@@ -22,10 +25,10 @@ func GetMembers(c *fiber.Ctx) error {
 	
 	query := database.DB.Model(&models.Member{})
 	
-	// ค้นหาตามชื่อหรือเบอร์โทร
+	// ค้นหาตามชื่อหรือรหัสสมาชิก เบอร์โทรต้องตรงทุกหลักเพื่อไม่ให้เปิดเผยข้อมูลสมาชิกอื่น
 	if search != "" {
-		query = query.Where("name LIKE ? OR phone LIKE ? OR member_number LIKE ?", 
-			"%"+search+"%", "%"+search+"%", "%"+search+"%")
+		query = query.Where("name LIKE ? OR phone = ? OR member_number LIKE ?", 
+			"%"+search+"%", normalizePhone(search), "%"+search+"%")
 	}
 	
 	// กรองตามระดับสมาชิก
@@ -114,7 +117,11 @@ func CreateMember(c *fiber.Ctx) error {
 		Name        string     `json:"name"`
 		Phone       *string    `json:"phone"`
 		Email       *string    `json:"email"`
-		DateOfBirth *time.Time `json:"date_of_birth"`
+		DateOfBirth  *time.Time `json:"date_of_birth"`
+		ReferralCode *string    `json:"referral_code"` // รหัสแนะนำของเพื่อนที่แนะนำ
+
+		PrivacyConsent   bool `json:"privacy_consent"`
+		MarketingConsent bool `json:"marketing_consent"`
 	}
 	
 	if err := c.BodyParser(&request); err != nil {
@@ -125,8 +132,9 @@ func CreateMember(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Name is required"})
 	}
 	
-	// ตรวจสอบเบอร์โทรซ้ำ
-	if request.Phone != nil && *request.Phone != "" {
+	// ตรวจสอบเบอร์โทรซ้ำ เก็บเบอร์รูปแบบเดียวกับที่ใช้ค้นหา
+	request.Phone = normalizePhonePtr(request.Phone)
+	if request.Phone != nil {
 		var existingMember models.Member
 		result := database.DB.First(&existingMember, "phone = ?", *request.Phone)
 		if result.Error == nil {
@@ -134,6 +142,17 @@ func CreateMember(c *fiber.Ctx) error {
 		}
 	}
 	
+	// ตรวจสอบรหัสแนะนำ
+	var referredByID *string
+	if request.ReferralCode != nil && *request.ReferralCode != "" {
+		var referrer models.Member
+		result := database.DB.First(&referrer, "referral_code = ? AND is_active = ?", strings.ToUpper(*request.ReferralCode), true)
+		if result.Error != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid referral code"})
+		}
+		referredByID = &referrer.ID
+	}
+	
 	// สร้างรหัสสมาชิกใหม่
 	memberNumber := generateMemberNumber()
 	
@@ -151,28 +170,44 @@ func CreateMember(c *fiber.Ctx) error {
 		TotalOrders:     0,
 		Tier:            "BRONZE",
 		IsActive:        true,
+		ReferralCode:    stringPtr(generateReferralCode()),
+		ReferredByID:    referredByID,
 	}
 	
-	result := database.DB.Create(&member)
-	if result.Error != nil {
-		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	tx := database.DB.Begin()
+
+	if err := tx.Create(&member).Error; err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 	
-	// สร้างประวัติคะแนนเริ่มต้น
-	history := models.PointHistory{
-		BaseModel:   models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
+	// บันทึกความยินยอมที่ให้ตอนสมัคร
+	if err := recordConsent(tx, member.ID, "PRIVACY", request.PrivacyConsent, stringPtr("SIGNUP")); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := recordConsent(tx, member.ID, "MARKETING", request.MarketingConsent, stringPtr("SIGNUP")); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	
+	// คะแนนต้อนรับสมาชิกใหม่
+	_, err := postPointEntry(tx, pointEntry{
 		MemberID:    member.ID,
 		Type:        "BONUS",
-		Points:      10, // คะแนนสมาชิกใหม่
+		Points:      10,
 		Description: "ยินดีต้อนรับสมาชิกใหม่",
+	})
+	if err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
-	database.DB.Create(&history)
 	
-	// อัพเดทคะแนนสมาชิก
-	database.DB.Model(&member).Updates(models.Member{
-		TotalPoints:     10,
-		AvailablePoints: 10,
-	})
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	database.DB.First(&member, "id = ?", member.ID)
 
 	return c.Status(201).JSON(member)
 }
@@ -187,13 +222,32 @@ func UpdateMember(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
 	}
 	
+	if member.ErasedAt != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Member data has been erased"})
+	}
+	
 	var updateData models.Member
 	if err := c.BodyParser(&updateData); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 	
+	if updateData.Phone != nil {
+		updateData.Phone = normalizePhonePtr(updateData.Phone)
+		if updateData.Phone == nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Phone number is invalid"})
+		}
+		var existingMember models.Member
+		if database.DB.First(&existingMember, "phone = ? AND id <> ?", *updateData.Phone, member.ID).Error == nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Phone number already exists"})
+		}
+	}
+	
 	updateData.UpdatedAt = time.Now()
-	result = database.DB.Model(&member).Updates(updateData)
+	// ยอดคะแนนเปลี่ยนได้ผ่าน ledger เท่านั้น
+	result = database.DB.Model(&member).
+		Omit("total_points", "available_points", "used_points", "referral_code", "referred_by_id",
+			"privacy_consent", "privacy_consent_at", "marketing_consent", "marketing_consent_at", "erased_at", "merged_into_id").
+		Updates(updateData)
 	if result.Error != nil {
 		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
 	}
@@ -219,57 +273,64 @@ func EarnPoints(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Points must be positive"})
 	}
 	
-	// ดึงข้อมูลสมาชิก
-	var member models.Member
-	result := database.DB.First(&member, "id = ?", request.MemberID)
-	if result.Error != nil {
+	tx := database.DB.Begin()
+
+	// ดึงข้อมูลสมาชิกพร้อมล็อกแถวจนจบ transaction
+	member, err := lockMember(tx, request.MemberID)
+	if err != nil {
+		tx.Rollback()
 		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
 	}
 	
 	// คำนวณคะแนนจากกฎ (ถ้ามีการใช้จ่าย)
 	totalPoints := request.Points
 	if request.SpentAmount != nil {
-		extraPoints := calculatePointsFromRules(member, *request.SpentAmount)
+		extraPoints := calculatePointsFromRules(*member, *request.SpentAmount)
 		totalPoints += extraPoints
 	}
 	
-	// สร้างประวัติคะแนน
-	history := models.PointHistory{
-		BaseModel:   models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
-		MemberID:    request.MemberID,
+	// ตัวคูณคะแนนตามระดับสมาชิก ใช้กับคะแนนทั้งหมดที่ได้รับ
+	totalPoints = int(float64(totalPoints) * tierEarnMultiplier(tx, *member))
+	
+	// บันทึกคะแนนผ่าน ledger ระดับที่ได้ 0 คะแนนยังบันทึกรายการ 0 คะแนนไว้นับยอดใช้จ่าย
+	entry := pointEntry{
+		MemberID:    member.ID,
 		OrderID:     request.OrderID,
 		Type:        "EARN",
 		Points:      totalPoints,
 		Description: request.Description,
-		ExpiresAt:   getPointExpiryDate(), // คะแนนหมดอายุ 1 ปี
+		SpentAmount: request.SpentAmount,
 	}
-	database.DB.Create(&history)
-	
-	// อัพเดทคะแนนสมาชิก
-	newTotalPoints := member.TotalPoints + totalPoints
-	newAvailablePoints := member.AvailablePoints + totalPoints
-	
-	updates := models.Member{
-		TotalPoints:     newTotalPoints,
-		AvailablePoints: newAvailablePoints,
-		LastVisit:       &[]time.Time{time.Now()}[0],
+	if totalPoints > 0 {
+		entry.ExpiresAt = getPointExpiryDate() // คะแนนหมดอายุ 1 ปี
+	}
+	if _, err = postPointEntry(tx, entry); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 	
 	// อัพเดทยอดใช้จ่ายและจำนวนออเดอร์
-	if request.SpentAmount != nil {
-		updates.TotalSpent = member.TotalSpent + *request.SpentAmount
-		updates.TotalOrders = member.TotalOrders + 1
+	if err := recordMemberVisit(tx, member.ID, request.SpentAmount); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
 	
-	database.DB.Model(&member).Updates(updates)
-	
 	// ตรวจสอบการอัพเกรดระดับ
-	checkTierUpgrade(member.ID)
+	if err := checkTierUpgrade(tx, member.ID); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	database.DB.First(member, "id = ?", member.ID)
 
 	return c.JSON(fiber.Map{
 		"message": "Points earned successfully",
 		"points_earned": totalPoints,
-		"new_balance": newAvailablePoints,
+		"new_balance":   member.AvailablePoints,
 	})
 }
 
@@ -280,28 +341,53 @@ func RedeemPoints(c *fiber.Ctx) error {
 		RewardID string  `json:"reward_id"`
 		OrderID  *string `json:"order_id"`
 		Notes    *string `json:"notes"`
+		OTPID    string  `json:"otp_id"`   // ได้จาก /members/:id/otp
+		OTPCode  string  `json:"otp_code"` // รหัสที่สมาชิกได้รับทาง SMS
 	}
 	
 	if err := c.BodyParser(&request); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
 	}
 	
-	// ดึงข้อมูลสมาชิก
-	var member models.Member
-	result := database.DB.First(&member, "id = ?", request.MemberID)
-	if result.Error != nil {
+	tx := database.DB.Begin()
+
+	// ดึงข้อมูลสมาชิกพร้อมล็อกแถวจนจบ transaction
+	member, err := lockMember(tx, request.MemberID)
+	if err != nil {
+		tx.Rollback()
 		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
 	}
 	
+	// ยืนยันตัวตนสมาชิกด้วย OTP ก่อนใช้คะแนน
+	if err := verifyMemberOTP(tx, member.ID, "REDEEM", request.OTPID, request.OTPCode); err != nil {
+		tx.Rollback()
+		return c.Status(401).JSON(fiber.Map{"error": err.Error()})
+	}
+	
 	// ดึงข้อมูลรางวัล
 	var reward models.Reward
-	result = database.DB.First(&reward, "id = ? AND is_active = ?", request.RewardID, true)
+	result := tx.First(&reward, "id = ? AND is_active = ?", request.RewardID, true)
 	if result.Error != nil {
+		tx.Rollback()
 		return c.Status(404).JSON(fiber.Map{"error": "Reward not found or inactive"})
 	}
+
+	// ตรวจสอบช่วงเวลาของรางวัล
+	now := time.Now()
+	if (reward.StartDate != nil && reward.StartDate.After(now)) || (reward.EndDate != nil && reward.EndDate.Before(now)) {
+		tx.Rollback()
+		return c.Status(400).JSON(fiber.Map{"error": "Reward is not available at this time"})
+	}
+
+	// รางวัลสะสมแสตมป์ได้รับจากบัตรสะสมเท่านั้น
+	if reward.Type == "BUY_X_GET_Y" {
+		tx.Rollback()
+		return c.Status(400).JSON(fiber.Map{"error": "Reward is issued from stamp cards only"})
+	}
 	
 	// ตรวจสอบคะแนนเพียงพอ
 	if member.AvailablePoints < reward.PointCost {
+		tx.Rollback()
 		return c.Status(400).JSON(fiber.Map{
 			"error": "Insufficient points",
 			"required": reward.PointCost,
@@ -310,7 +396,8 @@ func RedeemPoints(c *fiber.Ctx) error {
 	}
 	
 	// ตรวจสอบระดับสมาชิก
-	if reward.RequiredTier != nil && !checkTierRequirement(member.Tier, *reward.RequiredTier) {
+	if reward.RequiredTier != nil && !checkTierRequirement(tx, member.Tier, *reward.RequiredTier) {
+		tx.Rollback()
 		return c.Status(400).JSON(fiber.Map{
 			"error": "Tier requirement not met",
 			"required": *reward.RequiredTier,
@@ -318,22 +405,40 @@ func RedeemPoints(c *fiber.Ctx) error {
 		})
 	}
 	
+	// ตรวจสอบจำนวนครั้งที่แลกได้ต่อคน
+	if reward.UsageLimit != nil {
+		var usedCount int64
+		tx.Model(&models.RewardRedemption{}).
+			Where("member_id = ? AND reward_id = ? AND status IN ?", member.ID, reward.ID, []string{"PENDING", "USED"}).
+			Count(&usedCount)
+		if usedCount >= int64(*reward.UsageLimit) {
+			tx.Rollback()
+			return c.Status(400).JSON(fiber.Map{
+				"error": "Reward usage limit reached",
+				"limit": *reward.UsageLimit,
+			})
+		}
+	}
+	
 	// สร้างการแลกรางวัล
 	redemption := models.RewardRedemption{
 		BaseModel: models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
 		MemberID:  request.MemberID,
 		RewardID:  request.RewardID,
 		OrderID:   request.OrderID,
+		Code:       stringPtr(generateRedemptionCode()),
 		PointsUsed: reward.PointCost,
 		Status:    "PENDING",
 		ExpiresAt: &[]time.Time{time.Now().AddDate(0, 0, 30)}[0], // หมดอายุ 30 วัน
 		Notes:     request.Notes,
 	}
-	database.DB.Create(&redemption)
+	if err := tx.Create(&redemption).Error; err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
 	
-	// สร้างประวัติคะแนน
-	history := models.PointHistory{
-		BaseModel:     models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
+	// หักคะแนนผ่าน ledger
+	_, err = postPointEntry(tx, pointEntry{
 		MemberID:      request.MemberID,
 		OrderID:       request.OrderID,
 		Type:          "REDEEM",
@@ -341,27 +446,50 @@ func RedeemPoints(c *fiber.Ctx) error {
 		Description:   fmt.Sprintf("แลกรางวัล: %s", reward.Name),
 		ReferenceType: stringPtr("REWARD"),
 		ReferenceID:   &redemption.ID,
+	})
+	if errors.Is(err, errInsufficientPoints) {
+		tx.Rollback()
+		return c.Status(400).JSON(fiber.Map{"error": "Insufficient points"})
+	}
+	if err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
 	}
-	database.DB.Create(&history)
 	
-	// อัพเดทคะแนนสมาชิก
-	newAvailablePoints := member.AvailablePoints - reward.PointCost
-	newUsedPoints := member.UsedPoints + reward.PointCost
+	if err := recordMemberVisit(tx, request.MemberID, nil); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
 	
-	database.DB.Model(&member).Updates(models.Member{
-		AvailablePoints: newAvailablePoints,
-		UsedPoints:      newUsedPoints,
-		LastVisit:       &[]time.Time{time.Now()}[0],
-	})
+	// อัพเดทสถิติรางวัล และตัดสต๊อกของรางวัล (ถ้ามีการจำกัดจำนวน)
+	updates := map[string]interface{}{"total_redemptions": gorm.Expr("total_redemptions + 1")}
+	rewardQuery := tx.Model(&models.Reward{}).Where("id = ?", reward.ID)
+	if reward.Stock != nil {
+		updates["stock"] = gorm.Expr("stock - 1")
+		rewardQuery = rewardQuery.Where("stock > 0")
+	}
+	result = rewardQuery.Updates(updates)
+	if result.Error != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return c.Status(400).JSON(fiber.Map{"error": "Reward is out of stock"})
+	}
 	
-	// อัพเดทสถิติรางวัล
-	database.DB.Model(&reward).Update("total_redemptions", reward.TotalRedemptions+1)
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	database.DB.First(member, "id = ?", member.ID)
 
 	return c.JSON(fiber.Map{
 		"message": "Reward redeemed successfully",
 		"redemption_id": redemption.ID,
+		"redemption_code":  *redemption.Code,
 		"points_used": reward.PointCost,
-		"remaining_points": newAvailablePoints,
+		"remaining_points": member.AvailablePoints,
 	})
 }
 
@@ -371,7 +499,15 @@ func GetRewards(c *fiber.Ctx) error {
 	
 	memberTier := c.Query("tier") // กรองตามระดับสมาชิก
 	
-	query := database.DB.Where("is_active = ?", true)
+	query := database.DB.Model(&models.Reward{})
+	
+	// หน้าจัดการรางวัลส่ง include_inactive=true เพื่อดูรางวัลทั้งหมด
+	if !c.QueryBool("include_inactive", false) {
+		now := time.Now()
+		query = query.Where("is_active = ?", true).
+			Where("(start_date IS NULL OR start_date <= ?) AND (end_date IS NULL OR end_date >= ?)", now, now).
+			Where("stock IS NULL OR stock > 0")
+	}
 	
 	// กรองตามระดับสมาชิก
 	if memberTier != "" {
@@ -398,14 +534,27 @@ func GetMemberStats(c *fiber.Ctx) error {
 		PlatinumMembers  int64   `json:"platinum_members"`
 		TotalPointsIssued int64  `json:"total_points_issued"`
 		TotalPointsRedeemed int64 `json:"total_points_redeemed"`
+		MembersByTier    map[string]int64 `json:"members_by_tier"`
 	}
 	
 	database.DB.Model(&models.Member{}).Count(&stats.TotalMembers)
 	database.DB.Model(&models.Member{}).Where("is_active = ?", true).Count(&stats.ActiveMembers)
-	database.DB.Model(&models.Member{}).Where("tier = ?", "BRONZE").Count(&stats.BronzeMembers)
-	database.DB.Model(&models.Member{}).Where("tier = ?", "SILVER").Count(&stats.SilverMembers)
-	database.DB.Model(&models.Member{}).Where("tier = ?", "GOLD").Count(&stats.GoldMembers)
-	database.DB.Model(&models.Member{}).Where("tier = ?", "PLATINUM").Count(&stats.PlatinumMembers)
+	
+	// นับสมาชิกทุกระดับในคิวรีเดียว
+	var tierCounts []struct {
+		Tier  string
+		Count int64
+	}
+	database.DB.Model(&models.Member{}).Select("tier, COUNT(*) AS count").Group("tier").Scan(&tierCounts)
+	
+	stats.MembersByTier = map[string]int64{}
+	for _, row := range tierCounts {
+		stats.MembersByTier[row.Tier] = row.Count
+	}
+	stats.BronzeMembers = stats.MembersByTier["BRONZE"]
+	stats.SilverMembers = stats.MembersByTier["SILVER"]
+	stats.GoldMembers = stats.MembersByTier["GOLD"]
+	stats.PlatinumMembers = stats.MembersByTier["PLATINUM"]
 	
 	// รวมคะแนนที่ให้
 	database.DB.Model(&models.PointHistory{}).Where("type = ? AND points > 0", "EARN").
@@ -426,7 +575,9 @@ func generateMemberNumber() string {
 
 func calculatePointsFromRules(member models.Member, spentAmount float64) int {
 	var rules []models.PointRule
+	now := time.Now()
 	database.DB.Where("is_active = ? AND type = ?", true, "PURCHASE").
+		Where("(start_date IS NULL OR start_date <= ?) AND (end_date IS NULL OR end_date >= ?)", now, now).
 		Order("priority DESC").Find(&rules)
 	
 	totalPoints := 0
@@ -447,76 +598,23 @@ func calculatePointsFromRules(member models.Member, spentAmount float64) int {
 	return totalPoints
 }
 
+// tierEarnMultiplier ตัวคูณคะแนนของระดับสมาชิก ถ้าไม่พบระดับที่เปิดใช้งานคิดเป็น 1
+func tierEarnMultiplier(db *gorm.DB, member models.Member) float64 {
+	var tier models.MemberTier
+	if err := db.First(&tier, "name = ? AND is_active = ?", member.Tier, true).Error; err != nil {
+		return 1
+	}
+	return tier.EarnMultiplier
+}
+
 func getPointExpiryDate() *time.Time {
 	expiry := time.Now().AddDate(1, 0, 0) // หมดอายุ 1 ปี
 	return &expiry
 }
 
-func checkTierRequirement(currentTier, requiredTier string) bool {
-	tiers := map[string]int{
-		"BRONZE":   1,
-		"SILVER":   2,
-		"GOLD":     3,
-		"PLATINUM": 4,
-	}
-	
-	return tiers[currentTier] >= tiers[requiredTier]
-}
-
-func checkTierUpgrade(memberID string) {
-	var member models.Member
-	database.DB.First(&member, "id = ?", memberID)
-	
-	newTier := ""
-	
-	// กฎการอัพเกรดระดับ
-	if member.TotalSpent >= 50000 && member.TotalOrders >= 100 {
-		newTier = "PLATINUM"
-	} else if member.TotalSpent >= 20000 && member.TotalOrders >= 50 {
-		newTier = "GOLD"
-	} else if member.TotalSpent >= 5000 && member.TotalOrders >= 20 {
-		newTier = "SILVER"
-	}
-	
-	if newTier != "" && newTier != member.Tier {
-		// อัพเกรดระดับ
-		database.DB.Model(&member).Update("tier", newTier)
-		
-		// บันทึกประวัติการอัพเกรด
-		upgrade := models.TierUpgrade{
-			BaseModel:     models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
-			MemberID:      memberID,
-			FromTier:      member.Tier,
-			ToTier:        newTier,
-			AchievedSpend: member.TotalSpent,
-			AchievedOrders: member.TotalOrders,
-			UpgradeDate:   time.Now(),
-		}
-		database.DB.Create(&upgrade)
-		
-		// ให้คะแนนโบนัสการอัพเกรด
-		bonusPoints := 50
-		if newTier == "PLATINUM" {
-			bonusPoints = 200
-		} else if newTier == "GOLD" {
-			bonusPoints = 100
-		}
-		
-		history := models.PointHistory{
-			BaseModel:   models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
-			MemberID:    memberID,
-			Type:        "BONUS",
-			Points:      bonusPoints,
-			Description: fmt.Sprintf("โบนัสอัพเกรดเป็นสมาชิก%s", newTier),
-		}
-		database.DB.Create(&history)
-		
-		// อัพเดทคะแนน
-		database.DB.Model(&member).Updates(models.Member{
-			TotalPoints:     member.TotalPoints + bonusPoints,
-			AvailablePoints: member.AvailablePoints + bonusPoints,
-		})
-	}
+// checkTierRequirement ตรวจสอบว่าระดับปัจจุบันสูงเท่ากับหรือมากกว่าระดับที่ต้องการ
+func checkTierRequirement(db *gorm.DB, currentTier, requiredTier string) bool {
+	return tierRank(db, currentTier) >= tierRank(db, requiredTier)
 }
 
 func containsTier(tiers []string, tier string) bool {
@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// กลุ่มลูกค้าตามคะแนน RFM
+const (
+	segmentChampions = "CHAMPIONS" // มาบ่อย ใช้จ่ายสูง และเพิ่งมา
+	segmentLoyal     = "LOYAL"     // มาบ่อย
+	segmentAtRisk    = "AT_RISK"   // เคยมาบ่อยหรือใช้จ่ายสูง แต่ห่างหายไป
+	segmentLapsed    = "LAPSED"    // ไม่มาเกินจำนวนวันที่กำหนด
+	segmentRegular   = "REGULAR"
+)
+
+// memberRFM คะแนน RFM ของสมาชิก (1-5)
+type memberRFM struct {
+	MemberID        string     `json:"member_id"`
+	MemberNumber    string     `json:"member_number"`
+	Name            string     `json:"name"`
+	Tier            string     `json:"tier"`
+	LastVisit       *time.Time `json:"last_visit"`
+	RecencyDays     *int       `json:"recency_days"` // nil = ยังไม่เคยมา
+	Frequency       int        `json:"frequency"`    // จำนวนครั้งในช่วงเวลา
+	Monetary        float64    `json:"monetary"`     // ยอดใช้จ่ายในช่วงเวลา
+	RecencyScore    int        `json:"recency_score"`
+	FrequencyScore  int        `json:"frequency_score"`
+	MonetaryScore   int        `json:"monetary_score"`
+	Segment         string     `json:"segment"`
+	AvailablePoints int        `json:"available_points"`
+}
+
+// memberActivity ยอดกิจกรรมของสมาชิกจากออเดอร์หรือการบันทึกยอดซื้อ
+type memberActivity struct {
+	MemberID  string
+	Visits    int
+	Spend     float64
+	LastVisit *time.Time
+}
+
+// GetLoyaltyRFM คำนวณคะแนน RFM และแบ่งกลุ่มสมาชิก
+func GetLoyaltyRFM(c *fiber.Ctx) error {
+	windowDays := c.QueryInt("window_days", 365)
+	lapsedDays := c.QueryInt("lapsed_days", 90)
+	segment := c.Query("segment")
+
+	if windowDays <= 0 || lapsedDays <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "window_days and lapsed_days must be positive"})
+	}
+
+	now := time.Now()
+	scores, err := calculateRFM(database.DB, now, now.AddDate(0, 0, -windowDays), lapsedDays)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	summary := map[string]int{
+		segmentChampions: 0,
+		segmentLoyal:     0,
+		segmentAtRisk:    0,
+		segmentLapsed:    0,
+		segmentRegular:   0,
+	}
+	members := []memberRFM{}
+	for _, score := range scores {
+		summary[score.Segment]++
+		if segment == "" || score.Segment == segment {
+			members = append(members, score)
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"window_days": windowDays,
+		"lapsed_days": lapsedDays,
+		"segments":    summary,
+		"members":     members,
+	})
+}
+
+// GetInactiveMembers ดึงสมาชิกที่ไม่ได้มาใช้บริการเกิน N วัน
+func GetInactiveMembers(c *fiber.Ctx) error {
+	days := c.QueryInt("days", 60)
+	if days <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "days must be positive"})
+	}
+
+	query := database.DB.Where("is_active = ? AND erased_at IS NULL", true).
+		Where("last_visit IS NULL OR last_visit < ?", time.Now().AddDate(0, 0, -days))
+
+	// เฉพาะสมาชิกที่ยินยอมรับข่าวสาร สำหรับทำแคมเปญดึงลูกค้ากลับ
+	if c.QueryBool("marketing_only", false) {
+		query = query.Where("marketing_consent = ?", true)
+	}
+
+	var members []models.Member
+	result := query.Order("last_visit ASC").Find(&members)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"days":    days,
+		"count":   len(members),
+		"members": members,
+	})
+}
+
+// GetPointLiability คำนวณมูลค่าคะแนนคงค้างเป็นเงินบาทสำหรับบันทึกบัญชี
+// มูลค่าต่อคะแนนคำนวณจากรางวัลส่วนลดที่เปิดใช้งาน หรือกำหนดผ่าน point_value
+func GetPointLiability(c *fiber.Ctx) error {
+	pointValue := c.QueryFloat("point_value", 0)
+	if pointValue < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "point_value must not be negative"})
+	}
+	if pointValue == 0 {
+		pointValue = discountPointValue(database.DB)
+	}
+
+	var byTier []struct {
+		Tier            string  `json:"tier"`
+		Members         int64   `json:"members"`
+		AvailablePoints int64   `json:"available_points"`
+		Value           float64 `json:"value"`
+	}
+	result := database.DB.Model(&models.Member{}).
+		Select("tier, COUNT(*) AS members, COALESCE(SUM(available_points), 0) AS available_points").
+		Where("available_points > 0 AND merged_into_id IS NULL").
+		Group("tier").
+		Scan(&byTier)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	var totalPoints int64
+	for i := range byTier {
+		byTier[i].Value = roundBaht(float64(byTier[i].AvailablePoints) * pointValue)
+		totalPoints += byTier[i].AvailablePoints
+	}
+
+	return c.JSON(fiber.Map{
+		"as_of":                  time.Now(),
+		"point_value":            pointValue,
+		"outstanding_points":     totalPoints,
+		"outstanding_value_baht": roundBaht(float64(totalPoints) * pointValue),
+		"by_tier":                byTier,
+	})
+}
+
+// calculateRFM คำนวณคะแนน RFM ของสมาชิกที่ใช้งานอยู่ทั้งหมด โดยให้คะแนนตามลำดับ (quintile)
+func calculateRFM(db *gorm.DB, now, since time.Time, lapsedDays int) ([]memberRFM, error) {
+	var members []models.Member
+	if err := db.Where("is_active = ? AND erased_at IS NULL", true).Find(&members).Error; err != nil {
+		return nil, err
+	}
+
+	activity, err := loadMemberActivity(db, since)
+	if err != nil {
+		return nil, err
+	}
+
+	scores := make([]memberRFM, len(members))
+	for i, member := range members {
+		act := activity[member.ID]
+
+		lastVisit := member.LastVisit
+		if act.LastVisit != nil && (lastVisit == nil || act.LastVisit.After(*lastVisit)) {
+			lastVisit = act.LastVisit
+		}
+
+		scores[i] = memberRFM{
+			MemberID:        member.ID,
+			MemberNumber:    member.MemberNumber,
+			Name:            member.Name,
+			Tier:            member.Tier,
+			LastVisit:       lastVisit,
+			Frequency:       act.Visits,
+			Monetary:        roundBaht(act.Spend),
+			AvailablePoints: member.AvailablePoints,
+		}
+		if lastVisit != nil {
+			days := int(now.Sub(*lastVisit).Hours() / 24)
+			scores[i].RecencyDays = &days
+		}
+	}
+
+	assignQuintiles(scores, func(s memberRFM) float64 {
+		if s.RecencyDays == nil {
+			return math.Inf(-1)
+		}
+		return -float64(*s.RecencyDays) // มาล่าสุดได้คะแนนสูง
+	}, func(s *memberRFM, score int) { s.RecencyScore = score })
+	assignQuintiles(scores, func(s memberRFM) float64 {
+		return float64(s.Frequency)
+	}, func(s *memberRFM, score int) { s.FrequencyScore = score })
+	assignQuintiles(scores, func(s memberRFM) float64 {
+		return s.Monetary
+	}, func(s *memberRFM, score int) { s.MonetaryScore = score })
+
+	for i := range scores {
+		scores[i].Segment = rfmSegment(scores[i], lapsedDays)
+	}
+
+	return scores, nil
+}
+
+// loadMemberActivity รวมจำนวนครั้งและยอดใช้จ่ายของสมาชิกตั้งแต่วันที่กำหนด
+// นับจากออเดอร์ที่ผูกกับสมาชิก และการบันทึกยอดซื้อที่ไม่มีออเดอร์อ้างอิง
+func loadMemberActivity(db *gorm.DB, since time.Time) (map[string]memberActivity, error) {
+	activity := map[string]memberActivity{}
+
+	var fromOrders []memberActivity
+	err := db.Model(&models.Order{}).
+		Select("member_id, COUNT(*) AS visits, COALESCE(SUM(total_amount), 0) AS spend, MAX(created_at) AS last_visit").
+		Where("member_id IS NOT NULL AND status <> ? AND created_at >= ?", models.OrderStatusCancelled, since).
+		Group("member_id").
+		Scan(&fromOrders).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var fromPoints []memberActivity
+	err = db.Model(&models.PointHistory{}).
+		Select("member_id, COUNT(*) AS visits, COALESCE(SUM(spent_amount), 0) AS spend, MAX(created_at) AS last_visit").
+		Where("spent_amount IS NOT NULL AND order_id IS NULL AND created_at >= ?", since).
+		Group("member_id").
+		Scan(&fromPoints).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rows := range [][]memberActivity{fromOrders, fromPoints} {
+		for _, row := range rows {
+			act := activity[row.MemberID]
+			act.MemberID = row.MemberID
+			act.Visits += row.Visits
+			act.Spend += row.Spend
+			if row.LastVisit != nil && (act.LastVisit == nil || row.LastVisit.After(*act.LastVisit)) {
+				act.LastVisit = row.LastVisit
+			}
+			activity[row.MemberID] = act
+		}
+	}
+
+	return activity, nil
+}
+
+// assignQuintiles เรียงตามค่าแล้วให้คะแนน 1-5 ค่าเท่ากันได้คะแนนเท่ากัน
+func assignQuintiles(scores []memberRFM, value func(memberRFM) float64, set func(*memberRFM, int)) {
+	n := len(scores)
+	if n == 0 {
+		return
+	}
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return value(scores[order[a]]) < value(scores[order[b]])
+	})
+
+	score := 1
+	for pos, idx := range order {
+		if pos > 0 && value(scores[idx]) != value(scores[order[pos-1]]) {
+			score = pos*5/n + 1
+		}
+		set(&scores[idx], score)
+	}
+}
+
+// rfmSegment จัดกลุ่มสมาชิกจากคะแนน RFM
+func rfmSegment(s memberRFM, lapsedDays int) string {
+	switch {
+	case s.RecencyDays == nil || *s.RecencyDays >= lapsedDays:
+		return segmentLapsed
+	case s.RecencyScore >= 4 && s.FrequencyScore >= 4 && s.MonetaryScore >= 4:
+		return segmentChampions
+	case s.RecencyScore <= 2 && s.FrequencyScore+s.MonetaryScore >= 6:
+		return segmentAtRisk
+	case s.FrequencyScore >= 4:
+		return segmentLoyal
+	default:
+		return segmentRegular
+	}
+}
+
+// discountPointValue มูลค่าเฉลี่ยต่อคะแนนจากรางวัลส่วนลดแบบจำนวนเงินที่เปิดใช้งาน
+func discountPointValue(db *gorm.DB) float64 {
+	var totals struct {
+		Baht   float64
+		Points float64
+	}
+	db.Model(&models.Reward{}).
+		Select("COALESCE(SUM(discount_amount), 0) AS baht, COALESCE(SUM(point_cost), 0) AS points").
+		Where("type = ? AND is_active = ? AND discount_amount > 0 AND point_cost > 0", "DISCOUNT", true).
+		Scan(&totals)
+
+	if totals.Points == 0 {
+		return 0
+	}
+	return totals.Baht / totals.Points
+}
+
+func roundBaht(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// GetReferral ดึงรหัสแนะนำเพื่อนและสถิติการแนะนำของสมาชิก
+func GetReferral(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var member models.Member
+	if err := database.DB.First(&member, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
+
+	var referredCount int64
+	database.DB.Model(&models.Member{}).Where("referred_by_id = ?", member.ID).Count(&referredCount)
+
+	var awardedCount int64
+	database.DB.Model(&models.LoyaltyAward{}).
+		Where("member_id = ? AND type = ? AND award_key <> ?", member.ID, "REFERRAL", member.ID).
+		Count(&awardedCount)
+
+	return c.JSON(fiber.Map{
+		"referral_code":    member.ReferralCode,
+		"referred_members": referredCount,
+		"rewarded_members": awardedCount,
+	})
+}
+
+// activePointRule ดึงกฎการให้คะแนนที่ใช้งานอยู่ตามประเภท (เลือกลำดับความสำคัญสูงสุด)
+func activePointRule(db *gorm.DB, ruleType string, now time.Time) (*models.PointRule, error) {
+	var rule models.PointRule
+	err := db.Where("type = ? AND is_active = ? AND earn_points > 0", ruleType, true).
+		Where("(start_date IS NULL OR start_date <= ?) AND (end_date IS NULL OR end_date >= ?)", now, now).
+		Order("priority DESC").
+		First(&rule).Error
+	if err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// grantAwardOnce ให้คะแนนพิเศษหนึ่งครั้งต่อ (สมาชิก, ประเภท, key)
+// คืน false ถ้าเคยให้ไปแล้ว ดัชนี unique ของ LoyaltyAward กันการให้ซ้ำกรณีทำงานพร้อมกัน
+func grantAwardOnce(tx *gorm.DB, memberID, awardType, key string, entry pointEntry) (bool, error) {
+	var count int64
+	tx.Model(&models.LoyaltyAward{}).
+		Where("member_id = ? AND type = ? AND award_key = ?", memberID, awardType, key).
+		Count(&count)
+	if count > 0 {
+		return false, nil
+	}
+
+	award := models.LoyaltyAward{
+		MemberID: memberID,
+		Type:     awardType,
+		AwardKey: key,
+		Points:   entry.Points,
+	}
+	if err := tx.Create(&award).Error; err != nil {
+		return false, err
+	}
+
+	entry.MemberID = memberID
+	entry.ReferenceType = stringPtr(awardType)
+	entry.ReferenceID = &award.ID
+	history, err := postPointEntry(tx, entry)
+	if err != nil {
+		return false, err
+	}
+
+	if history != nil {
+		if err := tx.Model(&award).Update("point_history_id", history.ID).Error; err != nil {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// grantBirthdayPoints ให้คะแนนวันเกิดแก่สมาชิกที่เกิดวันนี้ ปีละครั้ง
+// สมาชิกที่เกิด 29 ก.พ. จะได้รับในวันที่ 28 ก.พ. ของปีที่ไม่ใช่ปีอธิกสุรทิน
+func grantBirthdayPoints(db *gorm.DB, now time.Time) (int, error) {
+	rule, err := activePointRule(db, "BIRTHDAY", now)
+	if err == gorm.ErrRecordNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	month, day := int(now.Month()), now.Day()
+	query := db.Where("is_active = ? AND date_of_birth IS NOT NULL", true)
+	if month == 2 && day == 28 && !isLeapYear(now.Year()) {
+		query = query.Where("MONTH(date_of_birth) = 2 AND DAY(date_of_birth) IN (28, 29)")
+	} else {
+		query = query.Where("MONTH(date_of_birth) = ? AND DAY(date_of_birth) = ?", month, day)
+	}
+
+	var members []models.Member
+	if err := query.Find(&members).Error; err != nil {
+		return 0, err
+	}
+
+	granted := 0
+	year := strconv.Itoa(now.Year())
+	for _, member := range members {
+		if len(rule.ApplicableTiers) > 0 && !containsTier(rule.ApplicableTiers, member.Tier) {
+			continue
+		}
+
+		tx := db.Begin()
+		ok, err := grantAwardOnce(tx, member.ID, "BIRTHDAY", year, pointEntry{
+			Type:        "BONUS",
+			Points:      *rule.EarnPoints,
+			Description: fmt.Sprintf("คะแนนวันเกิดปี %s", year),
+			ExpiresAt:   getPointExpiryDate(),
+		})
+		if err != nil {
+			tx.Rollback()
+			return granted, err
+		}
+		tx.Commit()
+
+		if ok {
+			granted++
+		}
+	}
+
+	return granted, nil
+}
+
+// awardReferralBonus ให้คะแนนแก่ผู้แนะนำและเพื่อนที่ถูกแนะนำเมื่อเพื่อนปิดออเดอร์แรก
+// ต้องเรียกภายใน transaction เดียวกับการปิดออเดอร์ orderID คือออเดอร์ที่กำลังปิด
+func awardReferralBonus(tx *gorm.DB, referee models.Member, orderID string) error {
+	if referee.ReferredByID == nil || *referee.ReferredByID == referee.ID {
+		return nil
+	}
+
+	// ให้เฉพาะออเดอร์แรกที่ปิดสำเร็จ
+	var completedOrders int64
+	err := tx.Model(&models.Order{}).
+		Where("member_id = ? AND status = ? AND id <> ?", referee.ID, models.OrderStatusCompleted, orderID).
+		Count(&completedOrders).Error
+	if err != nil || completedOrders > 0 {
+		return err
+	}
+
+	rule, err := activePointRule(tx, "REFERRAL", time.Now())
+	if err == gorm.ErrRecordNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var referrer models.Member
+	if err := tx.First(&referrer, "id = ? AND is_active = ?", *referee.ReferredByID, true).Error; err != nil {
+		return nil
+	}
+
+	// ทั้งสองฝ่ายใช้ ID ของเพื่อนที่ถูกแนะนำเป็น key จึงได้รับเพียงครั้งเดียวต่อการแนะนำ
+	ok, err := grantAwardOnce(tx, referee.ID, "REFERRAL", referee.ID, pointEntry{
+		Type:        "BONUS",
+		Points:      *rule.EarnPoints,
+		Description: fmt.Sprintf("คะแนนสมัครผ่านการแนะนำของสมาชิก %s", referrer.MemberNumber),
+		ExpiresAt:   getPointExpiryDate(),
+	})
+	if err != nil || !ok {
+		return err
+	}
+
+	_, err = grantAwardOnce(tx, referrer.ID, "REFERRAL", referee.ID, pointEntry{
+		Type:        "BONUS",
+		Points:      *rule.EarnPoints,
+		Description: fmt.Sprintf("คะแนนแนะนำเพื่อน สมาชิก %s", referee.MemberNumber),
+		ExpiresAt:   getPointExpiryDate(),
+	})
+	return err
+}
+
+func generateReferralCode() string {
+	return "REF" + strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:6])
+}
+
+func isLeapYear(year int) bool {
+	return year%4 == 0 && (year%100 != 0 || year%400 == 0)
+}
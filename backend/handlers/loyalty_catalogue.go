@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// CreateReward สร้างรางวัลใหม่
+func CreateReward(c *fiber.Ctx) error {
+	// เปิดใช้งานเมื่อไม่ระบุ ส่ง is_active: false มาเองได้
+	reward := models.Reward{IsActive: true}
+
+	if err := c.BodyParser(&reward); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if err := validateReward(reward); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	reward.TotalRedemptions = 0
+
+	result := database.DB.Create(&reward)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.Status(201).JSON(reward)
+}
+
+// UpdateReward แก้ไขรางวัล
+func UpdateReward(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var reward models.Reward
+	if err := database.DB.First(&reward, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Reward not found"})
+	}
+
+	totalRedemptions := reward.TotalRedemptions
+
+	if err := c.BodyParser(&reward); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	// สถิติแก้ผ่าน API ไม่ได้
+	reward.ID = id
+	reward.TotalRedemptions = totalRedemptions
+
+	if err := validateReward(reward); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := database.DB.Save(&reward).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(reward)
+}
+
+// DeactivateReward ปิดการใช้งานรางวัล (ไม่ลบเพื่อเก็บประวัติการแลก)
+func DeactivateReward(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	result := database.DB.Model(&models.Reward{}).Where("id = ?", id).Update("is_active", false)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	if result.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Reward not found"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Reward deactivated successfully"})
+}
+
+// GetPointRules ดึงรายการกฎการให้คะแนน
+func GetPointRules(c *fiber.Ctx) error {
+	var rules []models.PointRule
+
+	query := database.DB.Model(&models.PointRule{})
+
+	if ruleType := c.Query("type"); ruleType != "" {
+		query = query.Where("type = ?", ruleType)
+	}
+
+	if !c.QueryBool("include_inactive", false) {
+		query = query.Where("is_active = ?", true)
+	}
+
+	result := query.Order("type ASC, priority DESC").Find(&rules)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(rules)
+}
+
+// CreatePointRule สร้างกฎการให้คะแนนใหม่
+func CreatePointRule(c *fiber.Ctx) error {
+	// เปิดใช้งานเมื่อไม่ระบุ ส่ง is_active: false มาเองได้
+	rule := models.PointRule{IsActive: true}
+
+	if err := c.BodyParser(&rule); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if err := validatePointRule(rule); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	result := database.DB.Create(&rule)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.Status(201).JSON(rule)
+}
+
+// UpdatePointRule แก้ไขกฎการให้คะแนน
+func UpdatePointRule(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var rule models.PointRule
+	if err := database.DB.First(&rule, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Point rule not found"})
+	}
+
+	if err := c.BodyParser(&rule); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	rule.ID = id
+
+	if err := validatePointRule(rule); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := database.DB.Save(&rule).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(rule)
+}
+
+// DeactivatePointRule ปิดการใช้งานกฎการให้คะแนน
+func DeactivatePointRule(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	result := database.DB.Model(&models.PointRule{}).Where("id = ?", id).Update("is_active", false)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	if result.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Point rule not found"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Point rule deactivated successfully"})
+}
+
+// validateReward ตรวจสอบข้อมูลรางวัลตามประเภท
+func validateReward(reward models.Reward) error {
+	if reward.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if reward.PointCost < 0 {
+		return fmt.Errorf("point_cost must not be negative")
+	}
+	if reward.UsageLimit != nil && *reward.UsageLimit <= 0 {
+		return fmt.Errorf("usage_limit must be positive")
+	}
+	if reward.Stock != nil && *reward.Stock < 0 {
+		return fmt.Errorf("stock must not be negative")
+	}
+	if err := validateDateWindow(reward.StartDate, reward.EndDate); err != nil {
+		return err
+	}
+
+	switch reward.Type {
+	case "FREE_ITEM":
+		if err := validateFreeProduct(reward.FreeProductID); err != nil {
+			return err
+		}
+
+	case "DISCOUNT":
+		hasAmount := reward.DiscountAmount != nil && *reward.DiscountAmount > 0
+		hasPercent := reward.DiscountPercent != nil && *reward.DiscountPercent > 0
+		if !hasAmount && !hasPercent {
+			return fmt.Errorf("DISCOUNT reward requires discount_amount or discount_percent")
+		}
+		if hasAmount && hasPercent {
+			return fmt.Errorf("DISCOUNT reward accepts either discount_amount or discount_percent, not both")
+		}
+		if hasPercent && *reward.DiscountPercent > 100 {
+			return fmt.Errorf("discount_percent must not exceed 100")
+		}
+
+	case "BUY_X_GET_Y":
+		if reward.BuyQuantity == nil || *reward.BuyQuantity <= 0 {
+			return fmt.Errorf("BUY_X_GET_Y reward requires a positive buy_quantity")
+		}
+		if reward.GetQuantity == nil || *reward.GetQuantity <= 0 {
+			return fmt.Errorf("BUY_X_GET_Y reward requires a positive get_quantity")
+		}
+		if len(reward.ApplicableProducts) == 0 {
+			return fmt.Errorf("BUY_X_GET_Y reward requires applicable_products to collect stamps")
+		}
+		if err := validateFreeProduct(reward.FreeProductID); err != nil {
+			return err
+		}
+
+	case "PHYSICAL":
+		if reward.Stock == nil {
+			return fmt.Errorf("PHYSICAL reward requires stock")
+		}
+
+	default:
+		return fmt.Errorf("unsupported reward type: %s", reward.Type)
+	}
+
+	return nil
+}
+
+func validateFreeProduct(productID *string) error {
+	if productID == nil || *productID == "" {
+		return fmt.Errorf("free_product_id is required")
+	}
+
+	var product models.Product
+	if err := database.DB.First(&product, "id = ?", *productID).Error; err != nil {
+		return fmt.Errorf("free product not found")
+	}
+
+	return nil
+}
+
+// validatePointRule ตรวจสอบข้อมูลกฎการให้คะแนนตามประเภท
+func validatePointRule(rule models.PointRule) error {
+	if rule.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if err := validateDateWindow(rule.StartDate, rule.EndDate); err != nil {
+		return err
+	}
+	if rule.BonusMultiplier != nil && *rule.BonusMultiplier <= 0 {
+		return fmt.Errorf("bonus_multiplier must be positive")
+	}
+
+	switch rule.Type {
+	case "PURCHASE":
+		if rule.SpendAmount == nil || *rule.SpendAmount <= 0 {
+			return fmt.Errorf("PURCHASE rule requires a positive spend_amount")
+		}
+		if rule.EarnPoints == nil || *rule.EarnPoints <= 0 {
+			return fmt.Errorf("PURCHASE rule requires positive earn_points")
+		}
+
+	case "BIRTHDAY", "REFERRAL", "BONUS":
+		if rule.EarnPoints == nil || *rule.EarnPoints <= 0 {
+			return fmt.Errorf("%s rule requires positive earn_points", rule.Type)
+		}
+
+	default:
+		return fmt.Errorf("unsupported rule type: %s", rule.Type)
+	}
+
+	return nil
+}
+
+func validateDateWindow(startDate, endDate *time.Time) error {
+	if startDate != nil && endDate != nil && endDate.Before(*startDate) {
+		return fmt.Errorf("end_date must be after start_date")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"log"
+	"time"
+)
+
+// StartLoyaltyJobs เริ่มงานเบื้องหลังของระบบสมาชิกที่ทำงานวันละครั้ง
+func StartLoyaltyJobs() {
+	go func() {
+		runDailyLoyaltyJobs()
+
+		ticker := time.NewTicker(24 * time.Hour)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			runDailyLoyaltyJobs()
+		}
+	}()
+}
+
+func runDailyLoyaltyJobs() {
+	changed, err := reviewMemberTiers(database.DB, time.Now())
+	if err != nil {
+		log.Println("Tier review failed:", err)
+	} else if changed > 0 {
+		log.Printf("Tier review changed %d members", changed)
+	}
+
+	granted, err := grantBirthdayPoints(database.DB, time.Now())
+	if err != nil {
+		log.Println("Birthday points failed:", err)
+	} else if granted > 0 {
+		log.Printf("Birthday points granted to %d members", granted)
+	}
+}
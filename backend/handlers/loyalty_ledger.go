@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"errors"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// errInsufficientPoints คะแนนคงเหลือไม่พอสำหรับการหักคะแนน
+var errInsufficientPoints = errors.New("insufficient points")
+
+// pointEntry รายการเปลี่ยนแปลงคะแนนหนึ่งรายการใน ledger
+type pointEntry struct {
+	MemberID      string
+	OrderID       *string
+	Type          string // EARN, REDEEM, EXPIRE, BONUS, ADJUST
+	Points        int    // จำนวนคะแนน (+/-)
+	Description   string
+	SpentAmount   *float64 // ยอดใช้จ่ายที่ได้รับคะแนน (ถ้ามี)
+	ExpiresAt     *time.Time
+	ReferenceType *string
+	ReferenceID   *string
+}
+
+// postPointEntry บันทึก PointHistory และปรับยอดคะแนนของสมาชิกด้วย relative update
+// ต้องเรียกภายใน transaction เพื่อให้ประวัติและยอดคงเหลือตรงกันเสมอ
+// รายการ 0 คะแนนบันทึกเฉพาะเมื่อมียอดใช้จ่าย เพื่อให้ยังนับเป็นยอดประเมินระดับสมาชิก
+func postPointEntry(tx *gorm.DB, entry pointEntry) (*models.PointHistory, error) {
+	if entry.Points == 0 {
+		if entry.SpentAmount == nil {
+			return nil, nil
+		}
+		return createPointHistory(tx, entry)
+	}
+
+	var updates map[string]interface{}
+	query := tx.Model(&models.Member{}).Where("id = ?", entry.MemberID)
+
+	if entry.Points > 0 {
+		updates = map[string]interface{}{
+			"total_points":     gorm.Expr("total_points + ?", entry.Points),
+			"available_points": gorm.Expr("available_points + ?", entry.Points),
+		}
+	} else {
+		deduct := -entry.Points
+		updates = map[string]interface{}{
+			"available_points": gorm.Expr("available_points - ?", deduct),
+		}
+		// คะแนนที่แลกรางวัลนับเป็นคะแนนที่ใช้แล้ว ส่วนคะแนนหมดอายุหรือปรับลดไม่นับ
+		if entry.Type == "REDEEM" {
+			updates["used_points"] = gorm.Expr("used_points + ?", deduct)
+		}
+		// ป้องกันยอดติดลบเมื่อมีการหักคะแนนพร้อมกันหลายรายการ
+		query = query.Where("available_points >= ?", deduct)
+	}
+
+	result := query.Updates(updates)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		if entry.Points < 0 {
+			return nil, errInsufficientPoints
+		}
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	return createPointHistory(tx, entry)
+}
+
+// createPointHistory บันทึกรายการในประวัติคะแนน
+func createPointHistory(tx *gorm.DB, entry pointEntry) (*models.PointHistory, error) {
+	history := models.PointHistory{
+		BaseModel:     models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		MemberID:      entry.MemberID,
+		OrderID:       entry.OrderID,
+		Type:          entry.Type,
+		Points:        entry.Points,
+		Description:   entry.Description,
+		SpentAmount:   entry.SpentAmount,
+		ExpiresAt:     entry.ExpiresAt,
+		ReferenceType: entry.ReferenceType,
+		ReferenceID:   entry.ReferenceID,
+	}
+	if err := tx.Create(&history).Error; err != nil {
+		return nil, err
+	}
+
+	return &history, nil
+}
+
+// recordMemberVisit อัพเดทยอดใช้จ่าย จำนวนออเดอร์ และวันที่มาใช้บริการล่าสุดแบบ relative update
+func recordMemberVisit(tx *gorm.DB, memberID string, spentAmount *float64) error {
+	updates := map[string]interface{}{
+		"last_visit": time.Now(),
+	}
+	if spentAmount != nil {
+		updates["total_spent"] = gorm.Expr("total_spent + ?", *spentAmount)
+		updates["total_orders"] = gorm.Expr("total_orders + 1")
+	}
+
+	return tx.Model(&models.Member{}).Where("id = ?", memberID).Updates(updates).Error
+}
+
+// lockMember อ่านข้อมูลสมาชิกพร้อมล็อกแถว (SELECT ... FOR UPDATE) จนจบ transaction
+func lockMember(tx *gorm.DB, memberID string) (*models.Member, error) {
+	var member models.Member
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&member, "id = ?", memberID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &member, nil
+}
+
+// pointDrift ยอดคะแนนที่ไม่ตรงกับประวัติคะแนนของสมาชิก
+type pointDrift struct {
+	MemberID                string `json:"member_id"`
+	MemberNumber            string `json:"member_number"`
+	Name                    string `json:"name"`
+	TotalPoints             int    `json:"total_points"`
+	AvailablePoints         int    `json:"available_points"`
+	UsedPoints              int    `json:"used_points"`
+	ExpectedTotalPoints     int    `json:"expected_total_points"`
+	ExpectedAvailablePoints int    `json:"expected_available_points"`
+	ExpectedUsedPoints      int    `json:"expected_used_points"`
+}
+
+// findPointDrift คำนวณยอดคะแนนใหม่จาก PointHistory และคืนเฉพาะสมาชิกที่ยอดไม่ตรง
+// memberID ว่างหมายถึงตรวจทุกคน
+func findPointDrift(db *gorm.DB, memberID string) ([]pointDrift, error) {
+	var rows []pointDrift
+	err := db.Raw(`
+		SELECT
+			m.id AS member_id,
+			m.member_number,
+			m.name,
+			m.total_points,
+			m.available_points,
+			m.used_points,
+			COALESCE(SUM(CASE WHEN ph.points > 0 THEN ph.points ELSE 0 END), 0) AS expected_total_points,
+			COALESCE(SUM(ph.points), 0) AS expected_available_points,
+			COALESCE(SUM(CASE WHEN ph.type = 'REDEEM' AND ph.points < 0 THEN -ph.points ELSE 0 END), 0) AS expected_used_points
+		FROM members m
+		LEFT JOIN point_histories ph ON ph.member_id = m.id AND ph.deleted_at IS NULL
+		WHERE m.deleted_at IS NULL AND (? = '' OR m.id = ?)
+		GROUP BY m.id, m.member_number, m.name, m.total_points, m.available_points, m.used_points
+	`, memberID, memberID).Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	drifts := make([]pointDrift, 0)
+	for _, row := range rows {
+		if row.TotalPoints != row.ExpectedTotalPoints ||
+			row.AvailablePoints != row.ExpectedAvailablePoints ||
+			row.UsedPoints != row.ExpectedUsedPoints {
+			drifts = append(drifts, row)
+		}
+	}
+
+	return drifts, nil
+}
+
+// ReconcilePoints ตรวจสอบยอดคะแนนสมาชิกเทียบกับประวัติคะแนน
+// GET รายงานยอดที่คลาดเคลื่อน ส่วน POST จะแก้ยอดคะแนนให้ตรงกับประวัติด้วย
+func ReconcilePoints(c *fiber.Ctx) error {
+	fix := c.Method() == fiber.MethodPost
+
+	drifts, err := findPointDrift(database.DB, "")
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	fixed := 0
+	if fix {
+		// แก้ทีละคนภายใต้ล็อก และคำนวณใหม่หลังล็อก ยอดอาจเปลี่ยนไปแล้วระหว่างตรวจ
+		for _, drift := range drifts {
+			err := database.DB.Transaction(func(tx *gorm.DB) error {
+				if _, err := lockMember(tx, drift.MemberID); err != nil {
+					return err
+				}
+
+				current, err := findPointDrift(tx, drift.MemberID)
+				if err != nil || len(current) == 0 {
+					return err
+				}
+
+				err = tx.Model(&models.Member{}).Where("id = ?", drift.MemberID).Updates(map[string]interface{}{
+					"total_points":     current[0].ExpectedTotalPoints,
+					"available_points": current[0].ExpectedAvailablePoints,
+					"used_points":      current[0].ExpectedUsedPoints,
+				}).Error
+				if err != nil {
+					return err
+				}
+				fixed++
+				return nil
+			})
+			if err != nil {
+				return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+			}
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"members_with_drift": len(drifts),
+		"drifts":             drifts,
+		"fixed":              fixed,
+	})
+}
@@ -0,0 +1,610 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var errMergeRollback = errors.New("merge preview")
+
+// memberMergeResult ผลการรวมบัญชีสมาชิก
+type memberMergeResult struct {
+	Preview      bool             `json:"preview"`
+	Source       models.Member    `json:"source"`
+	Target       models.Member    `json:"target"`
+	RecordsMoved map[string]int64 `json:"records_moved"`
+	PointsMoved  int              `json:"points_moved"`
+	SpendMoved   float64          `json:"spend_moved"`
+	FromTier     string           `json:"from_tier"`
+	ToTier       string           `json:"to_tier"`
+	MergeID      string           `json:"merge_id,omitempty"`
+}
+
+// memberMergeSnapshot ยอดของบัญชีต้นทางก่อนรวม เก็บใน MemberMerge.SourceSnapshot
+// เก็บเฉพาะรหัสและยอด ไม่เก็บข้อมูลส่วนบุคคล ประวัติการรวมจึงไม่ต้องลบตามคำขอลบข้อมูล
+type memberMergeSnapshot struct {
+	ID              string  `json:"id"`
+	MemberNumber    string  `json:"member_number"`
+	Tier            string  `json:"tier"`
+	TotalPoints     int     `json:"total_points"`
+	AvailablePoints int     `json:"available_points"`
+	UsedPoints      int     `json:"used_points"`
+	TotalSpent      float64 `json:"total_spent"`
+	TotalOrders     int     `json:"total_orders"`
+}
+
+// duplicateCandidate คู่สมาชิกที่อาจเป็นคนเดียวกัน
+type duplicateCandidate struct {
+	MemberA models.Member `json:"member_a"`
+	MemberB models.Member `json:"member_b"`
+	Score   float64       `json:"score"`   // ความคล้าย 0-1
+	Reasons []string      `json:"reasons"` // EMAIL, EMAIL_LOCAL, NAME
+}
+
+// MergeMembers รวมบัญชีสมาชิกต้นทางเข้ากับบัญชีปลายทาง
+// ส่ง preview=true เพื่อดูผลลัพธ์โดยไม่บันทึก
+func MergeMembers(c *fiber.Ctx) error {
+	var request struct {
+		SourceID string  `json:"source_id"`
+		TargetID string  `json:"target_id"`
+		Preview  bool    `json:"preview"`
+		Reason   *string `json:"reason"`
+		MergedBy *string `json:"merged_by"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if request.SourceID == "" || request.TargetID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "source_id and target_id are required"})
+	}
+
+	if request.SourceID == request.TargetID {
+		return c.Status(400).JSON(fiber.Map{"error": "Cannot merge a member into itself"})
+	}
+
+	var result *memberMergeResult
+
+	// โหมด preview รวมบัญชีจริงใน transaction แล้ว rollback เพื่อให้ได้ผลลัพธ์ตรงกับการรวมจริง
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		result, err = mergeMembers(tx, request.SourceID, request.TargetID, request.Reason, request.MergedBy)
+		if err != nil {
+			return err
+		}
+		if request.Preview {
+			result.Preview = true
+			return errMergeRollback
+		}
+		return nil
+	})
+
+	if err != nil && err != errMergeRollback {
+		var mergeErr mergeError
+		if errors.As(err, &mergeErr) {
+			return c.Status(mergeErr.status).JSON(fiber.Map{"error": mergeErr.message})
+		}
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if request.Preview {
+		return c.JSON(result)
+	}
+
+	return c.Status(201).JSON(result)
+}
+
+// GetMemberMerges ดึงประวัติการรวมบัญชี
+func GetMemberMerges(c *fiber.Ctx) error {
+	var merges []models.MemberMerge
+
+	query := database.DB.Model(&models.MemberMerge{})
+	if memberID := c.Query("member_id"); memberID != "" {
+		query = query.Where("source_member_id = ? OR target_member_id = ?", memberID, memberID)
+	}
+
+	result := query.Order("created_at DESC").Find(&merges)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(merges)
+}
+
+// duplicateNamePrefix จำนวนอักษรต้นของชื่อที่ใช้จับกลุ่มก่อนเทียบความคล้าย
+const duplicateNamePrefix = 3
+
+// maxDuplicateCandidates จำนวนคู่สูงสุดต่อหน้า
+const maxDuplicateCandidates = 500
+
+// FindDuplicateMembers หาสมาชิกที่อาจสมัครซ้ำจากอีเมลและความคล้ายของชื่อ
+// จับกลุ่มตามชื่อผู้ใช้ของอีเมลและอักษรต้นของชื่อก่อน แล้วเทียบความคล้ายเฉพาะคู่ในกลุ่มเดียวกัน
+func FindDuplicateMembers(c *fiber.Ctx) error {
+	minScore := c.QueryFloat("min_score", 0.85)
+	limit := c.QueryInt("limit", 100)
+	offset := c.QueryInt("offset", 0)
+	if limit <= 0 || limit > maxDuplicateCandidates {
+		limit = maxDuplicateCandidates
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	var members []models.Member
+	result := database.DB.Where("erased_at IS NULL AND merged_into_id IS NULL").
+		Order("created_at ASC").
+		Find(&members)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	names := make([][]rune, len(members))
+	blocks := make(map[string][]int)
+	for i, member := range members {
+		names[i] = []rune(normalizeName(member.Name))
+		// อีเมลเดียวกันมีชื่อผู้ใช้เดียวกันด้วย จึงจับกลุ่มตามชื่อผู้ใช้อย่างเดียวพอ
+		if email := normalizeEmail(member.Email); email != "" {
+			key := "email:" + emailLocalPart(email)
+			blocks[key] = append(blocks[key], i)
+		}
+		if len(names[i]) > 0 {
+			prefix := names[i]
+			if len(prefix) > duplicateNamePrefix {
+				prefix = prefix[:duplicateNamePrefix]
+			}
+			key := "name:" + string(prefix)
+			blocks[key] = append(blocks[key], i)
+		}
+	}
+
+	candidates := []duplicateCandidate{}
+	compared := make(map[[2]int]bool)
+	for _, block := range blocks {
+		for x := 0; x < len(block); x++ {
+			for y := x + 1; y < len(block); y++ {
+				i, j := block[x], block[y]
+				if compared[[2]int{i, j}] {
+					continue
+				}
+				compared[[2]int{i, j}] = true
+
+				score, reasons := duplicateScore(members[i], members[j], names[i], names[j], minScore)
+				if len(reasons) == 0 || score < minScore {
+					continue
+				}
+
+				candidates = append(candidates, duplicateCandidate{
+					MemberA: members[i],
+					MemberB: members[j],
+					Score:   score,
+					Reasons: reasons,
+				})
+			}
+		}
+	}
+
+	// เรียงตามคะแนนแล้วตามลำดับการสมัคร ผลแต่ละหน้าจึงคงที่
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].Score != candidates[j].Score {
+			return candidates[i].Score > candidates[j].Score
+		}
+		if candidates[i].MemberA.CreatedAt != candidates[j].MemberA.CreatedAt {
+			return candidates[i].MemberA.CreatedAt.Before(candidates[j].MemberA.CreatedAt)
+		}
+		return candidates[i].MemberB.CreatedAt.Before(candidates[j].MemberB.CreatedAt)
+	})
+
+	if offset > len(candidates) {
+		offset = len(candidates)
+	}
+	candidates = candidates[offset:]
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	return c.JSON(candidates)
+}
+
+// duplicateScore ความคล้ายของสมาชิกสองคนจากอีเมลและชื่อ พร้อมเหตุผล
+func duplicateScore(a, b models.Member, nameA, nameB []rune, minScore float64) (float64, []string) {
+	score := 0.0
+	var reasons []string
+
+	emailA, emailB := normalizeEmail(a.Email), normalizeEmail(b.Email)
+	if emailA != "" && emailB != "" {
+		if emailA == emailB {
+			score = 1
+			reasons = append(reasons, "EMAIL")
+		} else if emailLocalPart(emailA) == emailLocalPart(emailB) {
+			score = 0.9
+			reasons = append(reasons, "EMAIL_LOCAL")
+		}
+	}
+
+	if nameScore := similarity(nameA, nameB); nameScore >= minScore {
+		reasons = append(reasons, "NAME")
+		if nameScore > score {
+			score = nameScore
+		}
+	}
+
+	return score, reasons
+}
+
+// mergeError ข้อผิดพลาดที่ส่งกลับให้ผู้ใช้พร้อม HTTP status
+type mergeError struct {
+	status  int
+	message string
+}
+
+func (e mergeError) Error() string {
+	return e.message
+}
+
+// mergeMembers ย้ายข้อมูลทั้งหมดจากบัญชีต้นทางไปบัญชีปลายทาง รวมยอด และประเมินระดับใหม่
+// ต้องเรียกภายใน transaction
+func mergeMembers(tx *gorm.DB, sourceID, targetID string, reason, mergedBy *string) (*memberMergeResult, error) {
+	// ล็อกตามลำดับ ID เพื่อป้องกัน deadlock เมื่อมีการรวมสองทิศทางพร้อมกัน
+	ids := []string{sourceID, targetID}
+	sort.Strings(ids)
+
+	locked := map[string]*models.Member{}
+	for _, id := range ids {
+		member, err := lockMember(tx, id)
+		if err != nil {
+			return nil, mergeError{404, "Member not found"}
+		}
+		locked[id] = member
+	}
+	source, target := locked[sourceID], locked[targetID]
+
+	if source.ErasedAt != nil || target.ErasedAt != nil {
+		return nil, mergeError{400, "Member data has been erased"}
+	}
+	if source.MergedIntoID != nil || target.MergedIntoID != nil {
+		return nil, mergeError{400, "Member has already been merged"}
+	}
+
+	snapshot, err := json.Marshal(memberMergeSnapshot{
+		ID:              source.ID,
+		MemberNumber:    source.MemberNumber,
+		Tier:            source.Tier,
+		TotalPoints:     source.TotalPoints,
+		AvailablePoints: source.AvailablePoints,
+		UsedPoints:      source.UsedPoints,
+		TotalSpent:      source.TotalSpent,
+		TotalOrders:     source.TotalOrders,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	moved := map[string]int64{}
+	move := func(name string, model interface{}) error {
+		result := tx.Model(model).Where("member_id = ?", source.ID).Update("member_id", target.ID)
+		moved[name] = result.RowsAffected
+		return result.Error
+	}
+
+	if err := move("point_histories", &models.PointHistory{}); err != nil {
+		return nil, err
+	}
+	if err := move("reward_redemptions", &models.RewardRedemption{}); err != nil {
+		return nil, err
+	}
+	if err := move("tier_upgrades", &models.TierUpgrade{}); err != nil {
+		return nil, err
+	}
+	if err := move("orders", &models.Order{}); err != nil {
+		return nil, err
+	}
+	if err := move("consent_logs", &models.MemberConsentLog{}); err != nil {
+		return nil, err
+	}
+
+	if err := mergeLoyaltyAwards(tx, source.ID, target.ID, moved); err != nil {
+		return nil, err
+	}
+	if err := mergeStampCards(tx, source.ID, target.ID, moved); err != nil {
+		return nil, err
+	}
+
+	// เพื่อนที่บัญชีต้นทางเคยแนะนำ ย้ายมาเป็นของบัญชีปลายทาง
+	result := tx.Model(&models.Member{}).
+		Where("referred_by_id = ? AND id <> ?", source.ID, target.ID).
+		Update("referred_by_id", target.ID)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	moved["referrals"] = result.RowsAffected
+
+	// รหัส OTP ของบัญชีต้นทางใช้ไม่ได้อีก
+	if err := tx.Unscoped().Where("member_id = ?", source.ID).Delete(&models.MemberOTP{}).Error; err != nil {
+		return nil, err
+	}
+
+	// ปิดบัญชีต้นทาง ปล่อยเบอร์โทร อีเมล และรหัสแนะนำให้บัญชีปลายทางใช้ได้
+	err = tx.Model(&models.Member{}).Where("id = ?", source.ID).Updates(map[string]interface{}{
+		"phone":            nil,
+		"email":            nil,
+		"referral_code":    nil,
+		"total_points":     0,
+		"available_points": 0,
+		"used_points":      0,
+		"total_spent":      0,
+		"total_orders":     0,
+		"is_active":        false,
+		"merged_into_id":   target.ID,
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	updates := map[string]interface{}{
+		"total_points":     gorm.Expr("total_points + ?", source.TotalPoints),
+		"available_points": gorm.Expr("available_points + ?", source.AvailablePoints),
+		"used_points":      gorm.Expr("used_points + ?", source.UsedPoints),
+		"total_spent":      gorm.Expr("total_spent + ?", source.TotalSpent),
+		"total_orders":     gorm.Expr("total_orders + ?", source.TotalOrders),
+	}
+
+	// เติมข้อมูลที่บัญชีปลายทางยังไม่มี
+	if target.Phone == nil && source.Phone != nil {
+		updates["phone"] = *source.Phone
+	}
+	if target.Email == nil && source.Email != nil {
+		updates["email"] = *source.Email
+	}
+	if target.DateOfBirth == nil && source.DateOfBirth != nil {
+		updates["date_of_birth"] = *source.DateOfBirth
+	}
+	if target.ReferralCode == nil && source.ReferralCode != nil {
+		updates["referral_code"] = *source.ReferralCode
+	}
+	if source.LastVisit != nil && (target.LastVisit == nil || source.LastVisit.After(*target.LastVisit)) {
+		updates["last_visit"] = *source.LastVisit
+	}
+	if target.ReferredByID != nil && *target.ReferredByID == source.ID {
+		updates["referred_by_id"] = nil
+	}
+
+	if err := tx.Model(&models.Member{}).Where("id = ?", target.ID).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+
+	if err := mergeMemberTier(tx, *source, *target); err != nil {
+		return nil, err
+	}
+
+	var merged models.Member
+	if err := tx.First(&merged, "id = ?", target.ID).Error; err != nil {
+		return nil, err
+	}
+
+	records, err := json.Marshal(moved)
+	if err != nil {
+		return nil, err
+	}
+
+	audit := models.MemberMerge{
+		SourceMemberID: source.ID,
+		TargetMemberID: target.ID,
+		SourceSnapshot: string(snapshot),
+		PointsMoved:    source.AvailablePoints,
+		SpendMoved:     source.TotalSpent,
+		RecordsMoved:   string(records),
+		FromTier:       target.Tier,
+		ToTier:         merged.Tier,
+		Reason:         reason,
+		MergedBy:       mergedBy,
+	}
+	if err := tx.Create(&audit).Error; err != nil {
+		return nil, err
+	}
+
+	return &memberMergeResult{
+		Source:       *source,
+		Target:       merged,
+		RecordsMoved: moved,
+		PointsMoved:  source.AvailablePoints,
+		SpendMoved:   source.TotalSpent,
+		FromTier:     target.Tier,
+		ToTier:       merged.Tier,
+		MergeID:      audit.ID,
+	}, nil
+}
+
+// mergeLoyaltyAwards ย้ายสิทธิ์คะแนนพิเศษ รายการที่บัญชีปลายทางได้รับไปแล้วคงไว้ที่บัญชีต้นทาง
+func mergeLoyaltyAwards(tx *gorm.DB, sourceID, targetID string, moved map[string]int64) error {
+	var awards []models.LoyaltyAward
+	if err := tx.Where("member_id = ?", sourceID).Find(&awards).Error; err != nil {
+		return err
+	}
+
+	for _, award := range awards {
+		var count int64
+		tx.Model(&models.LoyaltyAward{}).
+			Where("member_id = ? AND type = ? AND award_key = ?", targetID, award.Type, award.AwardKey).
+			Count(&count)
+		if count > 0 {
+			continue
+		}
+
+		if err := tx.Model(&award).Update("member_id", targetID).Error; err != nil {
+			return err
+		}
+		moved["loyalty_awards"]++
+	}
+
+	return nil
+}
+
+// mergeStampCards ย้ายบัตรสะสมแสตมป์ ถ้าบัญชีปลายทางมีบัตรของรางวัลเดียวกันจะรวมแสตมป์เข้าด้วยกัน
+func mergeStampCards(tx *gorm.DB, sourceID, targetID string, moved map[string]int64) error {
+	var cards []models.StampCard
+	if err := tx.Preload("Reward").Where("member_id = ?", sourceID).Find(&cards).Error; err != nil {
+		return err
+	}
+
+	for _, card := range cards {
+		err := tx.Model(&models.StampHistory{}).Where("stamp_card_id = ?", card.ID).
+			Update("member_id", targetID).Error
+		if err != nil {
+			return err
+		}
+		moved["stamp_cards"]++
+
+		var existing models.StampCard
+		err = tx.First(&existing, "member_id = ? AND reward_id = ?", targetID, card.RewardID).Error
+		if err == gorm.ErrRecordNotFound {
+			if err := tx.Model(&card).Update("member_id", targetID).Error; err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&models.StampHistory{}).Where("stamp_card_id = ?", card.ID).
+			Update("stamp_card_id", existing.ID).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&existing).Update("completed_count", gorm.Expr("completed_count + ?", card.CompletedCount)).Error
+		if err != nil {
+			return err
+		}
+
+		if card.Reward.BuyQuantity != nil && *card.Reward.BuyQuantity > 0 {
+			if err := settleStampCard(tx, existing, card.Reward, card.Stamps, nil); err != nil {
+				return err
+			}
+		} else {
+			err := tx.Model(&existing).Update("stamps", gorm.Expr("stamps + ?", card.Stamps)).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Delete(&card).Error; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// mergeMemberTier ให้บัญชีปลายทางได้ระดับที่สูงกว่าของทั้งสองบัญชี แล้วประเมินจากยอดที่รวมแล้ว
+// ระดับที่ได้จากบัญชีต้นทางไม่ได้รับโบนัสซ้ำ
+func mergeMemberTier(tx *gorm.DB, source, target models.Member) error {
+	tiers, err := loadTiers(tx)
+	if err != nil || len(tiers) == 0 {
+		return err
+	}
+
+	sourceTier, okSource := findTier(tiers, source.Tier)
+	targetTier, _ := findTier(tiers, target.Tier)
+
+	if okSource && sourceTier.Rank > targetTier.Rank {
+		var merged models.Member
+		if err := tx.First(&merged, "id = ?", target.ID).Error; err != nil {
+			return err
+		}
+		spend, orders := qualifyingActivity(tx, merged, sourceTier, time.Now())
+		if err := changeMemberTier(tx, merged, sourceTier, sourceTier, spend, orders, "รวมบัญชีสมาชิก"); err != nil {
+			return err
+		}
+	}
+
+	return checkTierUpgrade(tx, target.ID)
+}
+
+// normalizeName ตัดช่องว่าง เครื่องหมาย และคำนำหน้าชื่อ เพื่อใช้เปรียบเทียบ
+func normalizeName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for _, prefix := range []string{"นางสาว", "นาง", "นาย", "คุณ", "mrs.", "mr.", "ms.", "miss "} {
+		if strings.HasPrefix(name, prefix) {
+			name = strings.TrimPrefix(name, prefix)
+			break
+		}
+	}
+
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r) {
+			return r
+		}
+		return -1
+	}, name)
+}
+
+func normalizeEmail(email *string) string {
+	if email == nil {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSpace(*email))
+}
+
+func emailLocalPart(email string) string {
+	if at := strings.Index(email, "@"); at >= 0 {
+		return email[:at]
+	}
+	return email
+}
+
+// similarity คำนวณความคล้ายของข้อความจาก edit distance (1 = เหมือนกัน)
+func similarity(a, b []rune) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+
+	return 1 - float64(levenshtein(a, b))/float64(longest)
+}
+
+func levenshtein(a, b []rune) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = minInt(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(values ...int) int {
+	result := values[0]
+	for _, v := range values[1:] {
+		if v < result {
+			result = v
+		}
+	}
+	return result
+}
@@ -0,0 +1,213 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"coffee-pula-backend/sms"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	otpTTL         = 5 * time.Minute  // อายุรหัส OTP
+	otpResendDelay = 60 * time.Second // ขอรหัสใหม่ได้หลังจากนี้
+	otpMaxAttempts = 5                // กรอกผิดได้สูงสุด
+)
+
+var (
+	errOTPRequired = errors.New("OTP verification required")
+	errOTPInvalid  = errors.New("invalid or expired OTP")
+)
+
+// smsProvider ผู้ให้บริการส่ง SMS ที่ใช้ส่ง OTP
+var smsProvider sms.Provider = sms.LogProvider{}
+
+// SetSMSProvider กำหนดผู้ให้บริการส่ง SMS
+func SetSMSProvider(provider sms.Provider) {
+	smsProvider = provider
+}
+
+// memberLookupResult ข้อมูลสมาชิกแบบปิดบังบางส่วนสำหรับแสดงที่จุดขาย
+type memberLookupResult struct {
+	ID              string `json:"id"`
+	MemberNumber    string `json:"member_number"`
+	Name            string `json:"name"`
+	Phone           string `json:"phone"`
+	Tier            string `json:"tier"`
+	AvailablePoints int    `json:"available_points"`
+}
+
+// LookupMemberByPhone ค้นหาสมาชิกด้วยเบอร์โทรแบบตรงทุกหลัก คืนข้อมูลแบบปิดบัง
+func LookupMemberByPhone(c *fiber.Ctx) error {
+	phone := normalizePhone(c.Query("phone"))
+	if phone == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "phone is required"})
+	}
+
+	var member models.Member
+	result := database.DB.First(&member, "phone = ? AND is_active = ?", phone, true)
+	if result.Error != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
+
+	return c.JSON(memberLookupResult{
+		ID:              member.ID,
+		MemberNumber:    member.MemberNumber,
+		Name:            maskName(member.Name),
+		Phone:           maskPhone(phone),
+		Tier:            member.Tier,
+		AvailablePoints: member.AvailablePoints,
+	})
+}
+
+// RequestMemberOTP ส่งรหัส OTP ไปยังเบอร์โทรของสมาชิก
+func RequestMemberOTP(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var request struct {
+		Purpose string `json:"purpose"`
+	}
+	c.BodyParser(&request)
+	if request.Purpose == "" {
+		request.Purpose = "REDEEM"
+	}
+
+	var member models.Member
+	if err := database.DB.First(&member, "id = ? AND is_active = ?", id, true).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
+
+	if member.Phone == nil || *member.Phone == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Member has no phone number"})
+	}
+
+	// จำกัดความถี่การขอรหัส
+	var recent int64
+	database.DB.Model(&models.MemberOTP{}).
+		Where("member_id = ? AND created_at > ?", member.ID, time.Now().Add(-otpResendDelay)).
+		Count(&recent)
+	if recent > 0 {
+		return c.Status(429).JSON(fiber.Map{"error": "Please wait before requesting a new OTP"})
+	}
+
+	code, err := generateOTPCode()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	otp := models.MemberOTP{
+		MemberID:  member.ID,
+		Purpose:   request.Purpose,
+		CodeHash:  hashOTP(code),
+		ExpiresAt: time.Now().Add(otpTTL),
+	}
+	if err := database.DB.Create(&otp).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	message := fmt.Sprintf("รหัส OTP Coffee PuLa ของคุณคือ %s (หมดอายุใน %d นาที)", code, int(otpTTL.Minutes()))
+	if err := smsProvider.Send(*member.Phone, message); err != nil {
+		return c.Status(502).JSON(fiber.Map{"error": "Failed to send OTP"})
+	}
+
+	return c.Status(201).JSON(fiber.Map{
+		"otp_id":     otp.ID,
+		"expires_at": otp.ExpiresAt,
+		"phone":      maskPhone(*member.Phone),
+	})
+}
+
+// verifyMemberOTP ตรวจสอบและใช้รหัส OTP ภายใน transaction
+// การนับครั้งที่กรอกผิดบันทึกนอก transaction เพื่อไม่ให้ถูก rollback
+func verifyMemberOTP(tx *gorm.DB, memberID, purpose, otpID, code string) error {
+	if otpID == "" || code == "" {
+		return errOTPRequired
+	}
+
+	var otp models.MemberOTP
+	err := tx.First(&otp, "id = ? AND member_id = ? AND purpose = ? AND verified_at IS NULL", otpID, memberID, purpose).Error
+	if err != nil {
+		return errOTPInvalid
+	}
+
+	if time.Now().After(otp.ExpiresAt) || otp.Attempts >= otpMaxAttempts {
+		return errOTPInvalid
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashOTP(code)), []byte(otp.CodeHash)) != 1 {
+		database.DB.Model(&models.MemberOTP{}).Where("id = ?", otp.ID).
+			Update("attempts", gorm.Expr("attempts + 1"))
+		return errOTPInvalid
+	}
+
+	// ใช้ได้ครั้งเดียว
+	result := tx.Model(&models.MemberOTP{}).
+		Where("id = ? AND verified_at IS NULL", otp.ID).
+		Update("verified_at", time.Now())
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return errOTPInvalid
+	}
+
+	return nil
+}
+
+func generateOTPCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func hashOTP(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizePhone ตัดช่องว่างและขีดออกจากเบอร์โทร
+func normalizePhone(phone string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.TrimSpace(phone))
+}
+
+// normalizePhonePtr ปรับเบอร์โทรที่ไม่บังคับกรอก คืน nil ถ้าว่าง
+func normalizePhonePtr(phone *string) *string {
+	if phone == nil {
+		return nil
+	}
+	normalized := normalizePhone(*phone)
+	if normalized == "" {
+		return nil
+	}
+	return &normalized
+}
+
+// maskPhone แสดงเฉพาะ 4 หลักท้าย
+func maskPhone(phone string) string {
+	if len(phone) <= 4 {
+		return phone
+	}
+	return strings.Repeat("*", len(phone)-4) + phone[len(phone)-4:]
+}
+
+// maskName แสดงเฉพาะตัวอักษรแรกของแต่ละคำ
+func maskName(name string) string {
+	words := strings.Fields(name)
+	for i, word := range words {
+		runes := []rune(word)
+		words[i] = string(runes[0]) + "***"
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// erasedMemberName ชื่อที่ใช้แทนสมาชิกที่ลบข้อมูลส่วนบุคคลแล้ว
+const erasedMemberName = "สมาชิกที่ลบข้อมูลแล้ว"
+
+// UpdateMemberConsent ให้หรือถอนความยินยอมของสมาชิก
+func UpdateMemberConsent(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var request struct {
+		Privacy   *bool   `json:"privacy"`
+		Marketing *bool   `json:"marketing"`
+		Source    *string `json:"source"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	var member models.Member
+	if err := database.DB.First(&member, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
+
+	if member.ErasedAt != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Member data has been erased"})
+	}
+
+	tx := database.DB.Begin()
+
+	if request.Privacy != nil {
+		if err := recordConsent(tx, member.ID, "PRIVACY", *request.Privacy, request.Source); err != nil {
+			tx.Rollback()
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	if request.Marketing != nil {
+		if err := recordConsent(tx, member.ID, "MARKETING", *request.Marketing, request.Source); err != nil {
+			tx.Rollback()
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	database.DB.First(&member, "id = ?", id)
+
+	return c.JSON(member)
+}
+
+// ExportMemberData ส่งออกข้อมูลทั้งหมดของสมาชิกเป็น JSON (สิทธิขอรับข้อมูลตาม PDPA)
+func ExportMemberData(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var member models.Member
+	if err := database.DB.First(&member, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
+
+	var pointHistory []models.PointHistory
+	database.DB.Where("member_id = ?", id).Order("created_at ASC").Find(&pointHistory)
+
+	var redemptions []models.RewardRedemption
+	database.DB.Preload("Reward").Where("member_id = ?", id).Order("created_at ASC").Find(&redemptions)
+
+	var orders []models.Order
+	database.DB.Preload("Items.Product").Where("member_id = ?", id).Order("created_at ASC").Find(&orders)
+
+	var tierUpgrades []models.TierUpgrade
+	database.DB.Where("member_id = ?", id).Order("upgrade_date ASC").Find(&tierUpgrades)
+
+	var stampCards []models.StampCard
+	database.DB.Preload("Histories").Where("member_id = ?", id).Find(&stampCards)
+
+	var consentLogs []models.MemberConsentLog
+	database.DB.Where("member_id = ?", id).Order("created_at ASC").Find(&consentLogs)
+
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="member-%s.json"`, member.MemberNumber))
+
+	return c.JSON(fiber.Map{
+		"exported_at":        time.Now(),
+		"member":             member,
+		"point_history":      pointHistory,
+		"reward_redemptions": redemptions,
+		"orders":             orders,
+		"tier_upgrades":      tierUpgrades,
+		"stamp_cards":        stampCards,
+		"consent_logs":       consentLogs,
+	})
+}
+
+// EraseMemberData ลบข้อมูลส่วนบุคคลของสมาชิก (สิทธิขอให้ลบข้อมูลตาม PDPA)
+// ข้อมูลทางการเงิน ประวัติคะแนน และสถิติรวมยังเก็บไว้ แต่ไม่สามารถระบุตัวบุคคลได้
+func EraseMemberData(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var member models.Member
+	if err := database.DB.First(&member, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
+
+	if member.ErasedAt != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Member data has already been erased"})
+	}
+
+	now := time.Now()
+	tx := database.DB.Begin()
+
+	err := tx.Model(&models.Member{}).Where("id = ?", id).Updates(map[string]interface{}{
+		"name":                 erasedMemberName,
+		"phone":                nil,
+		"email":                nil,
+		"date_of_birth":        nil,
+		"referral_code":        nil,
+		"privacy_consent":      false,
+		"privacy_consent_at":   now,
+		"marketing_consent":    false,
+		"marketing_consent_at": now,
+		"is_active":            false,
+		"erased_at":            now,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := eraseMemberOrderDetails(tx, id); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// รหัส OTP ไม่มีประโยชน์หลังลบข้อมูล
+	if err := tx.Unscoped().Where("member_id = ?", id).Delete(&models.MemberOTP{}).Error; err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":   "Member personal data erased",
+		"member_id": id,
+		"erased_at": now,
+	})
+}
+
+// eraseMemberOrderDetails ลบชื่อและข้อมูลติดต่อของลูกค้าออกจากออเดอร์และใบเสร็จของสมาชิก
+func eraseMemberOrderDetails(tx *gorm.DB, memberID string) error {
+	orderIDs := tx.Model(&models.Order{}).Select("id").Where("member_id = ?", memberID)
+
+	if err := tx.Model(&models.Order{}).Where("member_id = ?", memberID).
+		Update("customer_name", nil).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Model(&models.Receipt{}).Where("order_id IN (?)", orderIDs).
+		Updates(map[string]interface{}{
+			"customer_name":    nil,
+			"customer_phone":   nil,
+			"customer_address": nil,
+			"customer_tax_id":  nil,
+		}).Error; err != nil {
+		return err
+	}
+
+	if err := tx.Model(&models.Coupon{}).Where("order_id IN (?)", orderIDs).
+		Update("used_by", nil).Error; err != nil {
+		return err
+	}
+
+	return tx.Model(&models.PromotionUsage{}).Where("order_id IN (?)", orderIDs).
+		Update("customer_name", nil).Error
+}
+
+// recordConsent อัพเดทสถานะความยินยอมและบันทึกประวัติ
+func recordConsent(tx *gorm.DB, memberID, consentType string, granted bool, source *string) error {
+	column := map[string]string{
+		"PRIVACY":   "privacy_consent",
+		"MARKETING": "marketing_consent",
+	}[consentType]
+
+	err := tx.Model(&models.Member{}).Where("id = ?", memberID).Updates(map[string]interface{}{
+		column:         granted,
+		column + "_at": time.Now(),
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	log := models.MemberConsentLog{
+		MemberID:    memberID,
+		ConsentType: consentType,
+		Granted:     granted,
+		Source:      source,
+	}
+	return tx.Create(&log).Error
+}
@@ -0,0 +1,244 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetRedemptionByCode ตรวจสอบรหัสรางวัลก่อนใช้ที่จุดขาย
+func GetRedemptionByCode(c *fiber.Ctx) error {
+	code := strings.ToUpper(c.Params("code"))
+
+	var redemption models.RewardRedemption
+	result := database.DB.Preload("Reward.FreeProduct").Preload("Member").
+		First(&redemption, "code = ?", code)
+	if result.Error != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Redemption not found"})
+	}
+
+	return c.JSON(redemption)
+}
+
+// ApplyRedemption ใช้รางวัลที่แลกไว้กับออเดอร์ ลดราคาสินค้าฟรีหรือหักส่วนลดจากยอดออเดอร์
+func ApplyRedemption(c *fiber.Ctx) error {
+	var request struct {
+		Code    string `json:"code"`
+		OrderID string `json:"order_id"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if request.Code == "" || request.OrderID == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "code and order_id are required"})
+	}
+
+	tx := database.DB.Begin()
+
+	// ล็อกออเดอร์ก่อนรายการแลกรางวัล ลำดับเดียวกับการยกเลิกออเดอร์ที่คืนรางวัล
+	// รางวัลหลายรายการที่ใช้กับออเดอร์เดียวกันพร้อมกันจะรอกัน จึงคิดส่วนลดจากยอดล่าสุดเสมอ
+	var order models.Order
+	if err := lockOpenOrder(tx, request.OrderID, &order); err != nil {
+		tx.Rollback()
+		if err == errOrderClosed {
+			return c.Status(400).JSON(fiber.Map{"error": "Order is already closed"})
+		}
+		return c.Status(404).JSON(fiber.Map{"error": "Order not found"})
+	}
+	if err := tx.Where("order_id = ?", order.ID).Find(&order.Items).Error; err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// ล็อกรายการแลกรางวัลเพื่อป้องกันการใช้ซ้ำพร้อมกัน
+	var redemption models.RewardRedemption
+	result := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Reward").
+		First(&redemption, "code = ?", strings.ToUpper(request.Code))
+	if result.Error != nil {
+		tx.Rollback()
+		return c.Status(404).JSON(fiber.Map{"error": "Redemption not found"})
+	}
+
+	if redemption.Status != "PENDING" {
+		tx.Rollback()
+		return c.Status(400).JSON(fiber.Map{
+			"error":  "Redemption is not pending",
+			"status": redemption.Status,
+		})
+	}
+
+	now := time.Now()
+	if redemption.ExpiresAt != nil && redemption.ExpiresAt.Before(now) {
+		tx.Model(&redemption).Update("status", "EXPIRED")
+		tx.Commit()
+		return c.Status(400).JSON(fiber.Map{"error": "Redemption has expired"})
+	}
+
+	// รางวัลใช้ได้เฉพาะกับออเดอร์ของสมาชิกที่แลก
+	if order.MemberID == nil || *order.MemberID != redemption.MemberID {
+		tx.Rollback()
+		return c.Status(400).JSON(fiber.Map{"error": "Order does not belong to the redeeming member"})
+	}
+
+	discount, err := applyRewardToOrder(tx, redemption.Reward, order)
+	if err != nil {
+		tx.Rollback()
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// หักส่วนลดจากยอดออเดอร์
+	if err := tx.Model(&order).Update("total_amount", gorm.Expr("total_amount - ?", discount)).Error; err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err = tx.Model(&redemption).Updates(map[string]interface{}{
+		"status":           "USED",
+		"used_at":          now,
+		"order_id":         order.ID,
+		"discount_applied": discount,
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	database.DB.Preload("Items.Product").First(&order, "id = ?", order.ID)
+
+	return c.JSON(fiber.Map{
+		"message":         "Reward applied successfully",
+		"redemption_id":   redemption.ID,
+		"discount_amount": discount,
+		"order":           order,
+	})
+}
+
+// applyRewardToOrder ปรับรายการในออเดอร์ตามประเภทรางวัล และคืนจำนวนเงินที่ลดได้
+func applyRewardToOrder(tx *gorm.DB, reward models.Reward, order models.Order) (float64, error) {
+	switch reward.Type {
+	case "FREE_ITEM", "BUY_X_GET_Y":
+		if reward.FreeProductID == nil {
+			return 0, fmt.Errorf("reward has no free product")
+		}
+
+		freeQuantity := 1
+		if reward.GetQuantity != nil && *reward.GetQuantity > 0 {
+			freeQuantity = *reward.GetQuantity
+		}
+
+		for _, item := range order.Items {
+			if item.ProductID != *reward.FreeProductID || item.Price == 0 {
+				continue
+			}
+			return zeroPriceOrderItem(tx, item, freeQuantity)
+		}
+		return 0, fmt.Errorf("order does not contain the free product")
+
+	case "DISCOUNT":
+		discount := 0.0
+		if reward.DiscountAmount != nil {
+			discount = *reward.DiscountAmount
+		} else if reward.DiscountPercent != nil {
+			discount = math.Round(*reward.DiscountPercent*order.TotalAmount) / 100
+		}
+		if discount <= 0 {
+			return 0, fmt.Errorf("reward has no discount value")
+		}
+		// ส่วนลดต้องไม่เกินยอดออเดอร์
+		return math.Min(discount, order.TotalAmount), nil
+
+	case "PHYSICAL":
+		// ของรางวัลมอบให้ที่หน้าร้าน ไม่มีผลกับยอดออเดอร์
+		return 0, nil
+	}
+
+	return 0, fmt.Errorf("unsupported reward type: %s", reward.Type)
+}
+
+// zeroPriceOrderItem ทำให้สินค้าในรายการเป็นของฟรีตามจำนวนที่กำหนด
+// ถ้ารายการมีจำนวนมากกว่าของฟรี จะแยกส่วนที่ฟรีออกเป็นรายการใหม่ราคา 0
+func zeroPriceOrderItem(tx *gorm.DB, item models.OrderItem, freeQuantity int) (float64, error) {
+	if freeQuantity >= item.Quantity {
+		discount := item.Subtotal
+		err := tx.Model(&item).Updates(map[string]interface{}{"price": 0, "subtotal": 0}).Error
+		return discount, err
+	}
+
+	remaining := item.Quantity - freeQuantity
+	err := tx.Model(&item).Updates(map[string]interface{}{
+		"quantity": remaining,
+		"subtotal": item.Price * float64(remaining),
+	}).Error
+	if err != nil {
+		return 0, err
+	}
+
+	freeItem := models.OrderItem{
+		BaseModel: models.BaseModel{ID: uuid.New().String(), CreatedAt: time.Now(), UpdatedAt: time.Now()},
+		OrderID:   item.OrderID,
+		ProductID: item.ProductID,
+		Quantity:  freeQuantity,
+		Price:     0,
+		Subtotal:  0,
+
+		UnitCost:        item.UnitCost,
+		RawMaterialCost: item.RawMaterialCost,
+		LaborCost:       item.LaborCost,
+		OverheadCost:    item.OverheadCost,
+		ProductCostID:   item.ProductCostID,
+	}
+	if err := tx.Create(&freeItem).Error; err != nil {
+		return 0, err
+	}
+
+	return item.Price * float64(freeQuantity), nil
+}
+
+func generateRedemptionCode() string {
+	return "RW" + strings.ToUpper(strings.ReplaceAll(uuid.New().String(), "-", "")[:8])
+}
+
+// releaseOrderRedemptions คืนรางวัลที่ใช้กับออเดอร์ที่ถูกยกเลิก ให้นำไปใช้กับออเดอร์อื่นได้
+// รางวัลที่เลยวันหมดอายุแล้วเปลี่ยนเป็น EXPIRED แทน
+func releaseOrderRedemptions(tx *gorm.DB, orderID string, now time.Time) error {
+	var redemptions []models.RewardRedemption
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("order_id = ? AND status = ?", orderID, "USED").
+		Find(&redemptions).Error
+	if err != nil {
+		return err
+	}
+
+	for _, redemption := range redemptions {
+		status := "PENDING"
+		if redemption.ExpiresAt != nil && redemption.ExpiresAt.Before(now) {
+			status = "EXPIRED"
+		}
+
+		err := tx.Model(&models.RewardRedemption{}).Where("id = ?", redemption.ID).Updates(map[string]interface{}{
+			"status":           status,
+			"order_id":         nil,
+			"used_at":          nil,
+			"discount_applied": nil,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,137 @@
+//go:build integration
+
+package handlers
+
+import (
+	"bytes"
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// memberOrder สร้างสมาชิกพร้อมออเดอร์ที่ยังเปิดอยู่ของสมาชิก
+func (f *orderFixture) memberOrder(product models.Product, quantity int) (models.Member, models.Order) {
+	member := models.Member{MemberNumber: "T" + f.suffix, Name: "สมาชิกทดสอบ " + f.suffix, IsActive: true}
+	f.create(&member)
+
+	total := product.Price * float64(quantity)
+	order := models.Order{
+		OrderNumber: "TEST-" + f.suffix,
+		TotalAmount: total,
+		Status:      models.OrderStatusPending,
+		MemberID:    &member.ID,
+	}
+	f.create(&order)
+	f.create(&models.OrderItem{
+		OrderID:   order.ID,
+		ProductID: product.ID,
+		Quantity:  quantity,
+		Price:     product.Price,
+		Subtotal:  total,
+	})
+	return member, order
+}
+
+// redemptions สร้างรายการแลกรางวัลที่รอใช้ตามจำนวนที่ระบุ คืนรหัสของแต่ละรายการ
+func (f *orderFixture) redemptions(member models.Member, reward models.Reward, count int) []string {
+	f.create(&reward)
+
+	codes := make([]string, count)
+	for i := range codes {
+		code := "T" + f.suffix + string(rune('A'+i))
+		f.create(&models.RewardRedemption{MemberID: member.ID, RewardID: reward.ID, Code: &code, Status: "PENDING"})
+		codes[i] = code
+	}
+	return codes
+}
+
+// applyRedemptions ใช้รางวัลทุกรหัสกับออเดอร์พร้อมกัน คืน status ของแต่ละคำขอ
+func applyRedemptions(t *testing.T, orderID string, codes []string) []int {
+	app := fiber.New()
+	app.Post("/redemptions/apply", ApplyRedemption)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, len(codes))
+	for i, code := range codes {
+		body, _ := json.Marshal(fiber.Map{"code": code, "order_id": orderID})
+
+		wg.Add(1)
+		go func(i int, body []byte) {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/redemptions/apply", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			statuses[i] = resp.StatusCode
+		}(i, body)
+	}
+	wg.Wait()
+	return statuses
+}
+
+// TestApplyRedemptionConcurrentDiscount ส่วนลดเปอร์เซ็นต์สองรายการใช้กับออเดอร์เดียวกันพร้อมกัน
+// รายการที่สองต้องคิดจากยอดหลังหักรายการแรก ไม่ใช่ยอดเดิม
+func TestApplyRedemptionConcurrentDiscount(t *testing.T) {
+	f := newOrderFixture(t)
+
+	product := f.product("ลาเต้ทดสอบ")
+	member, order := f.memberOrder(product, 2)
+	percent := 50.0
+	codes := f.redemptions(member, models.Reward{Name: "ลด 50% " + f.suffix, Type: "DISCOUNT", DiscountPercent: &percent, IsActive: true}, 2)
+
+	for i, status := range applyRedemptions(t, order.ID, codes) {
+		if status != 200 {
+			t.Errorf("redemption %d: status %d, want 200", i, status)
+		}
+	}
+
+	var current models.Order
+	if err := database.DB.First(&current, "id = ?", order.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if want := order.TotalAmount * 0.25; math.Abs(current.TotalAmount-want) > 1e-6 {
+		t.Errorf("total_amount = %.2f, want %.2f", current.TotalAmount, want)
+	}
+}
+
+// TestApplyRedemptionConcurrentFreeItem ของฟรีสองรายการกับออเดอร์ที่มีสินค้าชิ้นเดียว ต้องใช้ได้รายการเดียว
+func TestApplyRedemptionConcurrentFreeItem(t *testing.T) {
+	f := newOrderFixture(t)
+
+	product := f.product("เอสเปรสโซทดสอบ")
+	member, order := f.memberOrder(product, 1)
+	codes := f.redemptions(member, models.Reward{Name: "ฟรี 1 แก้ว " + f.suffix, Type: "FREE_ITEM", FreeProductID: &product.ID, IsActive: true}, 2)
+
+	applied := 0
+	for _, status := range applyRedemptions(t, order.ID, codes) {
+		if status == 200 {
+			applied++
+		}
+	}
+	if applied != 1 {
+		t.Errorf("applied redemptions = %d, want 1", applied)
+	}
+
+	var current models.Order
+	if err := database.DB.First(&current, "id = ?", order.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if current.TotalAmount != 0 {
+		t.Errorf("total_amount = %.2f, want 0", current.TotalAmount)
+	}
+
+	var used int64
+	database.DB.Model(&models.RewardRedemption{}).Where("code IN ? AND status = ?", codes, "USED").Count(&used)
+	if used != 1 {
+		t.Errorf("used redemptions = %d, want 1", used)
+	}
+}
@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetStampCards ดึงบัตรสะสมแสตมป์ของสมาชิก
+func GetStampCards(c *fiber.Ctx) error {
+	memberID := c.Params("id")
+
+	var cards []models.StampCard
+	result := database.DB.Preload("Reward").
+		Where("member_id = ?", memberID).
+		Order("last_stamp_at DESC").
+		Find(&cards)
+
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(cards)
+}
+
+// GetStampHistory ดึงประวัติแสตมป์ของสมาชิก
+func GetStampHistory(c *fiber.Ctx) error {
+	memberID := c.Params("id")
+
+	limit := c.QueryInt("limit", 50)
+	offset := c.QueryInt("offset", 0)
+
+	query := database.DB.Where("member_id = ?", memberID)
+	if cardID := c.Query("card_id"); cardID != "" {
+		query = query.Where("stamp_card_id = ?", cardID)
+	}
+
+	var histories []models.StampHistory
+	result := query.Order("created_at DESC").Limit(limit).Offset(offset).Find(&histories)
+
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(histories)
+}
+
+// addStampsForOrder เพิ่มแสตมป์จากสินค้าที่ร่วมรายการในออเดอร์ และออกรางวัลเมื่อสะสมครบ
+// ต้องเรียกภายใน transaction เดียวกับการปิดออเดอร์ รางวัลที่ไม่ระบุสินค้าที่ร่วมรายการจะไม่ได้แสตมป์
+func addStampsForOrder(tx *gorm.DB, memberID string, orderID string, items []models.OrderItem) error {
+	now := time.Now()
+
+	var rewards []models.Reward
+	err := tx.Where("type = ? AND is_active = ? AND buy_quantity > 0", "BUY_X_GET_Y", true).
+		Where("(start_date IS NULL OR start_date <= ?) AND (end_date IS NULL OR end_date >= ?)", now, now).
+		Find(&rewards).Error
+	if err != nil {
+		return err
+	}
+
+	for _, reward := range rewards {
+		stamps := 0
+		for _, item := range items {
+			// ของแถมราคา 0 ไม่ได้แสตมป์
+			if item.Price <= 0 {
+				continue
+			}
+			if slices.Contains(reward.ApplicableProducts, item.ProductID) {
+				stamps += item.Quantity
+			}
+		}
+
+		if stamps == 0 {
+			continue
+		}
+
+		if err := addStamps(tx, memberID, orderID, reward, stamps); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addStamps เพิ่มแสตมป์ลงบัตรของรางวัลหนึ่งรายการ
+func addStamps(tx *gorm.DB, memberID string, orderID string, reward models.Reward, stamps int) error {
+	var card models.StampCard
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		First(&card, "member_id = ? AND reward_id = ?", memberID, reward.ID).Error
+	if err == gorm.ErrRecordNotFound {
+		card = models.StampCard{
+			MemberID:       memberID,
+			RewardID:       reward.ID,
+			StampsRequired: *reward.BuyQuantity,
+		}
+		err = tx.Create(&card).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	earn := models.StampHistory{
+		StampCardID: card.ID,
+		MemberID:    memberID,
+		Type:        "EARN",
+		Stamps:      stamps,
+		Description: fmt.Sprintf("สะสมแสตมป์ %s", reward.Name),
+		OrderID:     &orderID,
+	}
+	if err := tx.Create(&earn).Error; err != nil {
+		return err
+	}
+
+	return settleStampCard(tx, card, reward, stamps, &orderID)
+}
+
+// settleStampCard บวกแสตมป์เข้าบัตร ออกรางวัลทุกครั้งที่สะสมครบ และเก็บแสตมป์ที่เหลือไว้ในบัตร
+func settleStampCard(tx *gorm.DB, card models.StampCard, reward models.Reward, stamps int, orderID *string) error {
+	now := time.Now()
+
+	// ใช้เงื่อนไขล่าสุดของรางวัลเสมอ
+	required := *reward.BuyQuantity
+
+	total := card.Stamps + stamps
+	completed := total / required
+
+	for i := 0; i < completed; i++ {
+		redemption := models.RewardRedemption{
+			BaseModel:  models.BaseModel{ID: uuid.New().String(), CreatedAt: now, UpdatedAt: now},
+			MemberID:   card.MemberID,
+			RewardID:   reward.ID,
+			Code:       stringPtr(generateRedemptionCode()),
+			PointsUsed: 0,
+			Status:     "PENDING",
+			ExpiresAt:  &[]time.Time{now.AddDate(0, 0, 30)}[0], // หมดอายุ 30 วัน
+			Notes:      stringPtr("สะสมแสตมป์ครบ"),
+		}
+		if err := tx.Create(&redemption).Error; err != nil {
+			return err
+		}
+
+		complete := models.StampHistory{
+			StampCardID:  card.ID,
+			MemberID:     card.MemberID,
+			Type:         "COMPLETE",
+			Stamps:       -required,
+			Description:  fmt.Sprintf("สะสมครบ %d ดวง รับ%s", required, reward.Name),
+			OrderID:      orderID,
+			RedemptionID: &redemption.ID,
+		}
+		if err := tx.Create(&complete).Error; err != nil {
+			return err
+		}
+	}
+
+	if completed > 0 {
+		err := tx.Model(&models.Reward{}).Where("id = ?", reward.ID).
+			Update("total_redemptions", gorm.Expr("total_redemptions + ?", completed)).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(&card).Updates(map[string]interface{}{
+		"stamps":          total % required,
+		"stamps_required": required,
+		"completed_count": gorm.Expr("completed_count + ?", completed),
+		"last_stamp_at":   now,
+	}).Error
+}
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// tierReviewMonths ระยะเวลาระหว่างการประเมินระดับสมาชิกแต่ละรอบ
+const tierReviewMonths = 12
+
+// GetTiers ดึงรายการระดับสมาชิก
+func GetTiers(c *fiber.Ctx) error {
+	var tiers []models.MemberTier
+	result := database.DB.Order("`rank` ASC").Find(&tiers)
+
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(tiers)
+}
+
+// CreateTier สร้างระดับสมาชิกใหม่
+func CreateTier(c *fiber.Ctx) error {
+	// ค่าเริ่มต้นเมื่อไม่ส่งมา ส่ง 0 หรือ false มาเองได้
+	tier := models.MemberTier{QualificationMonths: 12, EarnMultiplier: 1, IsActive: true}
+
+	if err := c.BodyParser(&tier); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if err := validateTier(tier); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	result := database.DB.Create(&tier)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.Status(201).JSON(tier)
+}
+
+// UpdateTier แก้ไขเงื่อนไขระดับสมาชิก
+func UpdateTier(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var tier models.MemberTier
+	if err := database.DB.First(&tier, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Tier not found"})
+	}
+
+	if err := c.BodyParser(&tier); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	tier.ID = id
+
+	if err := validateTier(tier); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := database.DB.Save(&tier).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(tier)
+}
+
+// ReevaluateTiers ประเมินระดับสมาชิกที่ถึงรอบประเมินทันที (ปกติทำงานอัตโนมัติทุกวัน)
+func ReevaluateTiers(c *fiber.Ctx) error {
+	changed, err := reviewMemberTiers(database.DB, time.Now())
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "Tier review completed",
+		"changed": changed,
+	})
+}
+
+func validateTier(tier models.MemberTier) error {
+	if tier.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if tier.Rank <= 0 {
+		return fmt.Errorf("rank must be positive")
+	}
+	if tier.QualifyingSpend < 0 || tier.QualifyingOrders < 0 || tier.QualificationMonths < 0 {
+		return fmt.Errorf("qualification values must not be negative")
+	}
+	if tier.EarnMultiplier < 0 {
+		return fmt.Errorf("earn_multiplier must not be negative")
+	}
+	return nil
+}
+
+// loadTiers ดึงระดับสมาชิกที่เปิดใช้งาน เรียงจากต่ำไปสูง
+func loadTiers(db *gorm.DB) ([]models.MemberTier, error) {
+	var tiers []models.MemberTier
+	err := db.Where("is_active = ?", true).Order("`rank` ASC").Find(&tiers).Error
+	return tiers, err
+}
+
+// findTier หาระดับสมาชิกตามชื่อ
+func findTier(tiers []models.MemberTier, name string) (models.MemberTier, bool) {
+	for _, tier := range tiers {
+		if tier.Name == name {
+			return tier, true
+		}
+	}
+	return models.MemberTier{}, false
+}
+
+// tierRank คืนลำดับของระดับสมาชิก (0 ถ้าไม่พบ)
+func tierRank(db *gorm.DB, name string) int {
+	var tier models.MemberTier
+	if err := db.Select("`rank`").First(&tier, "name = ?", name).Error; err != nil {
+		return 0
+	}
+	return tier.Rank
+}
+
+// qualifyingActivity คำนวณยอดใช้จ่ายและจำนวนออเดอร์ในช่วงเวลาที่ระดับนั้นกำหนด
+func qualifyingActivity(db *gorm.DB, member models.Member, tier models.MemberTier, asOf time.Time) (float64, int) {
+	if tier.QualificationMonths <= 0 {
+		return member.TotalSpent, member.TotalOrders
+	}
+
+	var activity struct {
+		Spend  float64
+		Orders int
+	}
+	db.Model(&models.PointHistory{}).
+		Select("COALESCE(SUM(spent_amount), 0) AS spend, COUNT(*) AS orders").
+		Where("member_id = ? AND spent_amount IS NOT NULL AND created_at >= ? AND created_at <= ?",
+			member.ID, asOf.AddDate(0, -tier.QualificationMonths, 0), asOf).
+		Scan(&activity)
+
+	return activity.Spend, activity.Orders
+}
+
+// qualifiedTier หาระดับสูงสุดที่สมาชิกผ่านเงื่อนไข พร้อมยอดที่ใช้ประเมิน
+func qualifiedTier(db *gorm.DB, member models.Member, tiers []models.MemberTier, asOf time.Time) (models.MemberTier, float64, int) {
+	best := tiers[0]
+	bestSpend, bestOrders := qualifyingActivity(db, member, best, asOf)
+
+	for _, tier := range tiers[1:] {
+		spend, orders := qualifyingActivity(db, member, tier, asOf)
+		if spend >= tier.QualifyingSpend && orders >= tier.QualifyingOrders {
+			best, bestSpend, bestOrders = tier, spend, orders
+		}
+	}
+
+	return best, bestSpend, bestOrders
+}
+
+// changeMemberTier เปลี่ยนระดับสมาชิก บันทึก TierUpgrade และให้โบนัสเมื่อเป็นการอัพเกรด
+func changeMemberTier(tx *gorm.DB, member models.Member, from, to models.MemberTier, spend float64, orders int, notes string) error {
+	now := time.Now()
+	reviewDate := now.AddDate(0, tierReviewMonths, 0)
+
+	err := tx.Model(&models.Member{}).Where("id = ?", member.ID).Updates(map[string]interface{}{
+		"tier":             to.Name,
+		"tier_review_date": reviewDate,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	upgrade := models.TierUpgrade{
+		BaseModel:      models.BaseModel{ID: uuid.New().String(), CreatedAt: now, UpdatedAt: now},
+		MemberID:       member.ID,
+		FromTier:       member.Tier,
+		ToTier:         to.Name,
+		RequiredSpend:  to.QualifyingSpend,
+		RequiredOrders: to.QualifyingOrders,
+		AchievedSpend:  spend,
+		AchievedOrders: orders,
+		UpgradeDate:    now,
+		Notes:          &notes,
+	}
+	if err := tx.Create(&upgrade).Error; err != nil {
+		return err
+	}
+
+	// ให้คะแนนโบนัสเฉพาะการอัพเกรด
+	if to.Rank <= from.Rank || to.UpgradeBonus <= 0 {
+		return nil
+	}
+
+	_, err = postPointEntry(tx, pointEntry{
+		MemberID:      member.ID,
+		Type:          "BONUS",
+		Points:        to.UpgradeBonus,
+		Description:   fmt.Sprintf("โบนัสอัพเกรดเป็นสมาชิก%s", to.Name),
+		ReferenceType: stringPtr("TIER_UPGRADE"),
+		ReferenceID:   &upgrade.ID,
+	})
+	return err
+}
+
+// checkTierUpgrade ตรวจสอบและอัพเกรดระดับสมาชิก ต้องเรียกภายใน transaction เดียวกับการเปลี่ยนแปลงยอด
+// การลดระดับทำเฉพาะในรอบประเมินประจำปี (reviewMemberTiers)
+func checkTierUpgrade(tx *gorm.DB, memberID string) error {
+	var member models.Member
+	if err := tx.First(&member, "id = ?", memberID).Error; err != nil {
+		return err
+	}
+
+	tiers, err := loadTiers(tx)
+	if err != nil || len(tiers) == 0 {
+		return err
+	}
+
+	current, _ := findTier(tiers, member.Tier)
+	target, spend, orders := qualifiedTier(tx, member, tiers, time.Now())
+
+	if target.Rank <= current.Rank {
+		return nil
+	}
+
+	return changeMemberTier(tx, member, current, target, spend, orders, "อัพเกรดระดับสมาชิก")
+}
+
+// reviewMemberTiers ประเมินระดับของสมาชิกที่ถึงรอบประเมิน ปรับขึ้นหรือลดระดับตามยอดในช่วงเวลาที่กำหนด
+func reviewMemberTiers(db *gorm.DB, asOf time.Time) (int, error) {
+	tiers, err := loadTiers(db)
+	if err != nil || len(tiers) == 0 {
+		return 0, err
+	}
+
+	// สมาชิกที่ยังไม่มีรอบประเมิน ให้เริ่มนับรอบจากวันนี้
+	err = db.Model(&models.Member{}).
+		Where("tier_review_date IS NULL").
+		Update("tier_review_date", asOf.AddDate(0, tierReviewMonths, 0)).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var memberIDs []string
+	err = db.Model(&models.Member{}).
+		Where("is_active = ? AND tier_review_date <= ?", true, asOf).
+		Pluck("id", &memberIDs).Error
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, memberID := range memberIDs {
+		tierChanged := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// อ่านใหม่หลังล็อก ยอดหรือระดับอาจเปลี่ยนไปแล้วระหว่างนี้
+			member, err := lockMember(tx, memberID)
+			if err != nil {
+				return err
+			}
+			if !member.IsActive || member.TierReviewDate == nil || member.TierReviewDate.After(asOf) {
+				return nil
+			}
+
+			current, _ := findTier(tiers, member.Tier)
+			target, spend, orders := qualifiedTier(tx, *member, tiers, asOf)
+
+			if target.Name == member.Tier {
+				return tx.Model(&models.Member{}).Where("id = ?", member.ID).
+					Update("tier_review_date", asOf.AddDate(0, tierReviewMonths, 0)).Error
+			}
+
+			notes := "ปรับระดับจากการประเมินประจำปี"
+			if target.Rank < current.Rank {
+				notes = "ลดระดับจากการประเมินประจำปี"
+			}
+			tierChanged = true
+			return changeMemberTier(tx, *member, current, target, spend, orders, notes)
+		})
+		if err != nil {
+			return changed, err
+		}
+		if tierChanged {
+			changed++
+		}
+	}
+
+	return changed, nil
+}
@@ -20,18 +20,28 @@ func GetCategories(c *fiber.Ctx) error {
 	return c.JSON(categories)
 }
 
-// GetMenu - ดึงข้อมูลเมนูทั้งหมด
+// GetMenu - ดึงข้อมูลเมนูทั้งหมด พร้อมจำนวนที่ทำได้จากสต๊อก (servings) และสถานะหมด (sold_out)
 func GetMenu(c *fiber.Ctx) error {
-	var products []models.Product
-	result := database.DB.Preload("Category").Where("available = ?", true).Find(&products)
+	items, err := loadMenu(database.DB)
 	
-	if result.Error != nil {
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to fetch menu",
 		})
 	}
 	
-	return c.JSON(products)
+	// ซ่อนสินค้าที่หมด (ถ้าต้องการ)
+	if c.QueryBool("hide_sold_out", false) {
+		inStock := make([]menuItem, 0, len(items))
+		for _, item := range items {
+			if !item.SoldOut {
+				inStock = append(inStock, item)
+			}
+		}
+		items = inStock
+	}
+	
+	return c.JSON(items)
 }
 
 // CreateProduct - เพิ่มเมนูใหม่
@@ -44,6 +54,10 @@ func CreateProduct(c *fiber.Ctx) error {
 		})
 	}
 	
+	// ต้นทุนตามสูตรคำนวณเมื่อสร้างสูตร
+	product.RecipeCost = nil
+	product.RecipeCostUpdatedAt = nil
+	
 	result := database.DB.Create(&product)
 	if result.Error != nil {
 		return c.Status(500).JSON(fiber.Map{
@@ -68,18 +82,29 @@ func UpdateProduct(c *fiber.Ctx) error {
 		})
 	}
 	
+	// ต้นทุนตามสูตรคำนวณจากสูตรเท่านั้น สถานะหมดตั้งจากสต๊อกเท่านั้น
+	recipeCost, recipeCostUpdatedAt := product.RecipeCost, product.RecipeCostUpdatedAt
+	soldOut, soldOutAt := product.SoldOut, product.SoldOutAt
+	
 	if err := c.BodyParser(&product); err != nil {
 		return c.Status(400).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
 	
+	product.ID = productID
+	product.RecipeCost, product.RecipeCostUpdatedAt = recipeCost, recipeCostUpdatedAt
+	product.SoldOut, product.SoldOutAt = soldOut, soldOutAt
+	
 	if err := database.DB.Save(&product).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{
 			"error": "Failed to update product",
 		})
 	}
 	
+	// เปิด/ปิดขายแล้วสถานะหมดอาจเปลี่ยน
+	scheduleMenuRefresh()
+	
 	// Load category relation
 	database.DB.Preload("Category").First(&product, "id = ?", product.ID)
 	
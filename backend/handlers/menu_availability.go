@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"bufio"
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// menuItem สินค้าในเมนูพร้อมจำนวนที่ทำได้จากสต๊อกปัจจุบัน
+type menuItem struct {
+	models.Product
+	Servings *int `json:"servings"` // nil = ไม่มีสูตร ไม่จำกัดจำนวน
+}
+
+// menuAvailabilityChange สถานะหมด/มีของสินค้าที่เปลี่ยนไป ส่งให้เครื่องขายผ่าน /menu/stream
+type menuAvailabilityChange struct {
+	ProductID   string `json:"product_id"`
+	ProductName string `json:"product_name"`
+	Servings    *int   `json:"servings"`
+	SoldOut     bool   `json:"sold_out"`
+}
+
+// menuRefresh สัญญาณให้คำนวณสถานะหมดของเมนูใหม่ บัฟเฟอร์ 1 ช่องรวมหลายสัญญาณที่มาติดกันเป็นรอบเดียว
+var menuRefresh = make(chan struct{}, 1)
+
+// menuSubscribers เครื่องขายที่เปิด /menu/stream อยู่
+var menuSubscribers = struct {
+	sync.Mutex
+	clients map[chan []byte]struct{}
+}{clients: make(map[chan []byte]struct{})}
+
+// scheduleMenuRefresh ขอให้คำนวณสถานะหมดของเมนูใหม่โดยไม่รอผล
+// ต้องเรียกหลัง commit ทุกครั้งที่สต๊อกหรือสูตรเปลี่ยน
+func scheduleMenuRefresh() {
+	select {
+	case menuRefresh <- struct{}{}:
+	default:
+	}
+}
+
+// watchMenuAvailability คำนวณสถานะหมดของเมนูใหม่เมื่อได้รับสัญญาณ และส่งรายการที่เปลี่ยนให้เครื่องขาย
+func watchMenuAvailability() {
+	for range menuRefresh {
+		changes, err := refreshMenuAvailability(database.DB)
+		if err != nil {
+			log.Println("Menu availability refresh failed:", err)
+			continue
+		}
+		if len(changes) > 0 {
+			publishMenuChanges(changes)
+		}
+	}
+}
+
+// GetMenuAvailability ดึงจำนวนที่ทำได้ของทุกสินค้าที่เปิดขาย
+func GetMenuAvailability(c *fiber.Ctx) error {
+	items, err := loadMenu(database.DB)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	availability := make([]menuAvailabilityChange, 0, len(items))
+	for _, item := range items {
+		availability = append(availability, menuAvailabilityChange{
+			ProductID:   item.ID,
+			ProductName: item.Name,
+			Servings:    item.Servings,
+			SoldOut:     item.SoldOut,
+		})
+	}
+
+	return c.JSON(availability)
+}
+
+// StreamMenuAvailability ส่งสถานะหมด/มีของสินค้าที่เปลี่ยนให้เครื่องขายแบบ Server-Sent Events
+func StreamMenuAvailability(c *fiber.Ctx) error {
+	c.Set("Content-Type", "text/event-stream")
+	c.Set("Cache-Control", "no-cache")
+	c.Set("Connection", "keep-alive")
+
+	events := make(chan []byte, 8)
+	menuSubscribers.Lock()
+	menuSubscribers.clients[events] = struct{}{}
+	menuSubscribers.Unlock()
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer func() {
+			menuSubscribers.Lock()
+			delete(menuSubscribers.clients, events)
+			menuSubscribers.Unlock()
+		}()
+
+		// ส่ง ping เป็นระยะ เครื่องขายที่ปิดไปแล้วจะเขียนไม่สำเร็จและถูกถอดออก
+		ping := time.NewTicker(15 * time.Second)
+		defer ping.Stop()
+
+		for {
+			select {
+			case payload := <-events:
+				fmt.Fprintf(w, "event: menu.availability\ndata: %s\n\n", payload)
+			case <-ping.C:
+				fmt.Fprint(w, ": ping\n\n")
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// publishMenuChanges ส่งรายการที่เปลี่ยนให้ทุกเครื่องขาย เครื่องที่รับไม่ทันจะถูกข้ามรอบนี้
+func publishMenuChanges(changes []menuAvailabilityChange) {
+	payload, err := json.Marshal(changes)
+	if err != nil {
+		log.Println("Menu availability encode failed:", err)
+		return
+	}
+
+	menuSubscribers.Lock()
+	defer menuSubscribers.Unlock()
+
+	for events := range menuSubscribers.clients {
+		select {
+		case events <- payload:
+		default:
+		}
+	}
+}
+
+// loadMenu ดึงสินค้าที่เปิดขายพร้อมจำนวนที่ทำได้ สถานะหมดคิดจากสต๊อกตอนนี้ ไม่รอรอบคำนวณ
+func loadMenu(db *gorm.DB) ([]menuItem, error) {
+	var products []models.Product
+	err := db.Preload("Category").Preload("Recipe.Ingredients.Ingredient").
+		Where("available = ?", true).
+		Find(&products).Error
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]menuItem, 0, len(products))
+	for _, product := range products {
+		servings, err := productServings(db, &product)
+		if err != nil {
+			return nil, err
+		}
+
+		item := menuItem{Product: product, Servings: servings}
+		item.SoldOut = servings != nil && *servings == 0
+		item.Recipe = nil
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// refreshMenuAvailability ตั้งหรือยกเลิกสถานะหมดของสินค้าตามสต๊อก คืนเฉพาะสินค้าที่สถานะเปลี่ยน
+func refreshMenuAvailability(db *gorm.DB) ([]menuAvailabilityChange, error) {
+	var products []models.Product
+	err := db.Preload("Recipe.Ingredients.Ingredient").
+		Where("available = ? OR sold_out = ?", true, true).
+		Find(&products).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []menuAvailabilityChange
+	now := time.Now()
+
+	for _, product := range products {
+		servings, err := productServings(db, &product)
+		if err != nil {
+			return changes, err
+		}
+
+		soldOut := product.Available && servings != nil && *servings == 0
+		if soldOut == product.SoldOut {
+			continue
+		}
+
+		updates := map[string]interface{}{"sold_out": soldOut, "sold_out_at": nil}
+		if soldOut {
+			updates["sold_out_at"] = now
+		}
+		if err := db.Model(&models.Product{}).Where("id = ?", product.ID).Updates(updates).Error; err != nil {
+			return changes, err
+		}
+
+		changes = append(changes, menuAvailabilityChange{
+			ProductID:   product.ID,
+			ProductName: product.Name,
+			Servings:    servings,
+			SoldOut:     soldOut,
+		})
+	}
+
+	return changes, nil
+}
+
+// productServings จำนวนที่ทำได้จากสต๊อกที่ไม่ได้ถูกจอง ถูกจำกัดด้วยวัตถุดิบที่พอน้อยที่สุดในสูตร
+// product ต้องโหลด Recipe.Ingredients.Ingredient มาแล้ว คืน nil ถ้าไม่มีสูตร
+func productServings(db *gorm.DB, product *models.Product) (*int, error) {
+	if product.Recipe == nil || len(product.Recipe.Ingredients) == 0 {
+		return nil, nil
+	}
+
+	// วัตถุดิบเดียวกันอาจอยู่ในสูตรหลายบรรทัด รวมปริมาณต่อแก้วก่อน
+	perServing := make(map[string]float64)
+	stock := make(map[string]float64)
+	for _, item := range product.Recipe.Ingredients {
+		quantity, err := toStockQuantity(db, &item.Ingredient, item.Quantity, item.Unit)
+		if err != nil {
+			return nil, err
+		}
+		perServing[item.IngredientID] += quantity
+		stock[item.IngredientID] = availableStock(&item.Ingredient)
+	}
+
+	servings := -1
+	for ingredientID, quantity := range perServing {
+		if quantity <= 0 {
+			continue
+		}
+
+		// เผื่อค่าปัดเศษ เช่น 36 / 18 ที่ได้ 1.9999999
+		possible := int(math.Floor(stock[ingredientID]/quantity + 1e-9))
+		if servings == -1 || possible < servings {
+			servings = possible
+		}
+	}
+
+	if servings == -1 {
+		return nil, nil
+	}
+	if servings < 0 {
+		servings = 0
+	}
+	return &servings, nil
+}
@@ -1,9 +1,11 @@
 package handlers
 
 import (
+	"coffee-pula-backend/alerts"
 	"coffee-pula-backend/database"
 	"coffee-pula-backend/models"
 	"fmt"
+	"sort"
 	"time"
 	"github.com/gofiber/fiber/v2"
 )
@@ -22,7 +24,7 @@ func GetOrders(c *fiber.Ctx) error {
 	return c.JSON(orders)
 }
 
-// CreateOrder - สร้างออเดอร์ใหม่ พร้อมหักสต๊อกอัตโนมัติ
+// CreateOrder - สร้างออเดอร์ใหม่ พร้อมหักสต๊อกอัตโนมัติ (หรือจองสต๊อกไว้จนกว่าออเดอร์จะเสร็จ)
 func CreateOrder(c *fiber.Ctx) error {
 	var request struct {
 		Items []struct {
@@ -30,7 +32,10 @@ func CreateOrder(c *fiber.Ctx) error {
 			Quantity int     `json:"quantity"`
 			Price    float64 `json:"price"`
 		} `json:"items"`
-		CustomerName *string `json:"customerName"`
+		CustomerName       *string `json:"customerName"`
+		MemberID           *string `json:"memberId"`
+		ReserveStock       bool    `json:"reserveStock"`       // จองสต๊อกแทนการตัดทันที
+		ReservationMinutes *int    `json:"reservationMinutes"` // เวลาจอง (นาที) ไม่ระบุ = 15 นาที
 	}
 	
 	if err := c.BodyParser(&request); err != nil {
@@ -45,18 +50,47 @@ func CreateOrder(c *fiber.Ctx) error {
 		totalAmount += item.Price * float64(item.Quantity)
 	}
 	
-	// Generate order number
-	orderNumber := fmt.Sprintf("ORD-%d", time.Now().Unix())
-	
 	// Start transaction
 	tx := database.DB.Begin()
 	
+	// Generate order number (ลำดับต่อวัน ออเดอร์ที่สร้างพร้อมกันได้เลขไม่ซ้ำ)
+	orderNumber, err := nextDocumentNumber(tx, "ORD-", &models.Order{}, time.Now())
+	if err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to generate order number",
+		})
+	}
+	
 	// Create order
 	order := models.Order{
 		OrderNumber:  orderNumber,
 		TotalAmount:  totalAmount,
 		Status:       models.OrderStatusPending,
 		CustomerName: request.CustomerName,
+		MemberID:     request.MemberID,
+	}
+	
+	// โหมดจองสต๊อก ตัดจริงเมื่อออเดอร์เสร็จ
+	if request.ReserveStock {
+		ttl := defaultReservationTTL
+		if request.ReservationMinutes != nil && *request.ReservationMinutes > 0 {
+			ttl = time.Duration(*request.ReservationMinutes) * time.Minute
+		}
+		expiresAt := time.Now().Add(ttl)
+		order.StockReserved = true
+		order.ReservationExpiresAt = &expiresAt
+	}
+	
+	// ตรวจสอบสมาชิก (ถ้ามี)
+	if request.MemberID != nil {
+		var member models.Member
+		if err := tx.First(&member, "id = ? AND is_active = ?", *request.MemberID, true).Error; err != nil {
+			tx.Rollback()
+			return c.Status(404).JSON(fiber.Map{
+				"error": "Member not found",
+			})
+		}
 	}
 	
 	if err := tx.Create(&order).Error; err != nil {
@@ -66,8 +100,14 @@ func CreateOrder(c *fiber.Ctx) error {
 		})
 	}
 	
-	// Create order items และหักสต๊อก
+	// Create order items และรวมปริมาณวัตถุดิบที่ต้องใช้ทั้งออเดอร์
+	// สินค้าหลายรายการใช้วัตถุดิบเดียวกันได้ ต้องตรวจและตัดจากยอดรวม ไม่ใช่ทีละรายการ
+	needed := make(map[string]float64)
 	for _, item := range request.Items {
+		// Get product with recipe
+		var product models.Product
+		productErr := tx.Preload("Recipe.Ingredients.Ingredient").First(&product, "id = ?", item.MenuID).Error
+		
 		// Create order item
 		orderItem := models.OrderItem{
 			OrderID:   order.ID,
@@ -77,6 +117,14 @@ func CreateOrder(c *fiber.Ctx) error {
 			Subtotal:  item.Price * float64(item.Quantity),
 		}
 		
+		// บันทึกต้นทุนและเวอร์ชันสูตร ณ เวลาที่ขาย
+		if productErr == nil {
+			currentCostSnapshot(tx, product, order.CreatedAt).applyTo(&orderItem)
+			if product.Recipe != nil {
+				orderItem.RecipeVersionID = product.Recipe.ActiveVersionID
+			}
+		}
+		
 		if err := tx.Create(&orderItem).Error; err != nil {
 			tx.Rollback()
 			return c.Status(500).JSON(fiber.Map{
@@ -84,61 +132,108 @@ func CreateOrder(c *fiber.Ctx) error {
 			})
 		}
 		
-		// Get product with recipe
-		var product models.Product
-		if err := tx.Preload("Recipe.Ingredients.Ingredient").First(&product, "id = ?", item.MenuID).Error; err != nil {
+		if productErr != nil {
 			// Product not found, continue (some products might not have recipes)
 			continue
 		}
 		
-		// If product has recipe, deduct ingredients
+		// If product has recipe, add ingredients to the order total
 		if product.Recipe != nil {
 			for _, recipeIngredient := range product.Recipe.Ingredients {
-				totalNeeded := recipeIngredient.Quantity * float64(item.Quantity)
-				
-				// Check if enough stock
-				if recipeIngredient.Ingredient.CurrentStock < totalNeeded {
+				// สูตรอาจใช้หน่วยต่างจากหน่วยสต๊อก (ใช้ข้อมูลวัตถุดิบที่ preload มาเฉพาะการแปลงหน่วย ไม่ใช้ยอดสต๊อก)
+				perServing, err := toStockQuantity(tx, &recipeIngredient.Ingredient, recipeIngredient.Quantity, recipeIngredient.Unit)
+				if err != nil {
 					tx.Rollback()
 					return c.Status(400).JSON(fiber.Map{
-						"error": fmt.Sprintf("ไม่มี %s เพียงพอ (ต้องการ %.2f %s, มีเหลือ %.2f %s)", 
-							recipeIngredient.Ingredient.Name,
-							totalNeeded,
-							recipeIngredient.Ingredient.Unit,
-							recipeIngredient.Ingredient.CurrentStock,
-							recipeIngredient.Ingredient.Unit),
-					})
-				}
-				
-				// Deduct stock
-				newStock := recipeIngredient.Ingredient.CurrentStock - totalNeeded
-				if err := tx.Model(&models.Ingredient{}).Where("id = ?", recipeIngredient.IngredientID).Update("current_stock", newStock).Error; err != nil {
-					tx.Rollback()
-					return c.Status(500).JSON(fiber.Map{
-						"error": "Failed to update ingredient stock",
-					})
-				}
-				
-				// Record stock movement
-				movement := models.StockMovement{
-					IngredientID: recipeIngredient.IngredientID,
-					Type:         models.StockMovementTypeOut,
-					Quantity:     totalNeeded,
-					Reason:       stringPtr(fmt.Sprintf("ขาย - %s", product.Name)),
-					Reference:    &order.ID,
-				}
-				
-				if err := tx.Create(&movement).Error; err != nil {
-					tx.Rollback()
-					return c.Status(500).JSON(fiber.Map{
-						"error": "Failed to record stock movement",
+						"error": err.Error(),
 					})
 				}
+				needed[recipeIngredient.IngredientID] += perServing * float64(item.Quantity)
 			}
 		}
 	}
 	
+	// ล็อกวัตถุดิบทุกตัวเรียงตาม id ก่อนตัดหรือจอง ลำดับเดียวกับจุดตัดสต๊อกอื่นจึงไม่ deadlock
+	// ยอดสต๊อกอ่านใหม่หลังล็อก และตัดแบบบวกลบกับค่าในฐานข้อมูล ออเดอร์พร้อมกันจึงไม่ทับกัน
+	ingredientIDs := make([]string, 0, len(needed))
+	for ingredientID := range needed {
+		ingredientIDs = append(ingredientIDs, ingredientID)
+	}
+	sort.Strings(ingredientIDs)
+	if err := lockIngredients(tx, ingredientIDs); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to load ingredient",
+		})
+	}
+	
+	var lowStock []alerts.LowStockAlert
+	for _, ingredientID := range ingredientIDs {
+		totalNeeded := needed[ingredientID]
+		
+		ingredient, err := lockIngredient(tx, ingredientID)
+		if err != nil {
+			tx.Rollback()
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to load ingredient",
+			})
+		}
+		
+		// Check if enough stock (ไม่นับส่วนที่จองให้ออเดอร์อื่นไว้และล็อตที่หมดอายุ)
+		usable, err := usableStock(tx, ingredient)
+		if err != nil {
+			tx.Rollback()
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to load ingredient",
+			})
+		}
+		if usable < totalNeeded {
+			err = insufficientStockError(tx, ingredient, totalNeeded)
+			tx.Rollback()
+			return c.Status(400).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		
+		// จองไว้ก่อน ตัดสต๊อกจริงเมื่อออเดอร์เสร็จ
+		if order.StockReserved {
+			if err := reserveStock(tx, ingredient, order.ID, totalNeeded, *order.ReservationExpiresAt); err != nil {
+				tx.Rollback()
+				return c.Status(500).JSON(fiber.Map{
+					"error": "Failed to reserve ingredient stock",
+				})
+			}
+			continue
+		}
+		
+		// Deduct stock และบันทึกต้นทุนที่ตัดออก
+		_, err = issueStock(tx, ingredient, models.StockMovementTypeOut, stockEntry{
+			Quantity:  totalNeeded,
+			Reason:    stringPtr(fmt.Sprintf("ขาย - %s", order.OrderNumber)),
+			Reference: &order.ID,
+		})
+		if err != nil {
+			tx.Rollback()
+			return c.Status(500).JSON(fiber.Map{
+				"error": "Failed to update ingredient stock",
+			})
+		}
+		
+		if alert := lowStockAlert(ingredient, totalNeeded, &order.ID); alert != nil {
+			lowStock = append(lowStock, *alert)
+		}
+	}
+	
 	// Commit transaction
-	tx.Commit()
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to create order",
+		})
+	}
+	
+	// แจ้งเตือนวัตถุดิบที่ต่ำกว่าขั้นต่ำหลังบันทึกสำเร็จ
+	notifyLowStock(lowStock)
+	scheduleMenuRefresh()
 	
 	// Return order with items
 	database.DB.Preload("Items.Product").First(&order, "id = ?", order.ID)
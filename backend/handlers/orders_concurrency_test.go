@@ -0,0 +1,197 @@
+//go:build integration
+
+// ทดสอบกับ MySQL จริง: DB_HOST=localhost DB_USER=... DB_PASSWORD=... DB_NAME=... go test -tags integration ./handlers/
+package handlers
+
+import (
+	"bytes"
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// orderFixture ข้อมูลทดสอบ ลบทิ้งทั้งหมดเมื่อจบการทดสอบ
+type orderFixture struct {
+	t        *testing.T
+	suffix   string
+	category models.Category
+}
+
+func newOrderFixture(t *testing.T) *orderFixture {
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST not set")
+	}
+	database.Connect()
+	database.Migrate()
+
+	f := &orderFixture{t: t, suffix: uuid.New().String()[:8]}
+	f.category = models.Category{Name: "ทดสอบ " + f.suffix}
+	f.create(&f.category)
+	return f
+}
+
+func (f *orderFixture) create(value interface{}) {
+	f.t.Helper()
+	if err := database.DB.Create(value).Error; err != nil {
+		f.t.Fatal(err)
+	}
+	f.t.Cleanup(func() { database.DB.Unscoped().Delete(value) })
+}
+
+func (f *orderFixture) ingredient(name string, stock float64) models.Ingredient {
+	ingredient := models.Ingredient{Name: name + " " + f.suffix, Unit: "กรัม", CostPerUnit: 1, CurrentStock: stock}
+	f.create(&ingredient)
+	f.t.Cleanup(func() {
+		database.DB.Unscoped().Where("ingredient_id = ?", ingredient.ID).Delete(&models.StockMovement{})
+		database.DB.Unscoped().Where("ingredient_id = ?", ingredient.ID).Delete(&models.IngredientCostLayer{})
+	})
+	return ingredient
+}
+
+// product สร้างสินค้าพร้อมสูตร ส่วนผสมเรียงตามที่ส่งมา
+func (f *orderFixture) product(name string, components ...models.RecipeIngredient) models.Product {
+	product := models.Product{Name: name + " " + f.suffix, Price: 50, CategoryID: f.category.ID}
+	f.create(&product)
+	f.t.Cleanup(func() {
+		var orderIDs []string
+		database.DB.Model(&models.OrderItem{}).Where("product_id = ?", product.ID).Pluck("order_id", &orderIDs)
+		database.DB.Unscoped().Where("product_id = ?", product.ID).Delete(&models.OrderItem{})
+		if len(orderIDs) > 0 {
+			database.DB.Unscoped().Where("id IN ?", orderIDs).Delete(&models.Order{})
+		}
+	})
+
+	recipe := models.Recipe{ProductID: product.ID}
+	f.create(&recipe)
+	for i := range components {
+		components[i].RecipeID = recipe.ID
+		f.create(&components[i])
+	}
+	return product
+}
+
+// placeOrders ยิงออเดอร์ทั้งหมดพร้อมกัน ทุกออเดอร์ต้องสำเร็จ
+func placeOrders(t *testing.T, orders [][]string) {
+	app := fiber.New()
+	app.Post("/orders", CreateOrder)
+
+	var wg sync.WaitGroup
+	statuses := make([]int, len(orders))
+	for i, productIDs := range orders {
+		items := make([]fiber.Map, 0, len(productIDs))
+		for _, productID := range productIDs {
+			items = append(items, fiber.Map{"menuId": productID, "quantity": 1, "price": 50})
+		}
+		body, _ := json.Marshal(fiber.Map{"items": items})
+
+		wg.Add(1)
+		go func(i int, body []byte) {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/orders", bytes.NewReader(body))
+			req.Header.Set("Content-Type", "application/json")
+			resp, err := app.Test(req, -1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			statuses[i] = resp.StatusCode
+		}(i, body)
+	}
+	wg.Wait()
+
+	for i, status := range statuses {
+		if status != 201 {
+			t.Errorf("order %d: status %d, want 201", i, status)
+		}
+	}
+}
+
+// assertIssued ตรวจยอดสต๊อกคงเหลือและจำนวน movement OUT ของวัตถุดิบ
+func assertIssued(t *testing.T, ingredient models.Ingredient, issued float64, movements int64) {
+	t.Helper()
+
+	var current models.Ingredient
+	if err := database.DB.First(&current, "id = ?", ingredient.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	want := ingredient.CurrentStock - issued
+	if math.Abs(current.CurrentStock-want) > 1e-6 {
+		t.Errorf("%s: current_stock = %.2f, want %.2f", ingredient.Name, current.CurrentStock, want)
+	}
+
+	var count int64
+	database.DB.Model(&models.StockMovement{}).
+		Where("ingredient_id = ? AND type = ?", ingredient.ID, models.StockMovementTypeOut).
+		Count(&count)
+	if count != movements {
+		t.Errorf("%s: OUT movements = %d, want %d", ingredient.Name, count, movements)
+	}
+}
+
+// TestCreateOrderConcurrentStock ยิงออเดอร์พร้อมกันหลายรายการที่ใช้วัตถุดิบเดียวกัน
+// สต๊อกต้องลดครบทุกออเดอร์และมี movement OUT หนึ่งรายการต่อออเดอร์
+func TestCreateOrderConcurrentStock(t *testing.T) {
+	f := newOrderFixture(t)
+
+	const orders = 20
+	beans := f.ingredient("เมล็ดกาแฟทดสอบ", 1000)
+	espresso := f.product("เอสเปรสโซทดสอบ", models.RecipeIngredient{IngredientID: beans.ID, Quantity: 18})
+
+	batch := make([][]string, orders)
+	for i := range batch {
+		batch[i] = []string{espresso.ID}
+	}
+	placeOrders(t, batch)
+
+	assertIssued(t, beans, orders*18, orders)
+}
+
+// TestCreateOrderConcurrentSharedIngredients สินค้าสองตัวใช้วัตถุดิบชุดเดียวกันแต่สูตรเรียงส่วนผสมกลับกัน
+// ออเดอร์พร้อมกันต้องไม่ deadlock และตัดสต๊อกครบทุกวัตถุดิบ
+func TestCreateOrderConcurrentSharedIngredients(t *testing.T) {
+	f := newOrderFixture(t)
+
+	const orders = 30
+	beans := f.ingredient("เมล็ดกาแฟทดสอบ", 2000)
+	milk := f.ingredient("นมสดทดสอบ", 10000)
+	latte := f.product("ลาเต้ทดสอบ",
+		models.RecipeIngredient{IngredientID: beans.ID, Quantity: 18},
+		models.RecipeIngredient{IngredientID: milk.ID, Quantity: 150},
+	)
+	cappuccino := f.product("คาปูชิโน่ทดสอบ",
+		models.RecipeIngredient{IngredientID: milk.ID, Quantity: 100},
+		models.RecipeIngredient{IngredientID: beans.ID, Quantity: 18},
+	)
+
+	// สลับลำดับสินค้าในออเดอร์ ทุกออเดอร์ใช้วัตถุดิบทั้งสองตัว
+	batch := make([][]string, orders)
+	var beansIssued, milkIssued float64
+	for i := range batch {
+		switch i % 3 {
+		case 0:
+			batch[i] = []string{latte.ID}
+			beansIssued += 18
+			milkIssued += 150
+		case 1:
+			batch[i] = []string{cappuccino.ID}
+			beansIssued += 18
+			milkIssued += 100
+		default:
+			batch[i] = []string{cappuccino.ID, latte.ID}
+			beansIssued += 36
+			milkIssued += 250
+		}
+	}
+	placeOrders(t, batch)
+
+	assertIssued(t, beans, beansIssued, orders)
+	assertIssued(t, milk, milkIssued, orders)
+}
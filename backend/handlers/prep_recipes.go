@@ -0,0 +1,458 @@
+package handlers
+
+import (
+	"coffee-pula-backend/alerts"
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var errPrepRecipeCycle = errors.New("prep recipe cannot contain itself")
+
+// GetPrepRecipes ดึงสูตรผลิตวัตถุดิบกึ่งสำเร็จรูปทั้งหมด
+func GetPrepRecipes(c *fiber.Ctx) error {
+	var recipes []models.PrepRecipe
+	result := database.DB.Preload("Ingredient").Preload("Components.Ingredient").Find(&recipes)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(recipes)
+}
+
+// GetPrepRecipe ดึงสูตรผลิตของวัตถุดิบ พร้อมต้นทุนตามสูตรที่คิดลงไปทุกชั้น
+func GetPrepRecipe(c *fiber.Ctx) error {
+	ingredientID := c.Params("ingredient_id")
+
+	recipe, err := loadPrepRecipe(database.DB, ingredientID)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Prep recipe not found"})
+	}
+
+	type componentCost struct {
+		IngredientID   string   `json:"ingredient_id"`
+		IngredientName string   `json:"ingredient_name"`
+		Quantity       float64  `json:"quantity"`
+		Unit           string   `json:"unit"`
+		StockQuantity  float64  `json:"stock_quantity"` // ปริมาณเป็นหน่วยสต๊อกของส่วนผสม
+		UnitCost       float64  `json:"unit_cost"`      // ต้นทุนตามสูตรต่อหน่วยสต๊อกของส่วนผสม
+		Cost           float64  `json:"cost"`
+		Prepared       bool     `json:"prepared"` // ส่วนผสมนี้ผลิตเองอีกชั้น
+		CurrentCost    *float64 `json:"current_cost,omitempty"`
+	}
+
+	components := make([]componentCost, 0, len(recipe.Components))
+	batchCost := 0.0
+	for _, component := range recipe.Components {
+		quantity, err := toStockQuantity(database.DB, &component.Ingredient, component.Quantity, component.Unit)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		unitCost, err := ingredientStandardCost(database.DB, &component.Ingredient, map[string]bool{recipe.IngredientID: true})
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		row := componentCost{
+			IngredientID:   component.IngredientID,
+			IngredientName: component.Ingredient.Name,
+			Quantity:       component.Quantity,
+			Unit:           unitName(&component.Ingredient, component.Unit),
+			StockQuantity:  roundCost(quantity),
+			UnitCost:       roundCost(unitCost),
+			Cost:           roundCost(quantity * unitCost),
+		}
+		if _, err := loadPrepRecipe(database.DB, component.IngredientID); err == nil {
+			row.Prepared = true
+			current := component.Ingredient.CostPerUnit
+			row.CurrentCost = &current
+		}
+
+		batchCost += row.Cost
+		components = append(components, row)
+	}
+
+	return c.JSON(fiber.Map{
+		"recipe":        recipe,
+		"components":    components,
+		"batch_cost":    roundCost(batchCost),
+		"standard_cost": roundCost(batchCost / recipe.YieldQuantity),
+		"current_cost":  recipe.Ingredient.CostPerUnit, // ต้นทุนจริงจากการผลิตครั้งก่อน
+	})
+}
+
+// SavePrepRecipe สร้างหรือแทนที่สูตรผลิตของวัตถุดิบ
+func SavePrepRecipe(c *fiber.Ctx) error {
+	ingredientID := c.Params("ingredient_id")
+
+	var request struct {
+		YieldQuantity float64 `json:"yield_quantity"`
+		Instructions  *string `json:"instructions"`
+		Components    []struct {
+			IngredientID string  `json:"ingredient_id"`
+			Quantity     float64 `json:"quantity"`
+			Unit         *string `json:"unit"`
+		} `json:"components"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if request.YieldQuantity <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "yield_quantity must be positive"})
+	}
+	if len(request.Components) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "components are required"})
+	}
+
+	var recipe models.PrepRecipe
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var ingredient models.Ingredient
+		if err := tx.First(&ingredient, "id = ?", ingredientID).Error; err != nil {
+			return err
+		}
+
+		err := tx.Where("ingredient_id = ?", ingredientID).First(&recipe).Error
+		if err == gorm.ErrRecordNotFound {
+			recipe = models.PrepRecipe{IngredientID: ingredientID}
+		} else if err != nil {
+			return err
+		}
+		recipe.YieldQuantity = request.YieldQuantity
+		recipe.Instructions = request.Instructions
+		if err := tx.Save(&recipe).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("prep_recipe_id = ?", recipe.ID).Delete(&models.PrepRecipeComponent{}).Error; err != nil {
+			return err
+		}
+
+		for _, input := range request.Components {
+			if input.Quantity <= 0 {
+				return invalidPrepRecipe("component quantity must be positive")
+			}
+			if input.IngredientID == ingredientID {
+				return errPrepRecipeCycle
+			}
+
+			var component models.Ingredient
+			if err := tx.First(&component, "id = ?", input.IngredientID).Error; err != nil {
+				return invalidPrepRecipe("ingredient %s not found", input.IngredientID)
+			}
+			if _, err := unitFactor(tx, &component, input.Unit); err != nil {
+				return err
+			}
+
+			err := tx.Create(&models.PrepRecipeComponent{
+				PrepRecipeID: recipe.ID,
+				IngredientID: component.ID,
+				Quantity:     input.Quantity,
+				Unit:         normalizeUnit(&component, input.Unit),
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		// คิดต้นทุนลงไปทุกชั้นเพื่อตรวจว่าไม่มีสูตรวนกลับมาหาตัวเอง
+		if _, err := ingredientStandardCost(tx, &ingredient, map[string]bool{}); err != nil {
+			return err
+		}
+
+		return recomputeRecipeCostsForIngredient(tx, ingredientID)
+	})
+	if err != nil {
+		return prepRecipeError(c, err)
+	}
+
+	database.DB.Preload("Ingredient").Preload("Components.Ingredient").First(&recipe, "id = ?", recipe.ID)
+
+	return c.JSON(recipe)
+}
+
+// DeletePrepRecipe ลบสูตรผลิต วัตถุดิบที่ผลิตไว้แล้วยังอยู่ในสต๊อก
+func DeletePrepRecipe(c *fiber.Ctx) error {
+	ingredientID := c.Params("ingredient_id")
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var recipe models.PrepRecipe
+		if err := tx.Where("ingredient_id = ?", ingredientID).First(&recipe).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("prep_recipe_id = ?", recipe.ID).Delete(&models.PrepRecipeComponent{}).Error; err != nil {
+			return err
+		}
+		// ลบถาวรเพราะ ingredient_id เป็น unique สร้างสูตรใหม่ให้วัตถุดิบเดิมได้
+		if err := tx.Unscoped().Delete(&recipe).Error; err != nil {
+			return err
+		}
+		return recomputeRecipeCostsForIngredient(tx, ingredientID)
+	})
+	if err != nil {
+		return prepRecipeError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Prep recipe deleted successfully"})
+}
+
+// GetProductionBatches ดึงประวัติการผลิต
+func GetProductionBatches(c *fiber.Ctx) error {
+	startDate, endDate, err := parseReportPeriod(c, 30)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	query := database.DB.Preload("Ingredient").Where("produced_at >= ? AND produced_at < ?", startDate, endDate)
+	if ingredientID := c.Query("ingredient_id"); ingredientID != "" {
+		query = query.Where("ingredient_id = ?", ingredientID)
+	}
+
+	var batches []models.ProductionBatch
+	result := query.Order("produced_at DESC").Find(&batches)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(batches)
+}
+
+// CreateProductionBatch บันทึกการผลิต ตัดส่วนผสมตามสูตรและรับวัตถุดิบที่ผลิตได้เข้าสต๊อก
+// ต้นทุนต่อหน่วยของที่ผลิตได้คือต้นทุนจริงของส่วนผสมที่ตัดออกหารด้วยปริมาณที่ได้จริง
+func CreateProductionBatch(c *fiber.Ctx) error {
+	var request struct {
+		IngredientID string     `json:"ingredient_id"`
+		Batches      float64    `json:"batches"`      // ไม่ระบุ = 1 รอบ
+		ActualYield  *float64   `json:"actual_yield"` // ปริมาณที่ได้จริง ไม่ระบุ = ตามสูตร
+		ProducedBy   *string    `json:"produced_by"`
+		Notes        *string    `json:"notes"`
+		LotNumber    *string    `json:"lot_number"`
+		ExpiryDate   *time.Time `json:"expiry_date"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if request.Batches == 0 {
+		request.Batches = 1
+	}
+	if request.Batches < 0 || (request.ActualYield != nil && *request.ActualYield <= 0) {
+		return c.Status(400).JSON(fiber.Map{"error": "batches and actual_yield must be positive"})
+	}
+
+	var batch models.ProductionBatch
+	var lowStock []alerts.LowStockAlert
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		recipe, err := loadPrepRecipe(tx, request.IngredientID)
+		if err != nil {
+			return err
+		}
+
+		output := recipe.YieldQuantity * request.Batches
+		if request.ActualYield != nil {
+			output = *request.ActualYield
+		}
+
+		batch = models.ProductionBatch{
+			IngredientID: recipe.IngredientID,
+			Batches:      request.Batches,
+			Quantity:     output,
+			ProducedBy:   request.ProducedBy,
+			Notes:        request.Notes,
+			ProducedAt:   time.Now(),
+		}
+		if err := tx.Create(&batch).Error; err != nil {
+			return err
+		}
+
+		reason := fmt.Sprintf("ผลิต %s", recipe.Ingredient.Name)
+		totalCost := 0.0
+
+		// ล็อกส่วนผสมและวัตถุดิบที่ผลิตได้พร้อมกันตามลำดับ id
+		ingredientIDs := []string{recipe.IngredientID}
+		for _, component := range recipe.Components {
+			ingredientIDs = append(ingredientIDs, component.IngredientID)
+		}
+		if err := lockIngredients(tx, ingredientIDs); err != nil {
+			return err
+		}
+
+		for _, component := range recipe.Components {
+			ingredient, err := lockIngredient(tx, component.IngredientID)
+			if err != nil {
+				return err
+			}
+
+			quantity, err := toStockQuantity(tx, ingredient, component.Quantity, component.Unit)
+			if err != nil {
+				return err
+			}
+			quantity *= request.Batches
+
+			movement, err := issueStock(tx, ingredient, models.StockMovementTypeProductionOut, stockEntry{
+				Quantity:  quantity,
+				Reason:    &reason,
+				Reference: &batch.ID,
+			})
+			if errors.Is(err, errInsufficientStock) {
+				return insufficientStockError(tx, ingredient, quantity)
+			}
+			if err != nil {
+				return err
+			}
+			totalCost += *movement.TotalCost
+
+			if alert := lowStockAlert(ingredient, quantity, &batch.ID); alert != nil {
+				lowStock = append(lowStock, *alert)
+			}
+		}
+
+		produced, err := lockIngredient(tx, recipe.IngredientID)
+		if err != nil {
+			return err
+		}
+
+		unitCost := roundCost(totalCost / output)
+		_, err = receiveStock(tx, produced, models.StockMovementTypeProductionIn, stockEntry{
+			Quantity:   output,
+			UnitCost:   &unitCost,
+			Reason:     &reason,
+			Reference:  &batch.ID,
+			LotNumber:  request.LotNumber,
+			ExpiryDate: request.ExpiryDate,
+		})
+		if err != nil {
+			return err
+		}
+
+		batch.TotalCost = roundCost(totalCost)
+		batch.UnitCost = unitCost
+		return tx.Model(&batch).Updates(map[string]interface{}{
+			"total_cost": batch.TotalCost,
+			"unit_cost":  batch.UnitCost,
+		}).Error
+	})
+	if err != nil {
+		return prepRecipeError(c, err)
+	}
+
+	notifyLowStock(lowStock)
+	scheduleMenuRefresh()
+
+	database.DB.Preload("Ingredient").First(&batch, "id = ?", batch.ID)
+
+	return c.Status(201).JSON(batch)
+}
+
+// loadPrepRecipe ดึงสูตรผลิตของวัตถุดิบพร้อมส่วนผสม
+func loadPrepRecipe(db *gorm.DB, ingredientID string) (*models.PrepRecipe, error) {
+	var recipe models.PrepRecipe
+	err := db.Preload("Ingredient").Preload("Components.Ingredient").
+		Where("ingredient_id = ?", ingredientID).
+		First(&recipe).Error
+	if err != nil {
+		return nil, err
+	}
+	return &recipe, nil
+}
+
+// ingredientStandardCost ต้นทุนต่อหน่วยสต๊อกตามสูตร วัตถุดิบที่ผลิตเองคิดจากสูตรผลิตลงไปทุกชั้น
+// วัตถุดิบทั่วไปใช้ต้นทุนต่อหน่วยปัจจุบัน visiting ใช้ตรวจสูตรที่วนกลับมาหาตัวเอง
+func ingredientStandardCost(db *gorm.DB, ingredient *models.Ingredient, visiting map[string]bool) (float64, error) {
+	recipe, err := loadPrepRecipe(db, ingredient.ID)
+	if err == gorm.ErrRecordNotFound {
+		return ingredient.CostPerUnit, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if visiting[ingredient.ID] {
+		return 0, errPrepRecipeCycle
+	}
+	visiting[ingredient.ID] = true
+	defer delete(visiting, ingredient.ID)
+
+	batchCost := 0.0
+	for _, component := range recipe.Components {
+		quantity, err := toStockQuantity(db, &component.Ingredient, component.Quantity, component.Unit)
+		if err != nil {
+			return 0, err
+		}
+		unitCost, err := ingredientStandardCost(db, &component.Ingredient, visiting)
+		if err != nil {
+			return 0, err
+		}
+		batchCost += quantity * unitCost
+	}
+
+	return batchCost / recipe.YieldQuantity, nil
+}
+
+// preparedIngredientsUsing วัตถุดิบที่ผลิตเองซึ่งใช้วัตถุดิบนี้เป็นส่วนผสม ทั้งทางตรงและผ่านชั้นอื่น
+func preparedIngredientsUsing(tx *gorm.DB, ingredientID string) ([]string, error) {
+	seen := map[string]bool{ingredientID: true}
+	queue := []string{ingredientID}
+	var result []string
+
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		var parents []string
+		err := tx.Model(&models.PrepRecipe{}).
+			Joins("JOIN prep_recipe_components ON prep_recipe_components.prep_recipe_id = prep_recipes.id AND prep_recipe_components.deleted_at IS NULL").
+			Where("prep_recipe_components.ingredient_id = ?", current).
+			Distinct().
+			Pluck("prep_recipes.ingredient_id", &parents).Error
+		if err != nil {
+			return nil, err
+		}
+
+		for _, parent := range parents {
+			if !seen[parent] {
+				seen[parent] = true
+				result = append(result, parent)
+				queue = append(queue, parent)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// prepRecipeError แปลงข้อผิดพลาดเป็น HTTP response
+// ข้อมูลไม่ถูกต้อง สูตรวน หรือสต๊อกไม่พอตอบ 400 ส่วนข้อผิดพลาดจากฐานข้อมูลตอบ 500
+func prepRecipeError(c *fiber.Ctx, err error) error {
+	var invalid prepRecipeInvalid
+	var shortage stockShortage
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Prep recipe or ingredient not found"})
+	case errors.As(err, &invalid), errors.As(err, &shortage),
+		errors.Is(err, errPrepRecipeCycle), errors.Is(err, errUnitConversion):
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	log.Println("Prep recipe update failed:", err)
+	return c.Status(500).JSON(fiber.Map{"error": "Failed to update prep recipe"})
+}
+
+// prepRecipeInvalid ข้อผิดพลาดจากข้อมูลสูตรผลิตที่ส่งมา ตอบกลับเป็น 400
+type prepRecipeInvalid string
+
+func (e prepRecipeInvalid) Error() string {
+	return string(e)
+}
+
+func invalidPrepRecipe(format string, args ...interface{}) error {
+	return prepRecipeInvalid(fmt.Sprintf(format, args...))
+}
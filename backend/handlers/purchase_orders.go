@@ -0,0 +1,496 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// purchaseOrderLineInput รายการที่ส่งมาตอนสร้างหรือแก้ไขใบสั่งซื้อ
+type purchaseOrderLineInput struct {
+	IngredientID string   `json:"ingredient_id"`
+	Quantity     float64  `json:"quantity"`
+	UnitPrice    *float64 `json:"unit_price"` // ไม่ระบุ = ใช้ราคาจากรายการราคาของผู้จำหน่าย
+	Unit         *string  `json:"unit"`       // ไม่ระบุ = หน่วยสั่งซื้อของวัตถุดิบ
+}
+
+// GetPurchaseOrders ดึงรายการใบสั่งซื้อ
+func GetPurchaseOrders(c *fiber.Ctx) error {
+	var orders []models.PurchaseOrder
+
+	query := database.DB.Preload("Supplier").Preload("Lines.Ingredient")
+
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	if supplierID := c.Query("supplier_id"); supplierID != "" {
+		query = query.Where("supplier_id = ?", supplierID)
+	}
+
+	result := query.Order("created_at DESC").Find(&orders)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(orders)
+}
+
+// GetPurchaseOrder ดึงใบสั่งซื้อพร้อมรายการ
+func GetPurchaseOrder(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var order models.PurchaseOrder
+	result := database.DB.Preload("Supplier").Preload("Lines.Ingredient").First(&order, "id = ?", id)
+	if result.Error != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Purchase order not found"})
+	}
+
+	return c.JSON(order)
+}
+
+// CreatePurchaseOrder สร้างใบสั่งซื้อฉบับร่าง
+func CreatePurchaseOrder(c *fiber.Ctx) error {
+	var request struct {
+		SupplierID string                   `json:"supplier_id"`
+		Notes      *string                  `json:"notes"`
+		Lines      []purchaseOrderLineInput `json:"lines"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	var supplier models.Supplier
+	if err := database.DB.First(&supplier, "id = ? AND is_active = ?", request.SupplierID, true).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Supplier not found"})
+	}
+
+	order := models.PurchaseOrder{
+		SupplierID: supplier.ID,
+		Status:     models.PurchaseOrderStatusDraft,
+		Notes:      request.Notes,
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		number, err := nextDocumentNumber(tx, "PO", &models.PurchaseOrder{}, time.Now())
+		if err != nil {
+			return err
+		}
+		order.PONumber = number
+
+		if err := tx.Create(&order).Error; err != nil {
+			return err
+		}
+		return replacePurchaseOrderLines(tx, &order, request.Lines)
+	})
+	if err != nil {
+		return purchaseOrderError(c, err)
+	}
+
+	database.DB.Preload("Supplier").Preload("Lines.Ingredient").First(&order, "id = ?", order.ID)
+
+	return c.Status(201).JSON(order)
+}
+
+// UpdatePurchaseOrder แก้ไขใบสั่งซื้อ (เฉพาะฉบับร่าง)
+func UpdatePurchaseOrder(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var request struct {
+		Notes *string                  `json:"notes"`
+		Lines []purchaseOrderLineInput `json:"lines"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	var order models.PurchaseOrder
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if order.Status != models.PurchaseOrderStatusDraft {
+			return invalidPurchaseOrder("only DRAFT purchase orders can be edited")
+		}
+
+		if err := tx.Model(&order).Update("notes", request.Notes).Error; err != nil {
+			return err
+		}
+		return replacePurchaseOrderLines(tx, &order, request.Lines)
+	})
+	if err != nil {
+		return purchaseOrderError(c, err)
+	}
+
+	database.DB.Preload("Supplier").Preload("Lines.Ingredient").First(&order, "id = ?", id)
+
+	return c.JSON(order)
+}
+
+// SubmitPurchaseOrder ส่งใบสั่งซื้อให้ผู้จำหน่าย กำหนดวันที่คาดว่าจะได้รับตามระยะเวลาจัดส่ง
+func SubmitPurchaseOrder(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var order models.PurchaseOrder
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Supplier").Preload("Lines").
+			First(&order, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if order.Status != models.PurchaseOrderStatusDraft {
+			return invalidPurchaseOrder("only DRAFT purchase orders can be submitted")
+		}
+		if len(order.Lines) == 0 {
+			return invalidPurchaseOrder("purchase order has no lines")
+		}
+
+		now := time.Now()
+		expected := now.AddDate(0, 0, order.Supplier.LeadTimeDays)
+		return tx.Model(&order).Updates(map[string]interface{}{
+			"status":        models.PurchaseOrderStatusOrdered,
+			"order_date":    now,
+			"expected_date": expected,
+		}).Error
+	})
+	if err != nil {
+		return purchaseOrderError(c, err)
+	}
+
+	database.DB.Preload("Supplier").Preload("Lines.Ingredient").First(&order, "id = ?", id)
+
+	return c.JSON(order)
+}
+
+// ReceivePurchaseOrder รับของตามใบสั่งซื้อ รับบางส่วนได้ แต่ละรายการบันทึกเป็น StockMovement IN พร้อมราคาซื้อ
+func ReceivePurchaseOrder(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var request struct {
+		Lines []struct {
+			LineID     string     `json:"line_id"`
+			Quantity   float64    `json:"quantity"`
+			UnitPrice  *float64   `json:"unit_price"` // ราคาจริงตามใบส่งของ ถ้าต่างจากใบสั่งซื้อ
+			LotNumber  *string    `json:"lot_number"`
+			ExpiryDate *time.Time `json:"expiry_date"`
+		} `json:"lines"`
+		Reference *string `json:"reference"` // เลขที่ใบส่งของ
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if len(request.Lines) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "lines are required"})
+	}
+
+	var order models.PurchaseOrder
+	var movements []models.StockMovement
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Lines").
+			First(&order, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if order.Status != models.PurchaseOrderStatusOrdered && order.Status != models.PurchaseOrderStatusPartial {
+			return invalidPurchaseOrder("purchase order is not awaiting delivery")
+		}
+
+		lines := make(map[string]*models.PurchaseOrderLine)
+		for i := range order.Lines {
+			lines[order.Lines[i].ID] = &order.Lines[i]
+		}
+
+		ingredientIDs := make([]string, 0, len(request.Lines))
+		for _, received := range request.Lines {
+			if line, ok := lines[received.LineID]; ok {
+				ingredientIDs = append(ingredientIDs, line.IngredientID)
+			}
+		}
+		if err := lockIngredients(tx, ingredientIDs); err != nil {
+			return err
+		}
+
+		for _, received := range request.Lines {
+			line, ok := lines[received.LineID]
+			if !ok {
+				return invalidPurchaseOrder("line %s not found in purchase order", received.LineID)
+			}
+			if received.Quantity <= 0 {
+				return invalidPurchaseOrder("received quantity must be positive")
+			}
+			if line.ReceivedQuantity+received.Quantity > line.Quantity {
+				return invalidPurchaseOrder("received quantity exceeds ordered quantity for line %s", line.ID)
+			}
+
+			unitPrice := line.UnitPrice
+			if received.UnitPrice != nil {
+				unitPrice = *received.UnitPrice
+			}
+
+			ingredient, err := lockIngredient(tx, line.IngredientID)
+			if err != nil {
+				return err
+			}
+
+			// รับเข้าสต๊อกเป็นหน่วยสต๊อก ราคาซื้อแปลงเป็นต่อหน่วยสต๊อก
+			factor, err := unitFactor(tx, ingredient, line.Unit)
+			if err != nil {
+				return err
+			}
+			stockUnitCost := roundCost(unitPrice / factor)
+
+			reason := fmt.Sprintf("รับของตามใบสั่งซื้อ %s", order.PONumber)
+			if request.Reference != nil {
+				reason += fmt.Sprintf(" (ใบส่งของ %s)", *request.Reference)
+			}
+
+			movement, err := receiveStock(tx, ingredient, models.StockMovementTypeIn, stockEntry{
+				Quantity:   received.Quantity * factor,
+				UnitCost:   &stockUnitCost,
+				Reason:     &reason,
+				Reference:  &order.ID,
+				LotNumber:  received.LotNumber,
+				ExpiryDate: received.ExpiryDate,
+			})
+			if err != nil {
+				return err
+			}
+			movements = append(movements, *movement)
+
+			line.ReceivedQuantity += received.Quantity
+			err = tx.Model(&models.PurchaseOrderLine{}).Where("id = ?", line.ID).
+				Update("received_quantity", gorm.Expr("received_quantity + ?", received.Quantity)).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		complete := true
+		for _, line := range order.Lines {
+			if line.ReceivedQuantity < line.Quantity {
+				complete = false
+				break
+			}
+		}
+
+		updates := map[string]interface{}{"status": models.PurchaseOrderStatusPartial}
+		if complete {
+			updates["status"] = models.PurchaseOrderStatusReceived
+			updates["received_date"] = time.Now()
+		}
+		return tx.Model(&order).Updates(updates).Error
+	})
+	if err != nil {
+		return purchaseOrderError(c, err)
+	}
+
+	scheduleMenuRefresh()
+
+	database.DB.Preload("Supplier").Preload("Lines.Ingredient").First(&order, "id = ?", id)
+
+	return c.JSON(fiber.Map{
+		"purchase_order": order,
+		"movements":      movements,
+	})
+}
+
+// CancelPurchaseOrder ยกเลิกใบสั่งซื้อ ถ้ารับของไปบางส่วนแล้ว ของที่รับยังอยู่ในสต๊อก
+func CancelPurchaseOrder(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	result := database.DB.Model(&models.PurchaseOrder{}).
+		Where("id = ? AND status IN ?", id, []models.PurchaseOrderStatus{
+			models.PurchaseOrderStatusDraft,
+			models.PurchaseOrderStatusOrdered,
+			models.PurchaseOrderStatusPartial,
+		}).
+		Update("status", models.PurchaseOrderStatusCancelled)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	if result.RowsAffected == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Purchase order not found or already closed"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Purchase order cancelled successfully"})
+}
+
+// GetOutstandingPurchaseOrders รายงานใบสั่งซื้อที่ยังรับของไม่ครบ แยกตามผู้จำหน่าย
+func GetOutstandingPurchaseOrders(c *fiber.Ctx) error {
+	var orders []models.PurchaseOrder
+	result := database.DB.Preload("Supplier").Preload("Lines.Ingredient").
+		Where("status IN ?", []models.PurchaseOrderStatus{
+			models.PurchaseOrderStatusOrdered,
+			models.PurchaseOrderStatusPartial,
+		}).
+		Order("expected_date ASC").
+		Find(&orders)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	type outstandingLine struct {
+		LineID         string  `json:"line_id"`
+		IngredientID   string  `json:"ingredient_id"`
+		IngredientName string  `json:"ingredient_name"`
+		Unit           string  `json:"unit"`
+		Ordered        float64 `json:"ordered"`
+		Received       float64 `json:"received"`
+		Outstanding    float64 `json:"outstanding"`
+		Value          float64 `json:"value"`
+	}
+
+	type outstandingOrder struct {
+		PurchaseOrderID  string            `json:"purchase_order_id"`
+		PONumber         string            `json:"po_number"`
+		SupplierID       string            `json:"supplier_id"`
+		SupplierName     string            `json:"supplier_name"`
+		Status           string            `json:"status"`
+		OrderDate        *time.Time        `json:"order_date"`
+		ExpectedDate     *time.Time        `json:"expected_date"`
+		Overdue          bool              `json:"overdue"`
+		OutstandingValue float64           `json:"outstanding_value"`
+		Lines            []outstandingLine `json:"lines"`
+	}
+
+	now := time.Now()
+	report := make([]outstandingOrder, 0, len(orders))
+	bySupplier := make(map[string]float64)
+	totalValue := 0.0
+	overdue := 0
+
+	for _, order := range orders {
+		row := outstandingOrder{
+			PurchaseOrderID: order.ID,
+			PONumber:        order.PONumber,
+			SupplierID:      order.SupplierID,
+			SupplierName:    order.Supplier.Name,
+			Status:          string(order.Status),
+			OrderDate:       order.OrderDate,
+			ExpectedDate:    order.ExpectedDate,
+			Overdue:         order.ExpectedDate != nil && order.ExpectedDate.Before(now),
+		}
+
+		for _, line := range order.Lines {
+			remaining := line.Quantity - line.ReceivedQuantity
+			if remaining <= 0 {
+				continue
+			}
+
+			value := roundBaht(remaining * line.UnitPrice)
+			row.Lines = append(row.Lines, outstandingLine{
+				LineID:         line.ID,
+				IngredientID:   line.IngredientID,
+				IngredientName: line.Ingredient.Name,
+				Unit:           unitName(&line.Ingredient, line.Unit),
+				Ordered:        line.Quantity,
+				Received:       line.ReceivedQuantity,
+				Outstanding:    remaining,
+				Value:          value,
+			})
+			row.OutstandingValue += value
+		}
+
+		if row.Overdue {
+			overdue++
+		}
+		bySupplier[order.Supplier.Name] += row.OutstandingValue
+		totalValue += row.OutstandingValue
+		report = append(report, row)
+	}
+
+	return c.JSON(fiber.Map{
+		"orders":            report,
+		"overdue_orders":    overdue,
+		"outstanding_value": roundBaht(totalValue),
+		"by_supplier":       bySupplier,
+	})
+}
+
+// replacePurchaseOrderLines แทนที่รายการในใบสั่งซื้อ และคำนวณยอดรวมใหม่
+func replacePurchaseOrderLines(tx *gorm.DB, order *models.PurchaseOrder, inputs []purchaseOrderLineInput) error {
+	if err := tx.Where("purchase_order_id = ?", order.ID).Delete(&models.PurchaseOrderLine{}).Error; err != nil {
+		return err
+	}
+
+	total := 0.0
+	for _, input := range inputs {
+		if input.Quantity <= 0 {
+			return invalidPurchaseOrder("line quantity must be positive")
+		}
+
+		var ingredient models.Ingredient
+		if err := tx.First(&ingredient, "id = ?", input.IngredientID).Error; err != nil {
+			return invalidPurchaseOrder("ingredient %s not found", input.IngredientID)
+		}
+
+		unit := input.Unit
+		if unit == nil {
+			unit = ingredient.PurchaseUnit
+		}
+		factor, err := unitFactor(tx, &ingredient, unit)
+		if err != nil {
+			return err
+		}
+
+		// ราคาจากรายการราคาของผู้จำหน่าย ถ้าไม่มีใช้ต้นทุนปัจจุบันของวัตถุดิบ แปลงเป็นราคาต่อหน่วยของรายการ
+		unitPrice := ingredient.CostPerUnit * factor
+		if input.UnitPrice != nil {
+			unitPrice = *input.UnitPrice
+		} else if price, err := activeSupplierPrice(tx, order.SupplierID, ingredient.ID); err == nil {
+			priceFactor, err := unitFactor(tx, &ingredient, price.Unit)
+			if err != nil {
+				return err
+			}
+			unitPrice = roundCost(price.UnitPrice / priceFactor * factor)
+		}
+
+		line := models.PurchaseOrderLine{
+			PurchaseOrderID: order.ID,
+			IngredientID:    ingredient.ID,
+			Unit:            normalizeUnit(&ingredient, unit),
+			Quantity:        input.Quantity,
+			UnitPrice:       unitPrice,
+			Subtotal:        roundBaht(input.Quantity * unitPrice),
+		}
+		if err := tx.Create(&line).Error; err != nil {
+			return err
+		}
+		total += line.Subtotal
+	}
+
+	return tx.Model(order).Update("total_amount", roundBaht(total)).Error
+}
+
+// purchaseOrderInvalid ข้อผิดพลาดจากข้อมูลที่ส่งมาหรือสถานะของใบสั่งซื้อ ตอบกลับเป็น 400
+type purchaseOrderInvalid string
+
+func (e purchaseOrderInvalid) Error() string {
+	return string(e)
+}
+
+func invalidPurchaseOrder(format string, args ...interface{}) error {
+	return purchaseOrderInvalid(fmt.Sprintf(format, args...))
+}
+
+// purchaseOrderError แปลงข้อผิดพลาดเป็น HTTP response
+// ข้อมูลไม่ถูกต้องตอบ 400 ส่วนข้อผิดพลาดจากฐานข้อมูลตอบ 500
+func purchaseOrderError(c *fiber.Ctx, err error) error {
+	var invalid purchaseOrderInvalid
+	switch {
+	case err == gorm.ErrRecordNotFound:
+		return c.Status(404).JSON(fiber.Map{"error": "Purchase order not found"})
+	case errors.As(err, &invalid), errors.Is(err, errUnitConversion):
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"math"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// costDivergenceThreshold สัดส่วนส่วนต่างระหว่างต้นทุนตามสูตรกับต้นทุนที่ตั้งไว้ที่ถือว่าผิดปกติ
+const costDivergenceThreshold = 0.10
+
+// theoreticalCost เปรียบเทียบต้นทุนวัตถุดิบตามสูตรกับต้นทุนที่กรอกเอง
+type theoreticalCost struct {
+	ProductID       string   `json:"product_id"`
+	ProductName     string   `json:"product_name"`
+	Price           float64  `json:"price"`
+	RecipeCost      *float64 `json:"recipe_cost"`       // ต้นทุนวัตถุดิบตามสูตร
+	ManualRawCost   *float64 `json:"manual_raw_cost"`   // ต้นทุนวัตถุดิบที่กรอกไว้
+	ManualTotalCost float64  `json:"manual_total_cost"` // ต้นทุนรวมที่กรอกไว้
+	Difference      *float64 `json:"difference"`        // ต้นทุนตามสูตร - ต้นทุนที่กรอกไว้
+	DifferencePct   *float64 `json:"difference_pct"`
+	Warning         *string  `json:"warning"`
+}
+
+// GetTheoreticalCosts แสดงต้นทุนตามสูตรเทียบกับต้นทุนที่กรอกเองของทุกสินค้า
+func GetTheoreticalCosts(c *fiber.Ctx) error {
+	threshold := c.QueryFloat("threshold", costDivergenceThreshold*100) / 100
+
+	var products []models.Product
+	if err := database.DB.Order("name ASC").Find(&products).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var activeCosts []models.ProductCost
+	database.DB.Where("is_active = ?", true).Find(&activeCosts)
+
+	costByProduct := make(map[string]models.ProductCost)
+	for _, cost := range activeCosts {
+		costByProduct[cost.ProductID] = cost
+	}
+
+	results := make([]theoreticalCost, 0, len(products))
+	divergent := 0
+
+	for _, product := range products {
+		row := theoreticalCost{
+			ProductID:       product.ID,
+			ProductName:     product.Name,
+			Price:           product.Price,
+			RecipeCost:      product.RecipeCost,
+			ManualTotalCost: product.Cost,
+		}
+
+		// เทียบกับต้นทุนวัตถุดิบที่กรอกไว้ ถ้าไม่ได้แยกไว้ให้เทียบกับต้นทุนรวม
+		manual := product.Cost
+		if cost, ok := costByProduct[product.ID]; ok && cost.RawMaterialCost != nil {
+			row.ManualRawCost = cost.RawMaterialCost
+			manual = *cost.RawMaterialCost
+		}
+
+		if product.RecipeCost == nil {
+			warning := "ไม่มีสูตร ไม่สามารถคำนวณต้นทุนวัตถุดิบได้"
+			row.Warning = &warning
+		} else {
+			diff := roundCost(*product.RecipeCost - manual)
+			row.Difference = &diff
+
+			if manual > 0 {
+				pct := roundCost(diff / manual * 100)
+				row.DifferencePct = &pct
+			}
+
+			if manual <= 0 || math.Abs(diff) > manual*threshold {
+				warning := "ต้นทุนตามสูตรต่างจากต้นทุนที่ตั้งไว้"
+				row.Warning = &warning
+				divergent++
+			}
+		}
+
+		results = append(results, row)
+	}
+
+	return c.JSON(fiber.Map{
+		"threshold_pct": threshold * 100,
+		"divergent":     divergent,
+		"products":      results,
+	})
+}
+
+// ApplyRecipeCost ใช้ต้นทุนตามสูตรเป็นต้นทุนวัตถุดิบ โดยคงค่าแรงและค่าใช้จ่ายทั่วไปเดิมไว้
+func ApplyRecipeCost(c *fiber.Ctx) error {
+	productID := c.Params("product_id")
+
+	tx := database.DB.Begin()
+
+	if err := recomputeProductRecipeCost(tx, productID); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var product models.Product
+	if err := tx.First(&product, "id = ?", productID).Error; err != nil {
+		tx.Rollback()
+		return c.Status(404).JSON(fiber.Map{"error": "Product not found"})
+	}
+
+	if product.RecipeCost == nil {
+		tx.Rollback()
+		return c.Status(400).JSON(fiber.Map{"error": "Product has no recipe"})
+	}
+
+	var current models.ProductCost
+	tx.Where("product_id = ? AND is_active = ?", productID, true).First(&current)
+
+	labor, overhead := 0.0, 0.0
+	if current.LaborCost != nil {
+		labor = *current.LaborCost
+	}
+	if current.OverheadCost != nil {
+		overhead = *current.OverheadCost
+	}
+
+	raw := *product.RecipeCost
+	notes := "ต้นทุนวัตถุดิบตามสูตร"
+	newCost := models.ProductCost{
+		ProductID:       productID,
+		CostPerUnit:     roundCost(raw + labor + overhead),
+		RawMaterialCost: &raw,
+		LaborCost:       current.LaborCost,
+		OverheadCost:    current.OverheadCost,
+		Notes:           &notes,
+		EffectiveDate:   time.Now(),
+		IsActive:        true,
+	}
+
+	if err := saveProductCost(tx, &newCost); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(newCost)
+}
+
+// RecomputeRecipeCosts คำนวณต้นทุนตามสูตรของทุกสินค้าใหม่
+func RecomputeRecipeCosts(c *fiber.Ctx) error {
+	var productIDs []string
+	if err := database.DB.Model(&models.Product{}).Pluck("id", &productIDs).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		for _, productID := range productIDs {
+			if err := recomputeProductRecipeCost(tx, productID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"recomputed": len(productIDs)})
+}
+
+// saveProductCost ปิดต้นทุนเดิม บันทึกต้นทุนใหม่ และอัปเดตต้นทุนในตาราง Product
+func saveProductCost(tx *gorm.DB, cost *models.ProductCost) error {
+	err := tx.Model(&models.ProductCost{}).
+		Where("product_id = ? AND is_active = ?", cost.ProductID, true).
+		Update("is_active", false).Error
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Create(cost).Error; err != nil {
+		return err
+	}
+
+	return tx.Model(&models.Product{}).Where("id = ?", cost.ProductID).
+		Update("cost", cost.CostPerUnit).Error
+}
+
+// calculateRecipeCost คำนวณต้นทุนวัตถุดิบตามสูตรของสินค้า คืน nil ถ้าไม่มีสูตร
+func calculateRecipeCost(db *gorm.DB, productID string) (*float64, error) {
+	var recipe models.Recipe
+	err := db.Preload("Ingredients.Ingredient").First(&recipe, "product_id = ?", productID).Error
+	if err == gorm.ErrRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	total := 0.0
+	for _, item := range recipe.Ingredients {
+		quantity, err := toStockQuantity(db, &item.Ingredient, item.Quantity, item.Unit)
+		if err != nil {
+			return nil, err
+		}
+		// วัตถุดิบที่ผลิตเองคิดต้นทุนจากสูตรผลิตลงไปทุกชั้น
+		unitCost, err := ingredientStandardCost(db, &item.Ingredient, map[string]bool{})
+		if err != nil {
+			return nil, err
+		}
+		total += quantity * unitCost
+	}
+	total = roundCost(total)
+
+	return &total, nil
+}
+
+// recomputeProductRecipeCost คำนวณและบันทึกต้นทุนตามสูตรของสินค้าใหม่
+// ต้องเรียกทุกครั้งที่สูตรหรือต้นทุนวัตถุดิบเปลี่ยน
+func recomputeProductRecipeCost(tx *gorm.DB, productID string) error {
+	cost, err := calculateRecipeCost(tx, productID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Model(&models.Product{}).Where("id = ?", productID).Updates(map[string]interface{}{
+		"recipe_cost":            cost,
+		"recipe_cost_updated_at": time.Now(),
+	}).Error
+}
+
+// recomputeRecipeCostsForIngredient คำนวณต้นทุนตามสูตรใหม่ของทุกสินค้าที่ใช้วัตถุดิบนี้
+// รวมสินค้าที่ใช้วัตถุดิบผลิตเองซึ่งมีวัตถุดิบนี้เป็นส่วนผสม
+func recomputeRecipeCostsForIngredient(tx *gorm.DB, ingredientID string) error {
+	prepared, err := preparedIngredientsUsing(tx, ingredientID)
+	if err != nil {
+		return err
+	}
+
+	var productIDs []string
+	err = tx.Model(&models.Recipe{}).
+		Joins("JOIN recipe_ingredients ON recipe_ingredients.recipe_id = recipes.id AND recipe_ingredients.deleted_at IS NULL").
+		Where("recipe_ingredients.ingredient_id IN ?", append(prepared, ingredientID)).
+		Distinct().
+		Pluck("recipes.product_id", &productIDs).Error
+	if err != nil {
+		return err
+	}
+
+	for _, productID := range productIDs {
+		if err := recomputeProductRecipeCost(tx, productID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func roundCost(amount float64) float64 {
+	return math.Round(amount*10000) / 10000
+}
@@ -0,0 +1,647 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errRecipeVersionLocked = errors.New("only draft or scheduled versions can be changed")
+
+// recipeIngredientInput ส่วนผสมหนึ่งรายการในคำขอสร้างหรือแก้สูตร
+type recipeIngredientInput struct {
+	IngredientID string  `json:"ingredient_id"`
+	Quantity     float64 `json:"quantity"`
+	Unit         *string `json:"unit"` // ไม่ระบุ = หน่วยในสูตรของวัตถุดิบ
+}
+
+// recipeVersionInput เนื้อหาของสูตรหนึ่งเวอร์ชัน
+type recipeVersionInput struct {
+	Instructions *string                 `json:"instructions"`
+	PrepTime     *int                    `json:"prep_time"`
+	Notes        *string                 `json:"notes"`
+	CreatedBy    *string                 `json:"created_by"`
+	Ingredients  []recipeIngredientInput `json:"ingredients"`
+}
+
+// recipeCostLine ต้นทุนของวัตถุดิบหนึ่งรายการในสูตร คิดเป็นหน่วยสต๊อก
+type recipeCostLine struct {
+	IngredientID   string  `json:"ingredient_id"`
+	IngredientName string  `json:"ingredient_name"`
+	Unit           string  `json:"unit"`
+	Quantity       float64 `json:"quantity"`
+	UnitCost       float64 `json:"unit_cost"`
+	Cost           float64 `json:"cost"`
+}
+
+// recipeIngredientChange ส่วนผสมที่ต่างกันระหว่างสองเวอร์ชัน
+type recipeIngredientChange struct {
+	IngredientID   string  `json:"ingredient_id"`
+	IngredientName string  `json:"ingredient_name"`
+	Change         string  `json:"change"` // ADDED, REMOVED, CHANGED
+	Unit           string  `json:"unit"`   // หน่วยสต๊อก
+	FromQuantity   float64 `json:"from_quantity"`
+	ToQuantity     float64 `json:"to_quantity"`
+	QuantityDelta  float64 `json:"quantity_delta"`
+	CostDelta      float64 `json:"cost_delta"`
+}
+
+// recipeVersionDiff เปรียบเทียบสองเวอร์ชันของสูตร ต้นทุนคิดจากต้นทุนวัตถุดิบปัจจุบันทั้งสองฝั่ง
+type recipeVersionDiff struct {
+	From                *models.RecipeVersion    `json:"from"`
+	To                  *models.RecipeVersion    `json:"to"`
+	Changes             []recipeIngredientChange `json:"changes"`
+	InstructionsChanged bool                     `json:"instructions_changed"`
+	PrepTimeChanged     bool                     `json:"prep_time_changed"`
+	FromCost            float64                  `json:"from_cost"`
+	ToCost              float64                  `json:"to_cost"`
+	CostDifference      float64                  `json:"cost_difference"`
+}
+
+// StartRecipeJobs เริ่มงานเบื้องหลังที่เปิดใช้สูตรที่กำหนดวันเริ่มใช้ไว้ ตรวจทุกนาที
+func StartRecipeJobs() {
+	go func() {
+		runRecipeJobs()
+
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			runRecipeJobs()
+		}
+	}()
+}
+
+func runRecipeJobs() {
+	activated, err := activateDueRecipeVersions(database.DB, time.Now())
+	if err != nil {
+		log.Println("Scheduled recipe activation failed:", err)
+	} else if activated > 0 {
+		log.Printf("Activated %d scheduled recipe versions", activated)
+		scheduleMenuRefresh()
+	}
+}
+
+// GetRecipeVersions ดึงทุกเวอร์ชันของสูตร ใหม่สุดก่อน
+func GetRecipeVersions(c *fiber.Ctx) error {
+	recipeID := c.Params("id")
+
+	var recipe models.Recipe
+	if err := database.DB.First(&recipe, "id = ?", recipeID).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Recipe not found"})
+	}
+
+	var versions []models.RecipeVersion
+	result := database.DB.Preload("Ingredients.Ingredient").
+		Where("recipe_id = ?", recipeID).
+		Order("version_number DESC").
+		Find(&versions)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(versions)
+}
+
+// GetRecipeVersion ดึงสูตรเวอร์ชันเดียว
+func GetRecipeVersion(c *fiber.Ctx) error {
+	version, err := loadRecipeVersion(database.DB, c.Params("id"), c.Params("version"))
+	if err != nil {
+		return recipeVersionError(c, err)
+	}
+
+	return c.JSON(version)
+}
+
+// CreateRecipeVersion สร้างสูตรเวอร์ชันใหม่เป็นร่าง ยังไม่มีผลจนกว่าจะเปิดใช้
+func CreateRecipeVersion(c *fiber.Ctx) error {
+	recipeID := c.Params("id")
+
+	var request recipeVersionInput
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	var version *models.RecipeVersion
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var recipe models.Recipe
+		if err := tx.First(&recipe, "id = ?", recipeID).Error; err != nil {
+			return err
+		}
+
+		var err error
+		version, err = createRecipeVersion(tx, recipe.ID, request)
+		return err
+	})
+	if err != nil {
+		return recipeVersionError(c, err)
+	}
+
+	database.DB.Preload("Ingredients.Ingredient").First(version, "id = ?", version.ID)
+
+	return c.Status(201).JSON(version)
+}
+
+// DeleteRecipeVersion ลบร่างหรือเวอร์ชันที่ยังรอวันเริ่มใช้
+func DeleteRecipeVersion(c *fiber.Ctx) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		version, err := loadRecipeVersion(tx, c.Params("id"), c.Params("version"))
+		if err != nil {
+			return err
+		}
+		if !recipeVersionEditable(version) {
+			return errRecipeVersionLocked
+		}
+
+		if err := tx.Where("recipe_version_id = ?", version.ID).Delete(&models.RecipeVersionIngredient{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.RecipeVersion{}, "id = ?", version.ID).Error
+	})
+	if err != nil {
+		return recipeVersionError(c, err)
+	}
+
+	return c.JSON(fiber.Map{"message": "Recipe version deleted successfully"})
+}
+
+// ActivateRecipeVersion เปิดใช้สูตรเวอร์ชันหนึ่ง ถ้าระบุ effective_from ในอนาคตจะรอเปิดใช้เมื่อถึงเวลา
+func ActivateRecipeVersion(c *fiber.Ctx) error {
+	var request struct {
+		EffectiveFrom *time.Time `json:"effective_from"` // ไม่ระบุหรือเป็นอดีต = เปิดใช้ทันที
+	}
+
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&request); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+		}
+	}
+
+	var version *models.RecipeVersion
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var recipe models.Recipe
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&recipe, "id = ?", c.Params("id")).Error
+		if err != nil {
+			return err
+		}
+
+		version, err = loadRecipeVersion(tx, recipe.ID, c.Params("version"))
+		if err != nil {
+			return err
+		}
+		if !recipeVersionEditable(version) {
+			return errRecipeVersionLocked
+		}
+
+		// ย้อนวันเริ่มใช้ไม่ได้ เพราะออเดอร์ที่ขายไปแล้วตัดสต๊อกด้วยสูตรเดิม
+		now := time.Now()
+		if request.EffectiveFrom != nil && request.EffectiveFrom.After(now) {
+			return tx.Model(&models.RecipeVersion{}).Where("id = ?", version.ID).Updates(map[string]interface{}{
+				"status":         models.RecipeVersionStatusScheduled,
+				"effective_from": *request.EffectiveFrom,
+			}).Error
+		}
+
+		return activateRecipeVersion(tx, &recipe, version, now)
+	})
+	if err != nil {
+		return recipeVersionError(c, err)
+	}
+
+	scheduleMenuRefresh()
+
+	database.DB.Preload("Ingredients.Ingredient").First(version, "id = ?", version.ID)
+
+	return c.JSON(version)
+}
+
+// GetRecipeVersionDiff เปรียบเทียบสองเวอร์ชัน ค่าเริ่มต้นเทียบเวอร์ชันที่ใช้อยู่กับเวอร์ชันล่าสุด
+func GetRecipeVersionDiff(c *fiber.Ctx) error {
+	var recipe models.Recipe
+	if err := database.DB.First(&recipe, "id = ?", c.Params("id")).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Recipe not found"})
+	}
+
+	to, err := resolveRecipeVersion(database.DB, &recipe, c.Query("to"), true)
+	if err != nil {
+		return recipeVersionError(c, err)
+	}
+	from, err := resolveRecipeVersion(database.DB, &recipe, c.Query("from"), false)
+	if err != nil {
+		return recipeVersionError(c, err)
+	}
+
+	diff, err := diffRecipeVersions(database.DB, from, to)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(diff)
+}
+
+// PreviewRecipeVersionCost ประเมินผลต่อต้นทุนและกำไรก่อนเปิดใช้เวอร์ชันใหม่
+// เทียบกับเวอร์ชันที่ใช้อยู่ และคาดการณ์ผลกระทบจากยอดขายย้อนหลัง N วัน
+func PreviewRecipeVersionCost(c *fiber.Ctx) error {
+	days := c.QueryInt("days", 30)
+	if days <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "days must be positive"})
+	}
+
+	var recipe models.Recipe
+	if err := database.DB.Preload("Product").First(&recipe, "id = ?", c.Params("id")).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Recipe not found"})
+	}
+
+	version, err := loadRecipeVersion(database.DB, recipe.ID, c.Params("version"))
+	if err != nil {
+		return recipeVersionError(c, err)
+	}
+	active, err := resolveRecipeVersion(database.DB, &recipe, "", false)
+	if err != nil {
+		return recipeVersionError(c, err)
+	}
+
+	diff, err := diffRecipeVersions(database.DB, active, version)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var sold float64
+	result := database.DB.Raw(`
+		SELECT COALESCE(SUM(oi.quantity), 0)
+		FROM order_items oi
+		JOIN orders o ON o.id = oi.order_id AND o.deleted_at IS NULL
+		WHERE oi.product_id = ? AND o.status <> ? AND o.created_at >= ? AND oi.deleted_at IS NULL
+	`, recipe.ProductID, models.OrderStatusCancelled, time.Now().AddDate(0, 0, -days)).Scan(&sold)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	price := recipe.Product.Price
+	margin := func(cost float64) *float64 {
+		if price <= 0 {
+			return nil
+		}
+		pct := math.Round((price-cost)/price*10000) / 100
+		return &pct
+	}
+
+	var differencePct *float64
+	if diff.FromCost > 0 {
+		pct := math.Round(diff.CostDifference/diff.FromCost*10000) / 100
+		differencePct = &pct
+	}
+
+	return c.JSON(fiber.Map{
+		"product_id":         recipe.ProductID,
+		"product_name":       recipe.Product.Name,
+		"price":              price,
+		"current_cost":       diff.FromCost,
+		"new_cost":           diff.ToCost,
+		"cost_difference":    diff.CostDifference,
+		"difference_pct":     differencePct,
+		"current_margin_pct": margin(diff.FromCost),
+		"new_margin_pct":     margin(diff.ToCost),
+		"days":               days,
+		"sold_quantity":      sold,
+		"projected_impact":   roundBaht(diff.CostDifference * sold), // ต้นทุนที่เพิ่มขึ้น (ลดลงถ้าติดลบ) ถ้ายอดขายเท่าช่วงที่ผ่านมา
+		"diff":               diff,
+	})
+}
+
+// createRecipeVersion สร้างเวอร์ชันร่างถัดไปของสูตร ส่วนผสมที่ปริมาณไม่เกิน 0 จะถูกข้าม
+func createRecipeVersion(tx *gorm.DB, recipeID string, input recipeVersionInput) (*models.RecipeVersion, error) {
+	// นับรวมเวอร์ชันที่ลบไปแล้ว เลขเวอร์ชันจะไม่ถูกใช้ซ้ำ
+	var last int
+	err := tx.Unscoped().Model(&models.RecipeVersion{}).
+		Where("recipe_id = ?", recipeID).
+		Select("COALESCE(MAX(version_number), 0)").
+		Scan(&last).Error
+	if err != nil {
+		return nil, err
+	}
+
+	version := models.RecipeVersion{
+		RecipeID:      recipeID,
+		VersionNumber: last + 1,
+		Status:        models.RecipeVersionStatusDraft,
+		Instructions:  input.Instructions,
+		PrepTime:      input.PrepTime,
+		Notes:         input.Notes,
+		CreatedBy:     input.CreatedBy,
+	}
+	if err := tx.Create(&version).Error; err != nil {
+		return nil, err
+	}
+
+	for _, ing := range input.Ingredients {
+		if ing.Quantity <= 0 {
+			continue
+		}
+
+		unit, err := recipeIngredientUnit(tx, ing.IngredientID, ing.Unit)
+		if err != nil {
+			return nil, err
+		}
+
+		item := models.RecipeVersionIngredient{
+			RecipeVersionID: version.ID,
+			IngredientID:    ing.IngredientID,
+			Quantity:        ing.Quantity,
+			Unit:            unit,
+		}
+		if err := tx.Create(&item).Error; err != nil {
+			return nil, err
+		}
+		version.Ingredients = append(version.Ingredients, item)
+	}
+
+	return &version, nil
+}
+
+// activateRecipeVersion เปิดใช้เวอร์ชัน เลิกใช้เวอร์ชันเดิม และคัดลอกส่วนผสมไปเป็นสูตรที่ใช้ตัดสต๊อก
+// version ต้องโหลด Ingredients มาแล้ว
+func activateRecipeVersion(tx *gorm.DB, recipe *models.Recipe, version *models.RecipeVersion, at time.Time) error {
+	err := tx.Model(&models.RecipeVersion{}).
+		Where("recipe_id = ? AND status = ? AND id <> ?", recipe.ID, models.RecipeVersionStatusActive, version.ID).
+		Updates(map[string]interface{}{
+			"status":       models.RecipeVersionStatusRetired,
+			"effective_to": at,
+		}).Error
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Where("recipe_id = ?", recipe.ID).Delete(&models.RecipeIngredient{}).Error; err != nil {
+		return err
+	}
+	for _, item := range version.Ingredients {
+		err := tx.Create(&models.RecipeIngredient{
+			RecipeID:     recipe.ID,
+			IngredientID: item.IngredientID,
+			Quantity:     item.Quantity,
+			Unit:         item.Unit,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	recipe.Instructions = version.Instructions
+	recipe.PrepTime = version.PrepTime
+	recipe.ActiveVersionID = &version.ID
+	err = tx.Model(&models.Recipe{}).Where("id = ?", recipe.ID).Updates(map[string]interface{}{
+		"instructions":      recipe.Instructions,
+		"prep_time":         recipe.PrepTime,
+		"active_version_id": recipe.ActiveVersionID,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	if err := recomputeProductRecipeCost(tx, recipe.ProductID); err != nil {
+		return err
+	}
+
+	var product models.Product
+	if err := tx.Select("recipe_cost").First(&product, "id = ?", recipe.ProductID).Error; err != nil {
+		return err
+	}
+
+	version.Status = models.RecipeVersionStatusActive
+	version.EffectiveFrom = &at
+	version.EffectiveTo = nil
+	version.RecipeCost = product.RecipeCost
+	return tx.Model(&models.RecipeVersion{}).Where("id = ?", version.ID).Updates(map[string]interface{}{
+		"status":         version.Status,
+		"effective_from": version.EffectiveFrom,
+		"effective_to":   nil,
+		"recipe_cost":    version.RecipeCost,
+	}).Error
+}
+
+// activateDueRecipeVersions เปิดใช้เวอร์ชันที่ถึงวันเริ่มใช้แล้ว เรียงตามวันเริ่มใช้ เวอร์ชันละหนึ่ง transaction
+func activateDueRecipeVersions(db *gorm.DB, now time.Time) (int, error) {
+	var due []models.RecipeVersion
+	err := db.Where("status = ? AND effective_from <= ?", models.RecipeVersionStatusScheduled, now).
+		Order("effective_from ASC").
+		Find(&due).Error
+	if err != nil {
+		return 0, err
+	}
+
+	activated := 0
+	for _, candidate := range due {
+		done := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			var recipe models.Recipe
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&recipe, "id = ?", candidate.RecipeID).Error
+			if err != nil {
+				return err
+			}
+
+			// อ่านใหม่หลังล็อกสูตร อาจถูกเปิดใช้หรือลบไปแล้วระหว่างนี้
+			var version models.RecipeVersion
+			if err := tx.Preload("Ingredients").First(&version, "id = ?", candidate.ID).Error; err != nil {
+				return err
+			}
+			if version.Status != models.RecipeVersionStatusScheduled {
+				return nil
+			}
+
+			done = true
+			return activateRecipeVersion(tx, &recipe, &version, *version.EffectiveFrom)
+		})
+		if err != nil {
+			return activated, err
+		}
+		if done {
+			activated++
+		}
+	}
+
+	return activated, nil
+}
+
+// diffRecipeVersions เทียบส่วนผสมของสองเวอร์ชันเป็นหน่วยสต๊อก from เป็น nil ได้ (สูตรใหม่)
+func diffRecipeVersions(db *gorm.DB, from, to *models.RecipeVersion) (*recipeVersionDiff, error) {
+	diff := &recipeVersionDiff{From: from, To: to, Changes: []recipeIngredientChange{}}
+
+	toLines, toCost, err := recipeVersionCost(db, to)
+	if err != nil {
+		return nil, err
+	}
+	diff.ToCost = toCost
+
+	var fromLines []recipeCostLine
+	if from != nil {
+		fromLines, diff.FromCost, err = recipeVersionCost(db, from)
+		if err != nil {
+			return nil, err
+		}
+		diff.InstructionsChanged = !equalStringPtr(from.Instructions, to.Instructions)
+		diff.PrepTimeChanged = !equalIntPtr(from.PrepTime, to.PrepTime)
+	}
+	diff.CostDifference = roundCost(diff.ToCost - diff.FromCost)
+
+	fromByIngredient := make(map[string]recipeCostLine)
+	for _, line := range fromLines {
+		fromByIngredient[line.IngredientID] = line
+	}
+	toByIngredient := make(map[string]recipeCostLine)
+	for _, line := range toLines {
+		toByIngredient[line.IngredientID] = line
+	}
+
+	for _, line := range fromLines {
+		if _, ok := toByIngredient[line.IngredientID]; !ok {
+			diff.Changes = append(diff.Changes, recipeIngredientChange{
+				IngredientID:   line.IngredientID,
+				IngredientName: line.IngredientName,
+				Change:         "REMOVED",
+				Unit:           line.Unit,
+				FromQuantity:   line.Quantity,
+				QuantityDelta:  -line.Quantity,
+				CostDelta:      -line.Cost,
+			})
+		}
+	}
+
+	for _, line := range toLines {
+		previous, ok := fromByIngredient[line.IngredientID]
+		if !ok {
+			diff.Changes = append(diff.Changes, recipeIngredientChange{
+				IngredientID:   line.IngredientID,
+				IngredientName: line.IngredientName,
+				Change:         "ADDED",
+				Unit:           line.Unit,
+				ToQuantity:     line.Quantity,
+				QuantityDelta:  line.Quantity,
+				CostDelta:      line.Cost,
+			})
+			continue
+		}
+
+		// เปลี่ยนแค่หน่วยที่เขียนในสูตรแต่ปริมาณเท่าเดิม ไม่นับว่าเปลี่ยน
+		if roundCost(line.Quantity-previous.Quantity) == 0 {
+			continue
+		}
+		diff.Changes = append(diff.Changes, recipeIngredientChange{
+			IngredientID:   line.IngredientID,
+			IngredientName: line.IngredientName,
+			Change:         "CHANGED",
+			Unit:           line.Unit,
+			FromQuantity:   previous.Quantity,
+			ToQuantity:     line.Quantity,
+			QuantityDelta:  roundCost(line.Quantity - previous.Quantity),
+			CostDelta:      roundCost(line.Cost - previous.Cost),
+		})
+	}
+
+	return diff, nil
+}
+
+// recipeVersionCost ต้นทุนตามสูตรของเวอร์ชันจากต้นทุนวัตถุดิบปัจจุบัน รวมวัตถุดิบที่ซ้ำกันเป็นบรรทัดเดียว
+func recipeVersionCost(db *gorm.DB, version *models.RecipeVersion) ([]recipeCostLine, float64, error) {
+	var lines []recipeCostLine
+	index := make(map[string]int)
+	total := 0.0
+
+	for _, item := range version.Ingredients {
+		quantity, err := toStockQuantity(db, &item.Ingredient, item.Quantity, item.Unit)
+		if err != nil {
+			return nil, 0, err
+		}
+		unitCost, err := ingredientStandardCost(db, &item.Ingredient, map[string]bool{})
+		if err != nil {
+			return nil, 0, err
+		}
+		cost := quantity * unitCost
+		total += cost
+
+		if i, ok := index[item.IngredientID]; ok {
+			lines[i].Quantity = roundCost(lines[i].Quantity + quantity)
+			lines[i].Cost = roundCost(lines[i].Cost + cost)
+			continue
+		}
+		index[item.IngredientID] = len(lines)
+		lines = append(lines, recipeCostLine{
+			IngredientID:   item.IngredientID,
+			IngredientName: item.Ingredient.Name,
+			Unit:           item.Ingredient.Unit,
+			Quantity:       roundCost(quantity),
+			UnitCost:       roundCost(unitCost),
+			Cost:           roundCost(cost),
+		})
+	}
+
+	return lines, roundCost(total), nil
+}
+
+// loadRecipeVersion ดึงเวอร์ชันตามเลขเวอร์ชันพร้อมส่วนผสม
+func loadRecipeVersion(db *gorm.DB, recipeID string, number string) (*models.RecipeVersion, error) {
+	var version models.RecipeVersion
+	err := db.Preload("Ingredients.Ingredient").
+		Where("recipe_id = ? AND version_number = ?", recipeID, number).
+		First(&version).Error
+	if err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+// resolveRecipeVersion ดึงเวอร์ชันตามเลขที่ระบุ ถ้าไม่ระบุใช้เวอร์ชันล่าสุด (latest) หรือเวอร์ชันที่ใช้อยู่
+// คืน nil ถ้าสูตรยังไม่มีเวอร์ชันที่ใช้อยู่
+func resolveRecipeVersion(db *gorm.DB, recipe *models.Recipe, number string, latest bool) (*models.RecipeVersion, error) {
+	if number != "" {
+		return loadRecipeVersion(db, recipe.ID, number)
+	}
+
+	query := db.Preload("Ingredients.Ingredient")
+	if latest {
+		query = query.Where("recipe_id = ?", recipe.ID).Order("version_number DESC")
+	} else if recipe.ActiveVersionID != nil {
+		query = query.Where("id = ?", *recipe.ActiveVersionID)
+	} else {
+		return nil, nil
+	}
+
+	var version models.RecipeVersion
+	if err := query.First(&version).Error; err != nil {
+		return nil, err
+	}
+	return &version, nil
+}
+
+func recipeVersionEditable(version *models.RecipeVersion) bool {
+	return version.Status == models.RecipeVersionStatusDraft || version.Status == models.RecipeVersionStatusScheduled
+}
+
+func equalStringPtr(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func equalIntPtr(a, b *int) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// recipeVersionError แปลงข้อผิดพลาดเป็น HTTP response
+func recipeVersionError(c *fiber.Ctx, err error) error {
+	if err == gorm.ErrRecordNotFound {
+		return c.Status(404).JSON(fiber.Map{"error": "Recipe or version not found"})
+	}
+	return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+}
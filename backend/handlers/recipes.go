@@ -3,7 +3,10 @@ package handlers
 import (
 	"coffee-pula-backend/database"
 	"coffee-pula-backend/models"
+	"time"
+
 	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm/clause"
 )
 
 // GetRecipes - ดึงข้อมูลสูตรทั้งหมด
@@ -20,16 +23,11 @@ func GetRecipes(c *fiber.Ctx) error {
 	return c.JSON(recipes)
 }
 
-// CreateRecipe - สร้างสูตรใหม่
+// CreateRecipe - สร้างสูตรใหม่ (เป็นเวอร์ชัน 1 และเปิดใช้ทันที)
 func CreateRecipe(c *fiber.Ctx) error {
 	var request struct {
-		ProductID    string `json:"product_id"`
-		Instructions *string `json:"instructions"`
-		PrepTime     *int    `json:"prep_time"`
-		Ingredients  []struct {
-			IngredientID string  `json:"ingredient_id"`
-			Quantity     float64 `json:"quantity"`
-		} `json:"ingredients"`
+		ProductID string `json:"product_id"`
+		recipeVersionInput
 	}
 	
 	if err := c.BodyParser(&request); err != nil {
@@ -55,45 +53,39 @@ func CreateRecipe(c *fiber.Ctx) error {
 		})
 	}
 	
-	// Create recipe ingredients
-	for _, ing := range request.Ingredients {
-		if ing.Quantity > 0 {
-			recipeIngredient := models.RecipeIngredient{
-				RecipeID:     recipe.ID,
-				IngredientID: ing.IngredientID,
-				Quantity:     ing.Quantity,
-			}
-			
-			if err := tx.Create(&recipeIngredient).Error; err != nil {
-				tx.Rollback()
-				return c.Status(500).JSON(fiber.Map{
-					"error": "Failed to create recipe ingredient",
-				})
-			}
-		}
+	// Create first version
+	version, err := createRecipeVersion(tx, recipe.ID, request.recipeVersionInput)
+	if err != nil {
+		tx.Rollback()
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	
+	// เปิดใช้เวอร์ชันแรก คัดลอกส่วนผสมและคำนวณต้นทุนตามสูตร
+	if err := activateRecipeVersion(tx, &recipe, version, time.Now()); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to activate recipe",
+		})
 	}
 	
 	// Commit transaction
 	tx.Commit()
 	
+	scheduleMenuRefresh()
+	
 	// Return recipe with full data
 	database.DB.Preload("Product").Preload("Ingredients.Ingredient").First(&recipe, "id = ?", recipe.ID)
 	
 	return c.Status(201).JSON(recipe)
 }
 
-// UpdateRecipe - แก้ไขสูตร
+// UpdateRecipe - แก้ไขสูตร (สร้างเวอร์ชันใหม่และเปิดใช้ทันที เวอร์ชันเดิมเก็บไว้เป็นประวัติ)
 func UpdateRecipe(c *fiber.Ctx) error {
 	recipeID := c.Params("id")
 	
-	var request struct {
-		Instructions *string `json:"instructions"`
-		PrepTime     *int    `json:"prep_time"`
-		Ingredients  []struct {
-			IngredientID string  `json:"ingredient_id"`
-			Quantity     float64 `json:"quantity"`
-		} `json:"ingredients"`
-	}
+	var request recipeVersionInput
 	
 	if err := c.BodyParser(&request); err != nil {
 		return c.Status(400).JSON(fiber.Map{
@@ -104,54 +96,36 @@ func UpdateRecipe(c *fiber.Ctx) error {
 	// Start transaction
 	tx := database.DB.Begin()
 	
-	// Update recipe basic info
 	var recipe models.Recipe
-	if err := tx.First(&recipe, "id = ?", recipeID).Error; err != nil {
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&recipe, "id = ?", recipeID).Error; err != nil {
 		tx.Rollback()
 		return c.Status(404).JSON(fiber.Map{
 			"error": "Recipe not found",
 		})
 	}
 	
-	recipe.Instructions = request.Instructions
-	recipe.PrepTime = request.PrepTime
-	
-	if err := tx.Save(&recipe).Error; err != nil {
+	// Create new version
+	version, err := createRecipeVersion(tx, recipe.ID, request)
+	if err != nil {
 		tx.Rollback()
-		return c.Status(500).JSON(fiber.Map{
-			"error": "Failed to update recipe",
+		return c.Status(400).JSON(fiber.Map{
+			"error": err.Error(),
 		})
 	}
 	
-	// Delete existing recipe ingredients
-	if err := tx.Where("recipe_id = ?", recipeID).Delete(&models.RecipeIngredient{}).Error; err != nil {
+	// เปิดใช้เวอร์ชันใหม่ เวอร์ชันเดิมถูกเลิกใช้ และคำนวณต้นทุนตามสูตรใหม่
+	if err := activateRecipeVersion(tx, &recipe, version, time.Now()); err != nil {
 		tx.Rollback()
 		return c.Status(500).JSON(fiber.Map{
-			"error": "Failed to delete old ingredients",
+			"error": "Failed to activate recipe",
 		})
 	}
 	
-	// Create new recipe ingredients
-	for _, ing := range request.Ingredients {
-		if ing.Quantity > 0 {
-			recipeIngredient := models.RecipeIngredient{
-				RecipeID:     recipeID,
-				IngredientID: ing.IngredientID,
-				Quantity:     ing.Quantity,
-			}
-			
-			if err := tx.Create(&recipeIngredient).Error; err != nil {
-				tx.Rollback()
-				return c.Status(500).JSON(fiber.Map{
-					"error": "Failed to create recipe ingredient",
-				})
-			}
-		}
-	}
-	
 	// Commit transaction
 	tx.Commit()
 	
+	scheduleMenuRefresh()
+	
 	// Return updated recipe with full data
 	database.DB.Preload("Product").Preload("Ingredients.Ingredient").First(&recipe, "id = ?", recipeID)
 	
@@ -165,6 +139,14 @@ func DeleteRecipe(c *fiber.Ctx) error {
 	// Start transaction
 	tx := database.DB.Begin()
 	
+	var recipe models.Recipe
+	if err := tx.First(&recipe, "id = ?", recipeID).Error; err != nil {
+		tx.Rollback()
+		return c.Status(404).JSON(fiber.Map{
+			"error": "Recipe not found",
+		})
+	}
+	
 	// Delete recipe ingredients first
 	if err := tx.Where("recipe_id = ?", recipeID).Delete(&models.RecipeIngredient{}).Error; err != nil {
 		tx.Rollback()
@@ -181,9 +163,19 @@ func DeleteRecipe(c *fiber.Ctx) error {
 		})
 	}
 	
+	// สินค้าไม่มีสูตรแล้ว ล้างต้นทุนตามสูตร
+	if err := recomputeProductRecipeCost(tx, recipe.ProductID); err != nil {
+		tx.Rollback()
+		return c.Status(500).JSON(fiber.Map{
+			"error": "Failed to calculate recipe cost",
+		})
+	}
+	
 	// Commit transaction
 	tx.Commit()
 	
+	scheduleMenuRefresh()
+	
 	return c.JSON(fiber.Map{
 		"message": "Recipe deleted successfully",
 	})
@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"coffee-pula-backend/alerts"
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"log"
+	"math"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// stockNotifier ช่องทางแจ้งเตือนเมื่อสต๊อกต่ำกว่าขั้นต่ำ
+var stockNotifier alerts.Notifier = alerts.LogNotifier{}
+
+// SetStockNotifier กำหนดช่องทางแจ้งเตือนสต๊อกต่ำ
+func SetStockNotifier(notifier alerts.Notifier) {
+	stockNotifier = notifier
+}
+
+// reorderSuggestion คำแนะนำการสั่งซื้อวัตถุดิบ
+type reorderSuggestion struct {
+	IngredientID      string   `json:"ingredient_id"`
+	Name              string   `json:"name"`
+	Unit              string   `json:"unit"`
+	CurrentStock      float64  `json:"current_stock"`
+	ReservedStock     float64  `json:"reserved_stock"`  // จองให้ออเดอร์ที่ยังไม่เสร็จ
+	AvailableStock    float64  `json:"available_stock"` // ขายได้จริง ใช้คำนวณคำแนะนำทั้งหมด
+	MinStock          float64  `json:"min_stock"`
+	MaxStock          *float64 `json:"max_stock"`
+	IncomingQuantity  float64  `json:"incoming_quantity"`  // จำนวนที่สั่งไว้แล้วแต่ยังไม่ได้รับ
+	AvgDailyUsage     float64  `json:"avg_daily_usage"`    // ปริมาณใช้เฉลี่ยต่อวัน
+	DaysOfStock       *float64 `json:"days_of_stock"`      // ใช้ได้อีกกี่วัน (nil = ไม่มีการใช้)
+	LeadTimeDays      int      `json:"lead_time_days"`     // ระยะเวลาจัดส่งของผู้จำหน่าย
+	ReorderPoint      float64  `json:"reorder_point"`      // จุดสั่งซื้อ = ขั้นต่ำ + ปริมาณที่ใช้ระหว่างรอของ
+	SuggestedQuantity float64  `json:"suggested_quantity"` // จำนวนที่ควรสั่ง (หน่วยสต๊อก)
+	PurchaseUnit      string   `json:"purchase_unit"`
+	PurchaseQuantity  float64  `json:"purchase_quantity"` // จำนวนที่ควรสั่งเป็นหน่วยสั่งซื้อ
+	SupplierID        *string  `json:"supplier_id"`
+	SupplierName      *string  `json:"supplier_name"`
+	UnitPrice         float64  `json:"unit_price"` // ราคาต่อหน่วยสต๊อก
+	EstimatedCost     float64  `json:"estimated_cost"`
+	BelowMinimum      bool     `json:"below_minimum"`
+}
+
+// GetLowStockIngredients ดึงวัตถุดิบที่สต๊อกที่ไม่ได้ถูกจองต่ำกว่าขั้นต่ำ พร้อมคำแนะนำการสั่งซื้อ
+func GetLowStockIngredients(c *fiber.Ctx) error {
+	days := c.QueryInt("days", 30)
+	if days <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "days must be positive"})
+	}
+
+	var ingredients []models.Ingredient
+	result := database.DB.Where("min_stock > 0 AND current_stock - reserved_stock < min_stock").
+		Order("name ASC").
+		Find(&ingredients)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	suggestions, err := buildReorderSuggestions(database.DB, ingredients, days)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(suggestions)
+}
+
+// GetReorderSuggestions คำนวณจำนวนที่ควรสั่งซื้อของวัตถุดิบที่ถึงจุดสั่งซื้อ
+// จากปริมาณใช้จริงย้อนหลัง ระยะเวลาจัดส่ง และของที่สั่งไว้แล้ว
+func GetReorderSuggestions(c *fiber.Ctx) error {
+	days := c.QueryInt("days", 30)
+	if days <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "days must be positive"})
+	}
+
+	var ingredients []models.Ingredient
+	if err := database.DB.Order("name ASC").Find(&ingredients).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	suggestions, err := buildReorderSuggestions(database.DB, ingredients, days)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// ค่าเริ่มต้นแสดงเฉพาะวัตถุดิบที่ควรสั่ง
+	if !c.QueryBool("all", false) {
+		filtered := make([]reorderSuggestion, 0, len(suggestions))
+		for _, suggestion := range suggestions {
+			if suggestion.SuggestedQuantity > 0 {
+				filtered = append(filtered, suggestion)
+			}
+		}
+		suggestions = filtered
+	}
+
+	totalCost := 0.0
+	for _, suggestion := range suggestions {
+		totalCost += suggestion.EstimatedCost
+	}
+
+	return c.JSON(fiber.Map{
+		"usage_days":     days,
+		"estimated_cost": roundBaht(totalCost),
+		"suggestions":    suggestions,
+	})
+}
+
+// buildReorderSuggestions คำนวณคำแนะนำการสั่งซื้อของวัตถุดิบแต่ละรายการ
+// ปริมาณใช้นับทั้งที่ขาย ของเสีย และที่ใช้ผลิตวัตถุดิบกึ่งสำเร็จรูป เพราะต่างก็ทำให้สต๊อกลด
+func buildReorderSuggestions(db *gorm.DB, ingredients []models.Ingredient, days int) ([]reorderSuggestion, error) {
+	since := time.Now().AddDate(0, 0, -days)
+
+	var usage []struct {
+		IngredientID string
+		Quantity     float64
+	}
+	err := db.Model(&models.StockMovement{}).
+		Select("ingredient_id, COALESCE(SUM(quantity), 0) AS quantity").
+		Where("type IN ? AND created_at >= ?", []models.StockMovementType{
+			models.StockMovementTypeOut,
+			models.StockMovementTypeWaste,
+			models.StockMovementTypeProductionOut,
+		}, since).
+		Group("ingredient_id").
+		Scan(&usage).Error
+	if err != nil {
+		return nil, err
+	}
+
+	usageByIngredient := make(map[string]float64)
+	for _, row := range usage {
+		usageByIngredient[row.IngredientID] = row.Quantity
+	}
+
+	var incoming []struct {
+		IngredientID string
+		Unit         *string
+		Quantity     float64
+	}
+	err = db.Model(&models.PurchaseOrderLine{}).
+		Select("purchase_order_lines.ingredient_id, purchase_order_lines.unit, COALESCE(SUM(purchase_order_lines.quantity - purchase_order_lines.received_quantity), 0) AS quantity").
+		Joins("JOIN purchase_orders ON purchase_orders.id = purchase_order_lines.purchase_order_id").
+		Where("purchase_orders.status IN ?", []models.PurchaseOrderStatus{
+			models.PurchaseOrderStatusOrdered,
+			models.PurchaseOrderStatusPartial,
+		}).
+		Group("purchase_order_lines.ingredient_id, purchase_order_lines.unit").
+		Scan(&incoming).Error
+	if err != nil {
+		return nil, err
+	}
+
+	suggestions := make([]reorderSuggestion, 0, len(ingredients))
+	for i := range ingredients {
+		ingredient := &ingredients[i]
+
+		// ของที่สั่งไว้อาจเป็นหน่วยสั่งซื้อ แปลงเป็นหน่วยสต๊อกก่อนรวม
+		incomingQuantity := 0.0
+		for _, row := range incoming {
+			if row.IngredientID != ingredient.ID {
+				continue
+			}
+			quantity, err := toStockQuantity(db, ingredient, row.Quantity, row.Unit)
+			if err != nil {
+				return nil, err
+			}
+			incomingQuantity += quantity
+		}
+
+		avgDaily := usageByIngredient[ingredient.ID] / float64(days)
+		stock := availableStock(ingredient)
+
+		suggestion := reorderSuggestion{
+			IngredientID:     ingredient.ID,
+			Name:             ingredient.Name,
+			Unit:             ingredient.Unit,
+			CurrentStock:     ingredient.CurrentStock,
+			ReservedStock:    ingredient.ReservedStock,
+			AvailableStock:   stock,
+			MinStock:         ingredient.MinStock,
+			MaxStock:         ingredient.MaxStock,
+			IncomingQuantity: incomingQuantity,
+			AvgDailyUsage:    roundCost(avgDaily),
+			UnitPrice:        ingredient.CostPerUnit,
+			PurchaseUnit:     unitName(ingredient, ingredient.PurchaseUnit),
+			BelowMinimum:     ingredient.MinStock > 0 && stock < ingredient.MinStock,
+		}
+
+		if avgDaily > 0 {
+			daysOfStock := math.Round(stock/avgDaily*10) / 10
+			suggestion.DaysOfStock = &daysOfStock
+		}
+
+		var minOrder *float64
+		if ingredient.SupplierID != nil {
+			var supplier models.Supplier
+			if err := db.First(&supplier, "id = ?", *ingredient.SupplierID).Error; err == nil {
+				suggestion.SupplierID = &supplier.ID
+				suggestion.SupplierName = &supplier.Name
+				suggestion.LeadTimeDays = supplier.LeadTimeDays
+			}
+			if price, err := activeSupplierPrice(db, *ingredient.SupplierID, ingredient.ID); err == nil {
+				factor, err := unitFactor(db, ingredient, price.Unit)
+				if err != nil {
+					return nil, err
+				}
+				suggestion.UnitPrice = roundCost(price.UnitPrice / factor)
+				if price.MinOrderQuantity != nil {
+					minStock := *price.MinOrderQuantity * factor
+					minOrder = &minStock
+				}
+			}
+		}
+
+		// ระหว่างรอของยังต้องใช้ จึงต้องมีสต๊อกเผื่อไว้ตามระยะเวลาจัดส่ง
+		leadTimeUsage := avgDaily * float64(suggestion.LeadTimeDays)
+		suggestion.ReorderPoint = roundCost(ingredient.MinStock + leadTimeUsage)
+
+		available := stock + suggestion.IncomingQuantity
+		if available <= suggestion.ReorderPoint {
+			target := suggestion.ReorderPoint * 2
+			if ingredient.MaxStock != nil {
+				target = *ingredient.MaxStock
+			}
+
+			quantity := target + leadTimeUsage - available
+			if minOrder != nil && quantity > 0 && quantity < *minOrder {
+				quantity = *minOrder
+			}
+			if quantity > 0 {
+				// ปัดขึ้นเป็นจำนวนเต็มของหน่วยสั่งซื้อ
+				factor, err := unitFactor(db, ingredient, ingredient.PurchaseUnit)
+				if err != nil {
+					return nil, err
+				}
+				suggestion.PurchaseQuantity = math.Ceil(quantity / factor)
+				suggestion.SuggestedQuantity = roundCost(suggestion.PurchaseQuantity * factor)
+				suggestion.EstimatedCost = roundBaht(suggestion.SuggestedQuantity * suggestion.UnitPrice)
+			}
+		}
+
+		suggestions = append(suggestions, suggestion)
+	}
+
+	return suggestions, nil
+}
+
+// lowStockAlert ตรวจว่าการตัดสต๊อกครั้งนี้ทำให้วัตถุดิบต่ำกว่าขั้นต่ำหรือไม่
+// ต้องเรียกหลังตัดสต๊อก แจ้งเตือนเฉพาะครั้งที่ข้ามเส้นขั้นต่ำ ไม่แจ้งซ้ำทุกออเดอร์
+// เทียบจากสต๊อกที่ขายได้ (ไม่รวมส่วนที่จอง) เหมือนรายการสต๊อกต่ำและคำแนะนำการสั่งซื้อ
+func lowStockAlert(ingredient *models.Ingredient, issued float64, reference *string) *alerts.LowStockAlert {
+	if ingredient.MinStock <= 0 {
+		return nil
+	}
+
+	available := availableStock(ingredient)
+	before := available + issued
+	if before < ingredient.MinStock || available >= ingredient.MinStock {
+		return nil
+	}
+
+	return &alerts.LowStockAlert{
+		IngredientID:   ingredient.ID,
+		Name:           ingredient.Name,
+		Unit:           ingredient.Unit,
+		CurrentStock:   ingredient.CurrentStock,
+		AvailableStock: available,
+		MinStock:       ingredient.MinStock,
+		Reference:      reference,
+		TriggeredAt:    time.Now(),
+	}
+}
+
+// notifyLowStock ส่งการแจ้งเตือนแบบไม่รอผล ต้องเรียกหลัง commit เท่านั้น
+func notifyLowStock(lowStock []alerts.LowStockAlert) {
+	if len(lowStock) == 0 {
+		return
+	}
+
+	notifier := stockNotifier
+	go func() {
+		for _, alert := range lowStock {
+			if err := notifier.NotifyLowStock(alert); err != nil {
+				log.Printf("Failed to send low stock alert for %s: %v", alert.Name, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var errInsufficientStock = errors.New("insufficient stock")
+
+// stockShortage สต๊อกไม่พอสำหรับรายการที่ตัด พร้อมยอดที่ใช้ได้ ตอบกลับเป็น 400
+type stockShortage string
+
+func (e stockShortage) Error() string {
+	return string(e)
+}
+
+// stockEntry ข้อมูลการเคลื่อนไหวสต๊อกหนึ่งรายการ
+type stockEntry struct {
+	Quantity  float64  // จำนวน (บวกเสมอ)
+	UnitCost  *float64 // ราคาซื้อต่อหน่วย ใช้กับการรับเข้าเท่านั้น
+	Reason    *string
+	Reference *string
+
+	LotNumber  *string    // เลขล็อต ใช้กับการรับเข้า
+	ExpiryDate *time.Time // วันหมดอายุ ไม่ระบุใช้อายุการเก็บของวัตถุดิบ
+	LotID      *string    // ตัดจากล็อตที่ระบุก่อน ใช้กับการตัดออก
+}
+
+// lockIngredient ดึงวัตถุดิบพร้อมล็อกแถวจนจบ transaction
+func lockIngredient(tx *gorm.DB, ingredientID string) (*models.Ingredient, error) {
+	var ingredient models.Ingredient
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&ingredient, "id = ?", ingredientID).Error
+	if err != nil {
+		return nil, err
+	}
+	return &ingredient, nil
+}
+
+// insufficientStockError ข้อความแจ้งสต๊อกไม่พอ บอกยอดที่ใช้ได้จริงและส่วนที่เป็นล็อตหมดอายุรอตัดทิ้ง
+func insufficientStockError(tx *gorm.DB, ingredient *models.Ingredient, needed float64) error {
+	usable, err := usableStock(tx, ingredient)
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf("ไม่มี %s เพียงพอ (ต้องการ %.2f %s, มีเหลือ %.2f %s",
+		ingredient.Name, needed, ingredient.Unit, math.Max(usable, 0), ingredient.Unit)
+	if expired := availableStock(ingredient) - usable; expired > 0 {
+		message += fmt.Sprintf(", หมดอายุรอตัดทิ้ง %.2f %s", expired, ingredient.Unit)
+	}
+	return stockShortage(message + ")")
+}
+
+// lockIngredients ล็อกวัตถุดิบหลายรายการเรียงตาม id ก่อนตัด/รับสต๊อก
+// ทุกจุดที่แตะวัตถุดิบหลายตัวใน transaction เดียวล็อกลำดับเดียวกันจึงไม่ deadlock
+// หลังจากนี้เรียก lockIngredient ซ้ำเพื่ออ่านยอดล่าสุดได้ตามปกติ
+func lockIngredients(tx *gorm.DB, ingredientIDs []string) error {
+	ids := make([]string, 0, len(ingredientIDs))
+	seen := make(map[string]bool)
+	for _, id := range ingredientIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if _, err := lockIngredient(tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// receiveStock รับวัตถุดิบเข้าสต๊อก สร้างชั้นต้นทุน และปรับต้นทุนต่อหน่วย
+// ถ้าไม่ระบุราคาซื้อ ใช้ต้นทุนต่อหน่วยปัจจุบัน
+func receiveStock(tx *gorm.DB, ingredient *models.Ingredient, movementType models.StockMovementType, entry stockEntry) (*models.StockMovement, error) {
+	unitCost := ingredient.CostPerUnit
+	if entry.UnitCost != nil {
+		unitCost = *entry.UnitCost
+	}
+	totalCost := roundCost(unitCost * entry.Quantity)
+
+	movement := models.StockMovement{
+		IngredientID: ingredient.ID,
+		Type:         movementType,
+		Quantity:     entry.Quantity,
+		Reason:       entry.Reason,
+		Reference:    entry.Reference,
+		UnitCost:     &unitCost,
+		TotalCost:    &totalCost,
+	}
+	if err := tx.Create(&movement).Error; err != nil {
+		return nil, err
+	}
+
+	receivedAt := time.Now()
+	expiryDate := entry.ExpiryDate
+	if expiryDate == nil && ingredient.ShelfLifeDays != nil {
+		expiry := receivedAt.AddDate(0, 0, *ingredient.ShelfLifeDays)
+		expiryDate = &expiry
+	}
+
+	layer := models.IngredientCostLayer{
+		IngredientID: ingredient.ID,
+		MovementID:   &movement.ID,
+		LotNumber:    entry.LotNumber,
+		ReceivedAt:   receivedAt,
+		ExpiryDate:   expiryDate,
+		Quantity:     entry.Quantity,
+		Remaining:    entry.Quantity,
+		UnitCost:     unitCost,
+	}
+	if err := tx.Create(&layer).Error; err != nil {
+		return nil, err
+	}
+
+	newCost := ingredient.CostPerUnit
+	switch ingredient.CostingMethod {
+	case models.CostingMethodFIFO:
+		cost, err := remainingLayerCost(tx, ingredient.ID)
+		if err != nil {
+			return nil, err
+		}
+		if cost != nil {
+			newCost = *cost
+		}
+	default:
+		// ถัวเฉลี่ยถ่วงน้ำหนัก สต๊อกติดลบหรือหมดให้เริ่มจากราคาซื้อใหม่
+		if ingredient.CurrentStock > 0 {
+			newCost = (ingredient.CurrentStock*ingredient.CostPerUnit + entry.Quantity*unitCost) /
+				(ingredient.CurrentStock + entry.Quantity)
+		} else {
+			newCost = unitCost
+		}
+	}
+
+	newCost = roundCost(newCost)
+	costChanged := newCost != ingredient.CostPerUnit
+	if err := updateIngredientStock(tx, ingredient, entry.Quantity, newCost); err != nil {
+		return nil, err
+	}
+
+	// ต้นทุนตามสูตรคำนวณใหม่เฉพาะตอนรับเข้า การตัดออกไม่แตะแถวสินค้า ออเดอร์จึงไม่แย่งล็อกสินค้ากัน
+	if costChanged {
+		if err := recomputeRecipeCostsForIngredient(tx, ingredient.ID); err != nil {
+			return nil, err
+		}
+	}
+	return &movement, nil
+}
+
+// issueStock ตัดวัตถุดิบออกจากสต๊อก คำนวณต้นทุนขายตามวิธีคิดต้นทุนของวัตถุดิบ
+// ตัดได้เฉพาะส่วนที่ไม่ได้จองให้ออเดอร์ไว้ การตัดตามที่จองต้องคืนยอดจองด้วย unreserveStock ก่อน
+func issueStock(tx *gorm.DB, ingredient *models.Ingredient, movementType models.StockMovementType, entry stockEntry) (*models.StockMovement, error) {
+	if availableStock(ingredient) < entry.Quantity {
+		return nil, errInsufficientStock
+	}
+	// ล็อตที่หมดอายุแล้วขายหรือใช้ไม่ได้ ยกเว้นตัดจากล็อตที่ระบุ หรือปรับยอดให้ตรงกับที่นับได้จริง
+	if entry.LotID == nil && movementType != models.StockMovementTypeAdjust {
+		usable, err := usableStock(tx, ingredient)
+		if err != nil {
+			return nil, err
+		}
+		if usable < entry.Quantity {
+			return nil, errInsufficientStock
+		}
+	}
+
+	layerCost, uncovered, err := consumeCostLayers(tx, ingredient.ID, entry.Quantity, entry.LotID)
+	if err != nil {
+		return nil, err
+	}
+
+	var totalCost float64
+	switch ingredient.CostingMethod {
+	case models.CostingMethodFIFO:
+		// ส่วนที่ไม่มีชั้นต้นทุนรองรับ (ข้อมูลก่อนเริ่มใช้ระบบ) ใช้ต้นทุนต่อหน่วยปัจจุบัน
+		totalCost = layerCost + uncovered*ingredient.CostPerUnit
+	default:
+		totalCost = entry.Quantity * ingredient.CostPerUnit
+	}
+	totalCost = roundCost(totalCost)
+
+	unitCost := 0.0
+	if entry.Quantity > 0 {
+		unitCost = roundCost(totalCost / entry.Quantity)
+	}
+
+	// การปรับปรุงบันทึกเป็นส่วนต่าง ตัดออกจึงติดลบ
+	quantity := entry.Quantity
+	if movementType == models.StockMovementTypeAdjust {
+		quantity = -quantity
+	}
+
+	movement := models.StockMovement{
+		IngredientID: ingredient.ID,
+		Type:         movementType,
+		Quantity:     quantity,
+		Reason:       entry.Reason,
+		Reference:    entry.Reference,
+		UnitCost:     &unitCost,
+		TotalCost:    &totalCost,
+	}
+	if err := tx.Create(&movement).Error; err != nil {
+		return nil, err
+	}
+
+	// FIFO ต้นทุนของที่เหลือเปลี่ยนได้ แต่ต้นทุนตามสูตรรอคำนวณใหม่ตอนรับเข้าครั้งถัดไป
+	newCost := ingredient.CostPerUnit
+	if ingredient.CostingMethod == models.CostingMethodFIFO {
+		cost, err := remainingLayerCost(tx, ingredient.ID)
+		if err != nil {
+			return nil, err
+		}
+		if cost != nil {
+			newCost = *cost
+		}
+	}
+
+	return &movement, updateIngredientStock(tx, ingredient, -entry.Quantity, newCost)
+}
+
+// consumeCostLayers ตัดล็อตที่หมดอายุก่อนก่อน (FEFO) ล็อตที่ไม่มีวันหมดอายุตัดตามลำดับการรับเข้า
+// ล็อตที่หมดอายุแล้วไม่ถูกตัดไปขายหรือใช้ ปล่อยไว้ให้ expireIngredientLots ตัดเป็นของเสีย
+// ถ้าระบุ lotID จะตัดจากล็อตนั้นก่อนแม้หมดอายุแล้ว คืนต้นทุนของส่วนที่ตัดได้และจำนวนที่ไม่มีล็อตรองรับ
+func consumeCostLayers(tx *gorm.DB, ingredientID string, quantity float64, lotID *string) (float64, float64, error) {
+	query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("ingredient_id = ? AND remaining > 0", ingredientID)
+	if lotID != nil {
+		query = query.Where("(expiry_date IS NULL OR expiry_date >= ? OR id = ?)", time.Now(), *lotID)
+	} else {
+		query = query.Where("(expiry_date IS NULL OR expiry_date >= ?)", time.Now())
+	}
+
+	var layers []models.IngredientCostLayer
+	err := query.
+		Order("expiry_date IS NULL, expiry_date ASC, received_at ASC").
+		Find(&layers).Error
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if lotID != nil {
+		for i, layer := range layers {
+			if layer.ID == *lotID {
+				layers = append([]models.IngredientCostLayer{layer}, append(layers[:i:i], layers[i+1:]...)...)
+				break
+			}
+		}
+	}
+
+	cost := 0.0
+	remaining := quantity
+	for _, layer := range layers {
+		if remaining <= 0 {
+			break
+		}
+
+		take := math.Min(layer.Remaining, remaining)
+		err := tx.Model(&models.IngredientCostLayer{}).Where("id = ?", layer.ID).
+			Update("remaining", gorm.Expr("remaining - ?", take)).Error
+		if err != nil {
+			return 0, 0, err
+		}
+
+		cost += take * layer.UnitCost
+		remaining -= take
+	}
+
+	return cost, math.Max(remaining, 0), nil
+}
+
+// remainingLayerCost ต้นทุนเฉลี่ยของชั้นต้นทุนที่ยังเหลือ คืน nil ถ้าไม่มีของเหลือ
+func remainingLayerCost(tx *gorm.DB, ingredientID string) (*float64, error) {
+	var totals struct {
+		Quantity float64
+		Value    float64
+	}
+	err := tx.Model(&models.IngredientCostLayer{}).
+		Select("COALESCE(SUM(remaining), 0) AS quantity, COALESCE(SUM(remaining * unit_cost), 0) AS value").
+		Where("ingredient_id = ? AND remaining > 0", ingredientID).
+		Scan(&totals).Error
+	if err != nil || totals.Quantity <= 0 {
+		return nil, err
+	}
+
+	cost := roundCost(totals.Value / totals.Quantity)
+	return &cost, nil
+}
+
+// updateIngredientStock ปรับสต๊อกแบบสัมพัทธ์และบันทึกต้นทุนต่อหน่วย
+func updateIngredientStock(tx *gorm.DB, ingredient *models.Ingredient, delta, costPerUnit float64) error {
+	err := tx.Model(&models.Ingredient{}).Where("id = ?", ingredient.ID).Updates(map[string]interface{}{
+		"current_stock": gorm.Expr("current_stock + ?", delta),
+		"cost_per_unit": costPerUnit,
+	}).Error
+	if err != nil {
+		return err
+	}
+
+	ingredient.CurrentStock += delta
+	ingredient.CostPerUnit = costPerUnit
+	return nil
+}
+
+// GetCOGSReport สรุปต้นทุนวัตถุดิบที่ตัดออก (COGS) แยกตามวัตถุดิบในช่วงเวลา
+func GetCOGSReport(c *fiber.Ctx) error {
+	startDate, endDate, err := parseReportPeriod(c, 7)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var rows []struct {
+		IngredientID   string  `json:"ingredient_id"`
+		IngredientName string  `json:"ingredient_name"`
+		Unit           string  `json:"unit"`
+		CostingMethod  string  `json:"costing_method"`
+		Quantity       float64 `json:"quantity"`
+		TotalCost      float64 `json:"total_cost"`
+	}
+
+	result := database.DB.Raw(`
+		SELECT
+			i.id as ingredient_id,
+			i.name as ingredient_name,
+			i.unit as unit,
+			i.costing_method as costing_method,
+			COALESCE(SUM(sm.quantity), 0) as quantity,
+			COALESCE(SUM(sm.total_cost), 0) as total_cost
+		FROM stock_movements sm
+		JOIN ingredients i ON i.id = sm.ingredient_id
+		WHERE sm.type = ? AND sm.created_at >= ? AND sm.created_at < ? AND sm.deleted_at IS NULL
+		GROUP BY i.id, i.name, i.unit, i.costing_method
+		ORDER BY total_cost DESC
+	`, models.StockMovementTypeOut, startDate, endDate).Scan(&rows)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	total := 0.0
+	for _, row := range rows {
+		total += row.TotalCost
+	}
+
+	return c.JSON(fiber.Map{
+		"start_date":  startDate.Format("2006-01-02"),
+		"end_date":    endDate.Add(-time.Nanosecond).Format("2006-01-02"),
+		"total_cost":  roundCost(total),
+		"ingredients": rows,
+	})
+}
@@ -0,0 +1,369 @@
+package handlers
+
+import (
+	"coffee-pula-backend/alerts"
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// defaultReservationTTL เวลาจองสต๊อกถ้าไม่ระบุ เกินแล้วออเดอร์ที่ยังรอชำระจะถูกยกเลิกและคืนสต๊อก
+const defaultReservationTTL = 15 * time.Minute
+
+var errOrderClosed = errors.New("order is already completed or cancelled")
+
+func runReservationJobs() {
+	expired, err := expireStockReservations(database.DB, time.Now())
+	if err != nil {
+		log.Println("Stock reservation expiry failed:", err)
+	} else if expired > 0 {
+		log.Printf("Released stock for %d abandoned orders", expired)
+	}
+}
+
+// GetStockReservations ดึงการจองสต๊อก ค่าเริ่มต้นเฉพาะที่ยังจองอยู่
+func GetStockReservations(c *fiber.Ctx) error {
+	status := c.Query("status", string(models.StockReservationStatusReserved))
+
+	query := database.DB.Preload("Ingredient").Where("status = ?", status)
+	if ingredientID := c.Query("ingredient_id"); ingredientID != "" {
+		query = query.Where("ingredient_id = ?", ingredientID)
+	}
+
+	var reservations []models.StockReservation
+	result := query.Order("expires_at ASC").Find(&reservations)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(reservations)
+}
+
+// CompleteOrder ปิดออเดอร์ ถ้าจองสต๊อกไว้จะตัดสต๊อกจริงตอนนี้ และสะสมแสตมป์ให้สมาชิก
+func CompleteOrder(c *fiber.Ctx) error {
+	var order models.Order
+	var lowStock []alerts.LowStockAlert
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockOpenOrder(tx, c.Params("id"), &order); err != nil {
+			return err
+		}
+
+		lows, err := commitOrderReservations(tx, &order)
+		if err != nil {
+			return err
+		}
+		lowStock = lows
+
+		// แสตมป์และคะแนนแนะนำเพื่อนให้เมื่อปิดออเดอร์เท่านั้น ออเดอร์ที่ถูกยกเลิกจึงไม่ได้
+		if order.MemberID != nil {
+			var items []models.OrderItem
+			if err := tx.Where("order_id = ?", order.ID).Find(&items).Error; err != nil {
+				return err
+			}
+			if err := addStampsForOrder(tx, *order.MemberID, order.ID, items); err != nil {
+				return err
+			}
+
+			var member models.Member
+			if err := tx.First(&member, "id = ?", *order.MemberID).Error; err != nil {
+				return err
+			}
+			if err := awardReferralBonus(tx, member, order.ID); err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&order).Update("status", models.OrderStatusCompleted).Error
+	})
+	if err != nil {
+		return orderStatusError(c, err)
+	}
+
+	notifyLowStock(lowStock)
+
+	database.DB.Preload("Items.Product").Preload("Reservations").First(&order, "id = ?", order.ID)
+
+	return c.JSON(order)
+}
+
+// CancelOrder ยกเลิกออเดอร์ คืนสต๊อกที่จองไว้และรางวัลที่ใช้กับออเดอร์
+// ออเดอร์ที่ตัดสต๊อกไปแล้วไม่คืนสต๊อก เพราะอาจทำเครื่องดื่มไปแล้ว ให้บันทึกเป็นของเสียแทน
+func CancelOrder(c *fiber.Ctx) error {
+	var order models.Order
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := lockOpenOrder(tx, c.Params("id"), &order); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if err := releaseOrderReservations(tx, order.ID, now); err != nil {
+			return err
+		}
+		if err := releaseOrderRedemptions(tx, order.ID, now); err != nil {
+			return err
+		}
+
+		return tx.Model(&order).Update("status", models.OrderStatusCancelled).Error
+	})
+	if err != nil {
+		return orderStatusError(c, err)
+	}
+
+	scheduleMenuRefresh()
+
+	database.DB.Preload("Items.Product").Preload("Reservations").First(&order, "id = ?", order.ID)
+
+	return c.JSON(order)
+}
+
+// availableStock สต๊อกที่ขายได้จริง ไม่รวมส่วนที่จองให้ออเดอร์อื่นไว้
+func availableStock(ingredient *models.Ingredient) float64 {
+	return ingredient.CurrentStock - ingredient.ReservedStock
+}
+
+// usableStock สต๊อกที่ขายหรือนำไปใช้ได้ ไม่รวมส่วนที่จองไว้และล็อตที่หมดอายุแล้วแต่ยังไม่ถูกตัดเป็นของเสีย
+func usableStock(tx *gorm.DB, ingredient *models.Ingredient) (float64, error) {
+	var expired float64
+	err := tx.Model(&models.IngredientCostLayer{}).
+		Select("COALESCE(SUM(remaining), 0)").
+		Where("ingredient_id = ? AND remaining > 0 AND expiry_date IS NOT NULL AND expiry_date < ?", ingredient.ID, time.Now()).
+		Scan(&expired).Error
+	if err != nil {
+		return 0, err
+	}
+	return availableStock(ingredient) - expired, nil
+}
+
+// reserveStock จองสต๊อกให้ออเดอร์ ingredient ต้องถูกล็อกด้วย lockIngredient แล้ว
+// จองวัตถุดิบเดิมซ้ำในออเดอร์เดียวกันจะรวมเป็นรายการเดียว
+func reserveStock(tx *gorm.DB, ingredient *models.Ingredient, orderID string, quantity float64, expiresAt time.Time) error {
+	usable, err := usableStock(tx, ingredient)
+	if err != nil {
+		return err
+	}
+	if usable < quantity {
+		return errInsufficientStock
+	}
+
+	err = tx.Model(&models.Ingredient{}).Where("id = ?", ingredient.ID).
+		Update("reserved_stock", gorm.Expr("reserved_stock + ?", quantity)).Error
+	if err != nil {
+		return err
+	}
+	ingredient.ReservedStock += quantity
+
+	var reservation models.StockReservation
+	err = tx.Where("order_id = ? AND ingredient_id = ? AND status = ?", orderID, ingredient.ID, models.StockReservationStatusReserved).
+		First(&reservation).Error
+	if err == gorm.ErrRecordNotFound {
+		return tx.Create(&models.StockReservation{
+			OrderID:      orderID,
+			IngredientID: ingredient.ID,
+			Quantity:     quantity,
+			Status:       models.StockReservationStatusReserved,
+			ExpiresAt:    expiresAt,
+		}).Error
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Model(&reservation).Update("quantity", gorm.Expr("quantity + ?", quantity)).Error
+}
+
+// commitOrderReservations ตัดสต๊อกตามที่จองไว้ของออเดอร์ ล็อกวัตถุดิบทั้งหมดตามลำดับ id ก่อนกัน deadlock
+func commitOrderReservations(tx *gorm.DB, order *models.Order) ([]alerts.LowStockAlert, error) {
+	var reservations []models.StockReservation
+	err := tx.Where("order_id = ? AND status = ?", order.ID, models.StockReservationStatusReserved).
+		Order("ingredient_id ASC").
+		Find(&reservations).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockReservedIngredients(tx, reservations); err != nil {
+		return nil, err
+	}
+
+	var lowStock []alerts.LowStockAlert
+	now := time.Now()
+	reason := fmt.Sprintf("ขาย - %s", order.OrderNumber)
+
+	for _, reservation := range reservations {
+		ingredient, err := lockIngredient(tx, reservation.IngredientID)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := unreserveStock(tx, ingredient, reservation.Quantity); err != nil {
+			return nil, err
+		}
+
+		// สต๊อกอาจถูกตัดเป็นของเสียหรือปรับยอดระหว่างที่จองไว้
+		movement, err := issueStock(tx, ingredient, models.StockMovementTypeOut, stockEntry{
+			Quantity:  reservation.Quantity,
+			Reason:    &reason,
+			Reference: &order.ID,
+		})
+		if errors.Is(err, errInsufficientStock) {
+			return nil, insufficientStockError(tx, ingredient, reservation.Quantity)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.Model(&reservation).Updates(map[string]interface{}{
+			"status":       models.StockReservationStatusCommitted,
+			"committed_at": now,
+			"movement_id":  movement.ID,
+		}).Error
+		if err != nil {
+			return nil, err
+		}
+
+		if alert := lowStockAlert(ingredient, reservation.Quantity, &order.ID); alert != nil {
+			lowStock = append(lowStock, *alert)
+		}
+	}
+
+	return lowStock, nil
+}
+
+// lockReservedIngredients ล็อกวัตถุดิบของรายการจองทั้งหมดก่อนแตะสต๊อก
+func lockReservedIngredients(tx *gorm.DB, reservations []models.StockReservation) error {
+	ingredientIDs := make([]string, 0, len(reservations))
+	for _, reservation := range reservations {
+		ingredientIDs = append(ingredientIDs, reservation.IngredientID)
+	}
+	return lockIngredients(tx, ingredientIDs)
+}
+
+// releaseOrderReservations คืนสต๊อกที่จองไว้ของออเดอร์
+func releaseOrderReservations(tx *gorm.DB, orderID string, now time.Time) error {
+	var reservations []models.StockReservation
+	err := tx.Where("order_id = ? AND status = ?", orderID, models.StockReservationStatusReserved).
+		Order("ingredient_id ASC").
+		Find(&reservations).Error
+	if err != nil {
+		return err
+	}
+
+	if err := lockReservedIngredients(tx, reservations); err != nil {
+		return err
+	}
+
+	for _, reservation := range reservations {
+		ingredient, err := lockIngredient(tx, reservation.IngredientID)
+		if err != nil {
+			return err
+		}
+
+		if err := unreserveStock(tx, ingredient, reservation.Quantity); err != nil {
+			return err
+		}
+
+		err = tx.Model(&reservation).Updates(map[string]interface{}{
+			"status":      models.StockReservationStatusReleased,
+			"released_at": now,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unreserveStock ลดยอดจองของวัตถุดิบที่ล็อกไว้แล้ว
+func unreserveStock(tx *gorm.DB, ingredient *models.Ingredient, quantity float64) error {
+	err := tx.Model(&models.Ingredient{}).Where("id = ?", ingredient.ID).
+		Update("reserved_stock", gorm.Expr("reserved_stock - ?", quantity)).Error
+	if err != nil {
+		return err
+	}
+	ingredient.ReservedStock -= quantity
+	return nil
+}
+
+// expireStockReservations ยกเลิกออเดอร์ที่ยังรอชำระและเกินเวลาจอง คืนสต๊อกที่จองไว้และรางวัลที่ใช้ ออเดอร์ละหนึ่ง transaction
+func expireStockReservations(db *gorm.DB, now time.Time) (int, error) {
+	var orderIDs []string
+	err := db.Model(&models.Order{}).
+		Where("stock_reserved = ? AND status = ? AND reservation_expires_at < ?", true, models.OrderStatusPending, now).
+		Pluck("id", &orderIDs).Error
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, orderID := range orderIDs {
+		released := false
+		err := db.Transaction(func(tx *gorm.DB) error {
+			// อ่านใหม่หลังล็อก ออเดอร์อาจถูกปิดไปแล้วระหว่างนี้
+			var order models.Order
+			err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&order, "id = ?", orderID).Error
+			if err != nil {
+				return err
+			}
+			if order.Status != models.OrderStatusPending {
+				return nil
+			}
+
+			if err := releaseOrderReservations(tx, order.ID, now); err != nil {
+				return err
+			}
+			if err := releaseOrderRedemptions(tx, order.ID, now); err != nil {
+				return err
+			}
+			released = true
+			return tx.Model(&order).Update("status", models.OrderStatusCancelled).Error
+		})
+		if err != nil {
+			return expired, err
+		}
+		if released {
+			expired++
+		}
+	}
+
+	if expired > 0 {
+		scheduleMenuRefresh()
+	}
+
+	return expired, nil
+}
+
+// lockOpenOrder ล็อกออเดอร์ที่ยังไม่ปิด
+func lockOpenOrder(tx *gorm.DB, orderID string, order *models.Order) error {
+	err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(order, "id = ?", orderID).Error
+	if err != nil {
+		return err
+	}
+	if order.Status == models.OrderStatusCompleted || order.Status == models.OrderStatusCancelled {
+		return errOrderClosed
+	}
+	return nil
+}
+
+// orderStatusError แปลงข้อผิดพลาดเป็น HTTP response
+// ออเดอร์ปิดแล้วหรือสต๊อกไม่พอตอบ 400 ส่วนข้อผิดพลาดจากฐานข้อมูลตอบ 500 ไม่ส่งรายละเอียดภายในกลับไป
+func orderStatusError(c *fiber.Ctx, err error) error {
+	var shortage stockShortage
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Order not found"})
+	case errors.Is(err, errOrderClosed), errors.As(err, &shortage):
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	log.Println("Order update failed:", err)
+	return c.Status(500).JSON(fiber.Map{"error": "Failed to update order"})
+}
@@ -0,0 +1,535 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetStocktakes ดึงรายการการตรวจนับสต๊อก
+func GetStocktakes(c *fiber.Ctx) error {
+	var stocktakes []models.Stocktake
+
+	query := database.DB.Model(&models.Stocktake{})
+	if status := c.Query("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	result := query.Order("started_at DESC").Find(&stocktakes)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(stocktakes)
+}
+
+// GetStocktake ดึงการตรวจนับพร้อมรายการและยอดนับของแต่ละคน
+func GetStocktake(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var stocktake models.Stocktake
+	result := database.DB.Preload("Lines.Ingredient").Preload("Lines.Counts").First(&stocktake, "id = ?", id)
+	if result.Error != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Stocktake not found"})
+	}
+
+	return c.JSON(stocktake)
+}
+
+// StartStocktake เริ่มตรวจนับ บันทึกยอดตามระบบและต้นทุนต่อหน่วยของวัตถุดิบ ณ เวลาเริ่ม
+func StartStocktake(c *fiber.Ctx) error {
+	var request struct {
+		IngredientIDs []string `json:"ingredient_ids"` // ไม่ระบุ = นับทุกรายการ
+		StartedBy     *string  `json:"started_by"`
+		Notes         *string  `json:"notes"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	var stocktake models.Stocktake
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		query := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Order("name ASC")
+		if len(request.IngredientIDs) > 0 {
+			query = query.Where("id IN ?", request.IngredientIDs)
+		}
+
+		var ingredients []models.Ingredient
+		if err := query.Find(&ingredients).Error; err != nil {
+			return err
+		}
+		if len(ingredients) == 0 {
+			return invalidStocktake("no ingredients to count")
+		}
+		if len(request.IngredientIDs) > 0 && len(ingredients) != len(request.IngredientIDs) {
+			return invalidStocktake("some ingredients were not found")
+		}
+
+		ids := make([]string, 0, len(ingredients))
+		for _, ingredient := range ingredients {
+			ids = append(ids, ingredient.ID)
+		}
+
+		// วัตถุดิบหนึ่งรายการนับได้ทีละรอบ ไม่อย่างนั้นส่วนต่างจะถูกบันทึกซ้ำ
+		var open int64
+		err := tx.Model(&models.StocktakeLine{}).
+			Joins("JOIN stocktakes ON stocktakes.id = stocktake_lines.stocktake_id").
+			Where("stocktakes.status = ? AND stocktakes.deleted_at IS NULL AND stocktake_lines.ingredient_id IN ?", models.StocktakeStatusOpen, ids).
+			Count(&open).Error
+		if err != nil {
+			return err
+		}
+		if open > 0 {
+			return invalidStocktake("some ingredients are already in an open stocktake")
+		}
+
+		number, err := nextDocumentNumber(tx, "ST", &models.Stocktake{}, time.Now())
+		if err != nil {
+			return err
+		}
+
+		stocktake = models.Stocktake{
+			StocktakeNumber: number,
+			Status:          models.StocktakeStatusOpen,
+			StartedAt:       time.Now(),
+			StartedBy:       request.StartedBy,
+			Notes:           request.Notes,
+		}
+		if err := tx.Create(&stocktake).Error; err != nil {
+			return err
+		}
+
+		for _, ingredient := range ingredients {
+			line := models.StocktakeLine{
+				StocktakeID:      stocktake.ID,
+				IngredientID:     ingredient.ID,
+				ExpectedQuantity: ingredient.CurrentStock,
+				UnitCost:         ingredient.CostPerUnit,
+			}
+			if err := tx.Create(&line).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stocktakeError(c, err)
+	}
+
+	database.DB.Preload("Lines.Ingredient").First(&stocktake, "id = ?", stocktake.ID)
+
+	return c.Status(201).JSON(stocktake)
+}
+
+// RecordStocktakeCounts บันทึกยอดนับของผู้นับหนึ่งคน
+// ผู้นับคนเดิมส่งยอดของจุดจัดเก็บเดิมซ้ำจะแทนที่ยอดเก่า ยอดนับของรายการคือผลรวมของทุกคนทุกจุด
+func RecordStocktakeCounts(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var request struct {
+		CountedBy string `json:"counted_by"`
+		Location  string `json:"location"`
+		Counts    []struct {
+			IngredientID string  `json:"ingredient_id"`
+			Quantity     float64 `json:"quantity"`
+		} `json:"counts"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if request.CountedBy == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "counted_by is required"})
+	}
+	if len(request.Counts) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "counts are required"})
+	}
+
+	var stocktake models.Stocktake
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Lines").
+			First(&stocktake, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if stocktake.Status != models.StocktakeStatusOpen {
+			return invalidStocktake("stocktake is not open")
+		}
+
+		lines := make(map[string]*models.StocktakeLine)
+		for i := range stocktake.Lines {
+			lines[stocktake.Lines[i].IngredientID] = &stocktake.Lines[i]
+		}
+
+		now := time.Now()
+		for _, input := range request.Counts {
+			line, ok := lines[input.IngredientID]
+			if !ok {
+				return invalidStocktake("ingredient %s is not part of this stocktake", input.IngredientID)
+			}
+			if input.Quantity < 0 {
+				return invalidStocktake("counted quantity must not be negative")
+			}
+
+			err := tx.Where("stocktake_line_id = ? AND counted_by = ? AND location = ?", line.ID, request.CountedBy, request.Location).
+				Delete(&models.StocktakeCount{}).Error
+			if err != nil {
+				return err
+			}
+
+			count := models.StocktakeCount{
+				StocktakeLineID: line.ID,
+				CountedBy:       request.CountedBy,
+				Location:        request.Location,
+				Quantity:        input.Quantity,
+				CountedAt:       now,
+			}
+			if err := tx.Create(&count).Error; err != nil {
+				return err
+			}
+
+			if err := refreshStocktakeLine(tx, line); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return stocktakeError(c, err)
+	}
+
+	database.DB.Preload("Lines.Ingredient").Preload("Lines.Counts").First(&stocktake, "id = ?", id)
+
+	return c.JSON(stocktake)
+}
+
+// PostStocktake ปิดการตรวจนับ บันทึกส่วนต่างเป็น StockMovement ADJUST พร้อมต้นทุน
+// บันทึกเป็นส่วนต่างจากยอดตอนเริ่มนับ ยอดขายระหว่างนับจึงไม่ถูกนับซ้ำ รายการที่ยังไม่ได้นับจะไม่ถูกปรับ
+func PostStocktake(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var request struct {
+		PostedBy *string `json:"posted_by"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	var stocktake models.Stocktake
+	var movements []models.StockMovement
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Lines").
+			First(&stocktake, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if stocktake.Status != models.StocktakeStatusOpen {
+			return invalidStocktake("stocktake is not open")
+		}
+
+		ingredientIDs := make([]string, 0, len(stocktake.Lines))
+		for _, line := range stocktake.Lines {
+			if line.VarianceQuantity != nil && *line.VarianceQuantity != 0 {
+				ingredientIDs = append(ingredientIDs, line.IngredientID)
+			}
+		}
+		if err := lockIngredients(tx, ingredientIDs); err != nil {
+			return err
+		}
+
+		reason := fmt.Sprintf("ตรวจนับสต๊อก %s", stocktake.StocktakeNumber)
+		for _, line := range stocktake.Lines {
+			if line.VarianceQuantity == nil || *line.VarianceQuantity == 0 {
+				continue
+			}
+			variance := *line.VarianceQuantity
+
+			ingredient, err := lockIngredient(tx, line.IngredientID)
+			if err != nil {
+				return err
+			}
+
+			var movement *models.StockMovement
+			if variance < 0 {
+				movement, err = issueStock(tx, ingredient, models.StockMovementTypeAdjust, stockEntry{
+					Quantity:  -variance,
+					Reason:    &reason,
+					Reference: &stocktake.ID,
+				})
+			} else {
+				movement, err = receiveStock(tx, ingredient, models.StockMovementTypeAdjust, stockEntry{
+					Quantity:  variance,
+					Reason:    &reason,
+					Reference: &stocktake.ID,
+				})
+			}
+			if errors.Is(err, errInsufficientStock) {
+				return invalidStocktake("%s: unreserved stock is lower than the counted shortage, complete or cancel open orders and recount before posting", ingredient.Name)
+			}
+			if err != nil {
+				return err
+			}
+			movements = append(movements, *movement)
+
+			// มูลค่าส่วนต่างใช้ต้นทุนจริงที่บันทึกในการเคลื่อนไหว
+			value := roundCost(*movement.TotalCost)
+			if variance < 0 {
+				value = -value
+			}
+			err = tx.Model(&models.StocktakeLine{}).Where("id = ?", line.ID).Updates(map[string]interface{}{
+				"movement_id":    movement.ID,
+				"variance_value": value,
+			}).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&stocktake).Updates(map[string]interface{}{
+			"status":    models.StocktakeStatusPosted,
+			"posted_at": time.Now(),
+			"posted_by": request.PostedBy,
+		}).Error
+	})
+	if err != nil {
+		return stocktakeError(c, err)
+	}
+
+	scheduleMenuRefresh()
+
+	database.DB.Preload("Lines.Ingredient").Preload("Lines.Counts").First(&stocktake, "id = ?", id)
+
+	return c.JSON(fiber.Map{
+		"stocktake": stocktake,
+		"movements": movements,
+	})
+}
+
+// CancelStocktake ยกเลิกการตรวจนับที่ยังไม่บันทึก
+func CancelStocktake(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	result := database.DB.Model(&models.Stocktake{}).
+		Where("id = ? AND status = ?", id, models.StocktakeStatusOpen).
+		Update("status", models.StocktakeStatusCancelled)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	if result.RowsAffected == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Stocktake not found or already closed"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Stocktake cancelled successfully"})
+}
+
+// GetStocktakeVariance รายงานส่วนต่างของการตรวจนับรายวัตถุดิบ เรียงตามมูลค่าส่วนต่าง
+func GetStocktakeVariance(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var stocktake models.Stocktake
+	result := database.DB.Preload("Lines.Ingredient").Preload("Lines.Counts").First(&stocktake, "id = ?", id)
+	if result.Error != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Stocktake not found"})
+	}
+
+	type varianceLine struct {
+		IngredientID     string   `json:"ingredient_id"`
+		IngredientName   string   `json:"ingredient_name"`
+		Unit             string   `json:"unit"`
+		ExpectedQuantity float64  `json:"expected_quantity"`
+		CountedQuantity  float64  `json:"counted_quantity"`
+		VarianceQuantity float64  `json:"variance_quantity"`
+		VariancePercent  *float64 `json:"variance_percent"` // เทียบกับยอดตามระบบ (nil = ยอดตามระบบเป็นศูนย์)
+		VarianceValue    float64  `json:"variance_value"`
+		Counters         []string `json:"counters"`
+	}
+
+	lines := make([]varianceLine, 0, len(stocktake.Lines))
+	uncounted := make([]string, 0)
+	shrinkage := 0.0
+	overage := 0.0
+	exact := 0
+
+	for _, line := range stocktake.Lines {
+		if line.CountedQuantity == nil {
+			uncounted = append(uncounted, line.Ingredient.Name)
+			continue
+		}
+
+		row := varianceLine{
+			IngredientID:     line.IngredientID,
+			IngredientName:   line.Ingredient.Name,
+			Unit:             line.Ingredient.Unit,
+			ExpectedQuantity: line.ExpectedQuantity,
+			CountedQuantity:  *line.CountedQuantity,
+			Counters:         make([]string, 0, len(line.Counts)),
+		}
+		if line.VarianceQuantity != nil {
+			row.VarianceQuantity = *line.VarianceQuantity
+		}
+		if line.VarianceValue != nil {
+			row.VarianceValue = *line.VarianceValue
+		}
+		if line.ExpectedQuantity != 0 {
+			percent := math.Round(row.VarianceQuantity/line.ExpectedQuantity*10000) / 100
+			row.VariancePercent = &percent
+		}
+
+		seen := make(map[string]bool)
+		for _, count := range line.Counts {
+			if !seen[count.CountedBy] {
+				seen[count.CountedBy] = true
+				row.Counters = append(row.Counters, count.CountedBy)
+			}
+		}
+
+		switch {
+		case row.VarianceValue < 0:
+			shrinkage += -row.VarianceValue
+		case row.VarianceValue > 0:
+			overage += row.VarianceValue
+		}
+		if row.VarianceQuantity == 0 {
+			exact++
+		}
+
+		lines = append(lines, row)
+	}
+
+	if c.Query("sort") == "quantity" {
+		sort.Slice(lines, func(i, j int) bool {
+			return math.Abs(lines[i].VarianceQuantity) > math.Abs(lines[j].VarianceQuantity)
+		})
+	} else {
+		sort.Slice(lines, func(i, j int) bool {
+			return math.Abs(lines[i].VarianceValue) > math.Abs(lines[j].VarianceValue)
+		})
+	}
+
+	accuracy := 0.0
+	if len(lines) > 0 {
+		accuracy = math.Round(float64(exact)/float64(len(lines))*10000) / 100
+	}
+
+	return c.JSON(fiber.Map{
+		"stocktake_id":     stocktake.ID,
+		"stocktake_number": stocktake.StocktakeNumber,
+		"status":           stocktake.Status,
+		"started_at":       stocktake.StartedAt,
+		"posted_at":        stocktake.PostedAt,
+		"shrinkage_value":  roundBaht(shrinkage),
+		"overage_value":    roundBaht(overage),
+		"net_value":        roundBaht(overage - shrinkage),
+		"accuracy_percent": accuracy,
+		"counted_lines":    len(lines),
+		"uncounted":        uncounted,
+		"lines":            lines,
+	})
+}
+
+// GetStocktakeVarianceSummary สรุปส่วนต่างจากการตรวจนับที่บันทึกแล้วในช่วงเวลา แยกตามวัตถุดิบ
+func GetStocktakeVarianceSummary(c *fiber.Ctx) error {
+	since := time.Now().AddDate(0, 0, -c.QueryInt("days", 90))
+
+	var rows []struct {
+		IngredientID     string  `json:"ingredient_id"`
+		IngredientName   string  `json:"ingredient_name"`
+		Unit             string  `json:"unit"`
+		Stocktakes       int     `json:"stocktakes"`
+		VarianceQuantity float64 `json:"variance_quantity"`
+		VarianceValue    float64 `json:"variance_value"`
+	}
+
+	result := database.DB.Raw(`
+		SELECT
+			i.id as ingredient_id,
+			i.name as ingredient_name,
+			i.unit as unit,
+			COUNT(sl.id) as stocktakes,
+			COALESCE(SUM(sl.variance_quantity), 0) as variance_quantity,
+			COALESCE(SUM(sl.variance_value), 0) as variance_value
+		FROM stocktake_lines sl
+		JOIN stocktakes s ON s.id = sl.stocktake_id
+		JOIN ingredients i ON i.id = sl.ingredient_id
+		WHERE s.status = ? AND s.posted_at >= ? AND sl.counted_quantity IS NOT NULL
+			AND s.deleted_at IS NULL AND sl.deleted_at IS NULL
+		GROUP BY i.id, i.name, i.unit
+		ORDER BY variance_value ASC
+	`, models.StocktakeStatusPosted, since).Scan(&rows)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	net := 0.0
+	for _, row := range rows {
+		net += row.VarianceValue
+	}
+
+	return c.JSON(fiber.Map{
+		"since":       since.Format("2006-01-02"),
+		"net_value":   roundBaht(net),
+		"ingredients": rows,
+	})
+}
+
+// refreshStocktakeLine รวมยอดนับของทุกคนและคำนวณส่วนต่างของรายการใหม่
+func refreshStocktakeLine(tx *gorm.DB, line *models.StocktakeLine) error {
+	var counted float64
+	err := tx.Model(&models.StocktakeCount{}).
+		Select("COALESCE(SUM(quantity), 0)").
+		Where("stocktake_line_id = ?", line.ID).
+		Scan(&counted).Error
+	if err != nil {
+		return err
+	}
+
+	variance := roundCost(counted - line.ExpectedQuantity)
+	value := roundCost(variance * line.UnitCost)
+
+	line.CountedQuantity = &counted
+	line.VarianceQuantity = &variance
+	line.VarianceValue = &value
+
+	return tx.Model(&models.StocktakeLine{}).Where("id = ?", line.ID).Updates(map[string]interface{}{
+		"counted_quantity":  counted,
+		"variance_quantity": variance,
+		"variance_value":    value,
+	}).Error
+}
+
+// stocktakeError แปลงข้อผิดพลาดเป็น HTTP response
+// ข้อมูลหรือสถานะไม่ถูกต้องตอบ 400 ส่วนข้อผิดพลาดจากฐานข้อมูลตอบ 500
+func stocktakeError(c *fiber.Ctx, err error) error {
+	var invalid stocktakeInvalid
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Stocktake not found"})
+	case errors.As(err, &invalid):
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	log.Println("Stocktake failed:", err)
+	return c.Status(500).JSON(fiber.Map{"error": "Failed to update stocktake"})
+}
+
+// stocktakeInvalid ข้อผิดพลาดจากข้อมูลที่ส่งมาหรือสถานะของการตรวจนับ ตอบกลับเป็น 400
+type stocktakeInvalid string
+
+func (e stocktakeInvalid) Error() string {
+	return string(e)
+}
+
+func invalidStocktake(format string, args ...interface{}) error {
+	return stocktakeInvalid(fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// GetSuppliers ดึงรายชื่อผู้จำหน่าย
+func GetSuppliers(c *fiber.Ctx) error {
+	var suppliers []models.Supplier
+
+	query := database.DB.Model(&models.Supplier{})
+	if !c.QueryBool("include_inactive", false) {
+		query = query.Where("is_active = ?", true)
+	}
+
+	result := query.Order("name ASC").Find(&suppliers)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(suppliers)
+}
+
+// CreateSupplier เพิ่มผู้จำหน่าย
+func CreateSupplier(c *fiber.Ctx) error {
+	var supplier models.Supplier
+
+	if err := c.BodyParser(&supplier); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if supplier.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "name is required"})
+	}
+	if supplier.LeadTimeDays < 0 || supplier.PaymentTermDays < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "lead_time_days and payment_term_days must not be negative"})
+	}
+
+	result := database.DB.Create(&supplier)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.Status(201).JSON(supplier)
+}
+
+// UpdateSupplier แก้ไขข้อมูลผู้จำหน่าย
+func UpdateSupplier(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var supplier models.Supplier
+	if err := database.DB.First(&supplier, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Supplier not found"})
+	}
+
+	if err := c.BodyParser(&supplier); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	supplier.ID = id
+
+	if supplier.Name == "" {
+		return c.Status(400).JSON(fiber.Map{"error": "name is required"})
+	}
+	if supplier.LeadTimeDays < 0 || supplier.PaymentTermDays < 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "lead_time_days and payment_term_days must not be negative"})
+	}
+
+	if err := database.DB.Save(&supplier).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(supplier)
+}
+
+// DeactivateSupplier ปิดการใช้งานผู้จำหน่าย (ไม่ลบเพื่อเก็บประวัติการสั่งซื้อ)
+func DeactivateSupplier(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	result := database.DB.Model(&models.Supplier{}).Where("id = ?", id).Update("is_active", false)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	if result.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Supplier not found"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Supplier deactivated successfully"})
+}
+
+// GetSupplierPrices ดึงรายการราคาของผู้จำหน่าย
+func GetSupplierPrices(c *fiber.Ctx) error {
+	supplierID := c.Params("id")
+
+	query := database.DB.Preload("Ingredient").Where("supplier_id = ?", supplierID)
+	if !c.QueryBool("include_history", false) {
+		query = query.Where("is_active = ?", true)
+	}
+
+	var prices []models.SupplierPrice
+	result := query.Order("effective_date DESC").Find(&prices)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(prices)
+}
+
+// SetSupplierPrice กำหนดราคาวัตถุดิบของผู้จำหน่าย ราคาเดิมของวัตถุดิบเดียวกันจะถูกปิดไว้เป็นประวัติ
+func SetSupplierPrice(c *fiber.Ctx) error {
+	supplierID := c.Params("id")
+
+	var request struct {
+		IngredientID     string   `json:"ingredient_id"`
+		UnitPrice        float64  `json:"unit_price"`
+		MinOrderQuantity *float64 `json:"min_order_quantity"`
+		Unit             *string  `json:"unit"` // หน่วยของราคาและจำนวนสั่งขั้นต่ำ (ไม่ระบุ = หน่วยสต๊อก)
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if request.UnitPrice <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "unit_price must be positive"})
+	}
+
+	var supplier models.Supplier
+	if err := database.DB.First(&supplier, "id = ?", supplierID).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Supplier not found"})
+	}
+
+	var ingredient models.Ingredient
+	if err := database.DB.First(&ingredient, "id = ?", request.IngredientID).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Ingredient not found"})
+	}
+
+	if _, err := unitFactor(database.DB, &ingredient, request.Unit); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	price := models.SupplierPrice{
+		SupplierID:       supplierID,
+		IngredientID:     request.IngredientID,
+		UnitPrice:        request.UnitPrice,
+		MinOrderQuantity: request.MinOrderQuantity,
+		Unit:             normalizeUnit(&ingredient, request.Unit),
+		EffectiveDate:    time.Now(),
+		IsActive:         true,
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&models.SupplierPrice{}).
+			Where("supplier_id = ? AND ingredient_id = ? AND is_active = ?", supplierID, request.IngredientID, true).
+			Update("is_active", false).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(&price).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(201).JSON(price)
+}
+
+// activeSupplierPrice ราคาปัจจุบันของวัตถุดิบจากผู้จำหน่าย
+func activeSupplierPrice(db *gorm.DB, supplierID, ingredientID string) (*models.SupplierPrice, error) {
+	var price models.SupplierPrice
+	err := db.Where("supplier_id = ? AND ingredient_id = ? AND is_active = ?", supplierID, ingredientID, true).
+		Order("effective_date DESC").
+		First(&price).Error
+	if err != nil {
+		return nil, err
+	}
+	return &price, nil
+}
@@ -0,0 +1,394 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"errors"
+	"fmt"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+var errUnitConversion = errors.New("unit conversion not found")
+
+// GetUnits ดึงทะเบียนหน่วยวัด
+func GetUnits(c *fiber.Ctx) error {
+	var units []models.UnitOfMeasure
+
+	query := database.DB.Model(&models.UnitOfMeasure{})
+	if dimension := c.Query("dimension"); dimension != "" {
+		query = query.Where("dimension = ?", dimension)
+	}
+
+	result := query.Order("dimension ASC, to_base ASC").Find(&units)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(units)
+}
+
+// CreateUnit เพิ่มหน่วยวัดในทะเบียน
+func CreateUnit(c *fiber.Ctx) error {
+	var unit models.UnitOfMeasure
+
+	if err := c.BodyParser(&unit); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if err := validateUnit(&unit); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	result := database.DB.Create(&unit)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.Status(201).JSON(unit)
+}
+
+// UpdateUnit แก้ไขหน่วยวัด
+func UpdateUnit(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var unit models.UnitOfMeasure
+	if err := database.DB.First(&unit, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Unit not found"})
+	}
+
+	current := unit
+
+	if err := c.BodyParser(&unit); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+	unit.ID = id
+
+	if err := validateUnit(&unit); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// หน่วยที่มีข้อมูลอ้างถึงอยู่ แก้ชื่อหรือการแปลงหน่วยแล้วปริมาณเดิมจะผิดหรือแปลงไม่ได้
+	if unit.Code != current.Code || unit.Name != current.Name ||
+		unit.Dimension != current.Dimension || unit.ToBase != current.ToBase {
+		used, err := unitReferences(database.DB, "", []string{current.Code, current.Name}, true)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+		}
+		if used > 0 {
+			return c.Status(409).JSON(fiber.Map{"error": "Unit is in use and cannot be changed"})
+		}
+	}
+
+	if err := database.DB.Save(&unit).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(unit)
+}
+
+// DeleteUnit ลบหน่วยวัดออกจากทะเบียน
+func DeleteUnit(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var unit models.UnitOfMeasure
+	if err := database.DB.First(&unit, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Unit not found"})
+	}
+
+	used, err := unitReferences(database.DB, "", []string{unit.Code, unit.Name}, true)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if used > 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Unit is in use and cannot be deleted"})
+	}
+
+	if err := database.DB.Delete(&unit).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"message": "Unit deleted successfully"})
+}
+
+// GetIngredientUnits ดึงหน่วยที่ใช้กับวัตถุดิบได้ พร้อมจำนวนหน่วยสต๊อกต่อหน่วย
+func GetIngredientUnits(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var ingredient models.Ingredient
+	if err := database.DB.First(&ingredient, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Ingredient not found"})
+	}
+
+	var conversions []models.IngredientUnitConversion
+	if err := database.DB.Where("ingredient_id = ?", id).Order("factor ASC").Find(&conversions).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	type unitOption struct {
+		Unit   string  `json:"unit"`
+		Factor float64 `json:"factor"` // 1 หน่วยนี้เท่ากับกี่หน่วยสต๊อก
+		Source string  `json:"source"` // STOCK, INGREDIENT, REGISTRY
+	}
+
+	options := []unitOption{{Unit: ingredient.Unit, Factor: 1, Source: "STOCK"}}
+	for _, conversion := range conversions {
+		options = append(options, unitOption{Unit: conversion.Unit, Factor: conversion.Factor, Source: "INGREDIENT"})
+	}
+
+	// หน่วยในทะเบียนที่อยู่มิติเดียวกับหน่วยสต๊อก
+	if stockUnit, err := findUnit(database.DB, ingredient.Unit); err == nil {
+		var units []models.UnitOfMeasure
+		database.DB.Where("dimension = ? AND id <> ?", stockUnit.Dimension, stockUnit.ID).Order("to_base ASC").Find(&units)
+		for _, unit := range units {
+			options = append(options, unitOption{Unit: unit.Name, Factor: unit.ToBase / stockUnit.ToBase, Source: "REGISTRY"})
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"ingredient_id": ingredient.ID,
+		"stock_unit":    ingredient.Unit,
+		"purchase_unit": ingredient.PurchaseUnit,
+		"recipe_unit":   ingredient.RecipeUnit,
+		"conversions":   conversions,
+		"units":         options,
+	})
+}
+
+// SetIngredientUnit กำหนดหน่วยเฉพาะของวัตถุดิบ ถ้ามีหน่วยชื่อเดิมอยู่แล้วจะแก้ตัวคูณ
+func SetIngredientUnit(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	var request struct {
+		Unit   string  `json:"unit"`
+		Factor float64 `json:"factor"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if request.Unit == "" || request.Factor <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "unit and a positive factor are required"})
+	}
+
+	var ingredient models.Ingredient
+	if err := database.DB.First(&ingredient, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Ingredient not found"})
+	}
+	if request.Unit == ingredient.Unit {
+		return c.Status(400).JSON(fiber.Map{"error": "unit is already the stock unit"})
+	}
+
+	var conversion models.IngredientUnitConversion
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("ingredient_id = ? AND unit = ?", id, request.Unit).First(&conversion).Error
+		if err == gorm.ErrRecordNotFound {
+			conversion = models.IngredientUnitConversion{IngredientID: id, Unit: request.Unit, Factor: request.Factor}
+			if err := tx.Create(&conversion).Error; err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else if err := tx.Model(&conversion).Update("factor", request.Factor).Error; err != nil {
+			return err
+		}
+
+		// ต้นทุนตามสูตรที่ใช้หน่วยนี้เปลี่ยนตาม
+		return recomputeRecipeCostsForIngredient(tx, id)
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(conversion)
+}
+
+// DeleteIngredientUnit ลบหน่วยเฉพาะของวัตถุดิบ
+func DeleteIngredientUnit(c *fiber.Ctx) error {
+	id := c.Params("id")
+	conversionID := c.Params("conversion_id")
+
+	var conversion models.IngredientUnitConversion
+	if err := database.DB.First(&conversion, "id = ? AND ingredient_id = ?", conversionID, id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Unit conversion not found"})
+	}
+
+	// หน่วยที่ยังมีข้อมูลอ้างถึงลบไม่ได้ ไม่อย่างนั้นจะแปลงหน่วยไม่ได้ตอนตัดหรือรับสต๊อก
+	used, err := unitReferences(database.DB, id, []string{conversion.Unit}, false)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+	if used > 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Unit is in use and cannot be deleted"})
+	}
+
+	if err := database.DB.Delete(&conversion).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{"message": "Unit conversion deleted successfully"})
+}
+
+// ConvertIngredientQuantity แปลงปริมาณของวัตถุดิบระหว่างหน่วย
+func ConvertIngredientQuantity(c *fiber.Ctx) error {
+	id := c.Params("id")
+
+	quantity := c.QueryFloat("quantity", 1)
+	from := c.Query("from")
+	to := c.Query("to")
+
+	var ingredient models.Ingredient
+	if err := database.DB.First(&ingredient, "id = ?", id).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Ingredient not found"})
+	}
+
+	fromFactor, err := unitFactor(database.DB, &ingredient, &from)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	toFactor, err := unitFactor(database.DB, &ingredient, &to)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"quantity":   quantity,
+		"from":       unitName(&ingredient, &from),
+		"to":         unitName(&ingredient, &to),
+		"result":     roundCost(quantity * fromFactor / toFactor),
+		"in_stock":   roundCost(quantity * fromFactor),
+		"stock_unit": ingredient.Unit,
+	})
+}
+
+// unitFactor จำนวนหน่วยสต๊อกต่อ 1 หน่วยที่ระบุ
+// ใช้หน่วยเฉพาะของวัตถุดิบก่อน แล้วจึงแปลงผ่านทะเบียนหน่วยถ้าอยู่มิติเดียวกัน
+func unitFactor(db *gorm.DB, ingredient *models.Ingredient, unit *string) (float64, error) {
+	if unit == nil || *unit == "" || *unit == ingredient.Unit {
+		return 1, nil
+	}
+
+	var conversion models.IngredientUnitConversion
+	err := db.Where("ingredient_id = ? AND unit = ?", ingredient.ID, *unit).First(&conversion).Error
+	if err == nil {
+		return conversion.Factor, nil
+	}
+	if err != gorm.ErrRecordNotFound {
+		return 0, err
+	}
+
+	from, fromErr := findUnit(db, *unit)
+	to, toErr := findUnit(db, ingredient.Unit)
+	if fromErr != nil || toErr != nil || from.Dimension != to.Dimension {
+		return 0, fmt.Errorf("%w: %s to %s for %s", errUnitConversion, *unit, ingredient.Unit, ingredient.Name)
+	}
+
+	return from.ToBase / to.ToBase, nil
+}
+
+// unitReferences นับข้อมูลที่อ้างถึงหน่วย ได้แก่ สูตรขาย สูตรทุกเวอร์ชัน สูตรผลิต ใบสั่งซื้อ ราคาผู้จำหน่าย
+// และหน่วยสั่งซื้อ/หน่วยในสูตรของวัตถุดิบ ingredientID ว่างหมายถึงทุกวัตถุดิบ
+// includeStockUnit นับวัตถุดิบที่ใช้หน่วยนี้เป็นหน่วยสต๊อกด้วย (หน่วยในทะเบียน)
+func unitReferences(db *gorm.DB, ingredientID string, units []string, includeStockUnit bool) (int64, error) {
+	type unitReference struct {
+		model  interface{}
+		column string // คอลัมน์ที่อ้างถึงวัตถุดิบ
+		where  string
+	}
+	references := []unitReference{
+		{&models.RecipeIngredient{}, "ingredient_id", "unit IN ?"},
+		{&models.RecipeVersionIngredient{}, "ingredient_id", "unit IN ?"},
+		{&models.PrepRecipeComponent{}, "ingredient_id", "unit IN ?"},
+		{&models.PurchaseOrderLine{}, "ingredient_id", "unit IN ?"},
+		{&models.SupplierPrice{}, "ingredient_id", "unit IN ?"},
+		{&models.Ingredient{}, "id", "purchase_unit IN ?"},
+		{&models.Ingredient{}, "id", "recipe_unit IN ?"},
+	}
+	if includeStockUnit {
+		references = append(references, unitReference{&models.Ingredient{}, "id", "unit IN ?"})
+	}
+
+	var total int64
+	for _, reference := range references {
+		query := db.Model(reference.model).Where(reference.where, units)
+		if ingredientID != "" {
+			query = query.Where(reference.column+" = ?", ingredientID)
+		}
+
+		var count int64
+		if err := query.Count(&count).Error; err != nil {
+			return 0, err
+		}
+		total += count
+	}
+
+	return total, nil
+}
+
+// toStockQuantity แปลงปริมาณเป็นหน่วยสต๊อกของวัตถุดิบ
+func toStockQuantity(db *gorm.DB, ingredient *models.Ingredient, quantity float64, unit *string) (float64, error) {
+	factor, err := unitFactor(db, ingredient, unit)
+	if err != nil {
+		return 0, err
+	}
+	return quantity * factor, nil
+}
+
+// recipeIngredientUnit หน่วยของวัตถุดิบในสูตร ไม่ระบุใช้หน่วยในสูตรของวัตถุดิบ
+// ตรวจว่าแปลงเป็นหน่วยสต๊อกได้ตั้งแต่ตอนบันทึกสูตร
+func recipeIngredientUnit(tx *gorm.DB, ingredientID string, unit *string) (*string, error) {
+	var ingredient models.Ingredient
+	if err := tx.First(&ingredient, "id = ?", ingredientID).Error; err != nil {
+		return nil, fmt.Errorf("ingredient %s not found", ingredientID)
+	}
+
+	if unit == nil || *unit == "" {
+		unit = ingredient.RecipeUnit
+	}
+	if _, err := unitFactor(tx, &ingredient, unit); err != nil {
+		return nil, err
+	}
+	return normalizeUnit(&ingredient, unit), nil
+}
+
+// normalizeUnit คืน nil ถ้าเป็นหน่วยสต๊อก เพื่อให้ข้อมูลที่ไม่ระบุหน่วยกับระบุหน่วยสต๊อกมีความหมายเดียวกัน
+func normalizeUnit(ingredient *models.Ingredient, unit *string) *string {
+	if unit == nil || *unit == "" || *unit == ingredient.Unit {
+		return nil
+	}
+	return unit
+}
+
+// findUnit หาหน่วยในทะเบียนจากรหัสหรือชื่อ
+func findUnit(db *gorm.DB, unit string) (*models.UnitOfMeasure, error) {
+	var found models.UnitOfMeasure
+	if err := db.Where("code = ? OR name = ?", unit, unit).First(&found).Error; err != nil {
+		return nil, err
+	}
+	return &found, nil
+}
+
+// unitName ชื่อหน่วยที่แสดง ถ้าไม่ระบุคือหน่วยสต๊อก
+func unitName(ingredient *models.Ingredient, unit *string) string {
+	if unit == nil || *unit == "" {
+		return ingredient.Unit
+	}
+	return *unit
+}
+
+// validateUnit ตรวจข้อมูลหน่วยวัด
+func validateUnit(unit *models.UnitOfMeasure) error {
+	if unit.Code == "" || unit.Name == "" {
+		return fmt.Errorf("code and name are required")
+	}
+	if unit.ToBase <= 0 {
+		return fmt.Errorf("to_base must be positive")
+	}
+	switch unit.Dimension {
+	case models.UnitDimensionMass, models.UnitDimensionVolume, models.UnitDimensionCount:
+		return nil
+	}
+	return fmt.Errorf("Invalid dimension")
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// usageVariance ปริมาณใช้ตามสูตรเทียบกับที่ใช้จริงของวัตถุดิบหนึ่งรายการ
+type usageVariance struct {
+	IngredientID        string     `json:"ingredient_id"`
+	IngredientName      string     `json:"ingredient_name"`
+	Unit                string     `json:"unit"`
+	TheoreticalQuantity float64    `json:"theoretical_quantity"` // ยอดขาย x ปริมาณตามสูตร
+	SoldQuantity        float64    `json:"sold_quantity"`        // ตัดสต๊อกตอนขาย (OUT)
+	WasteQuantity       float64    `json:"waste_quantity"`       // บันทึกของเสีย (WASTE)
+	ProductionQuantity  float64    `json:"production_quantity"`  // ใช้ผลิตวัตถุดิบกึ่งสำเร็จรูป (PRODUCTION_OUT)
+	AdjustedQuantity    float64    `json:"adjusted_quantity"`    // ส่วนที่หายจากการปรับยอด/ตรวจนับ (บวก = หาย)
+	ActualQuantity      float64    `json:"actual_quantity"`      // ขาย + ของเสีย + ผลิต + ส่วนที่หาย
+	VarianceQuantity    float64    `json:"variance_quantity"`    // ใช้จริง - ตามสูตร (บวก = ใช้เกิน)
+	VariancePercent     *float64   `json:"variance_percent"`
+	TheoreticalValue    float64    `json:"theoretical_value"`
+	ActualValue         float64    `json:"actual_value"`
+	VarianceValue       float64    `json:"variance_value"`
+	LastCountedAt       *time.Time `json:"last_counted_at"`
+	CountedInPeriod     bool       `json:"counted_in_period"` // ไม่มีการตรวจนับในช่วง = ส่วนที่หายอาจยังไม่ปรากฏ
+	Flagged             bool       `json:"flagged"`
+}
+
+// GetUsageVarianceReport เปรียบเทียบปริมาณใช้ตามสูตรกับที่ใช้จริงต่อวัตถุดิบในช่วงเวลา
+// ใช้จริงคิดจาก StockMovement ที่ตัดออกทุกประเภท ส่วนต่างจากการตรวจนับจึงรวมอยู่ด้วย
+func GetUsageVarianceReport(c *fiber.Ctx) error {
+	startDate, endDate, err := parseReportPeriod(c, 7)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	threshold := c.QueryFloat("threshold", 5)
+
+	var ingredients []models.Ingredient
+	if err := database.DB.Order("name ASC").Find(&ingredients).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	rows := make(map[string]*usageVariance)
+	byID := make(map[string]*models.Ingredient)
+	for i := range ingredients {
+		byID[ingredients[i].ID] = &ingredients[i]
+		rows[ingredients[i].ID] = &usageVariance{
+			IngredientID:   ingredients[i].ID,
+			IngredientName: ingredients[i].Name,
+			Unit:           ingredients[i].Unit,
+		}
+	}
+
+	// ปริมาณตามสูตร: ยอดขายที่ไม่ถูกยกเลิก x ปริมาณในสูตรเวอร์ชันที่ใช้ตอนขาย
+	// ออเดอร์ก่อนมีระบบเวอร์ชันใช้สูตรปัจจุบันแทน
+	var theoretical []struct {
+		IngredientID string
+		Unit         *string
+		Quantity     float64
+	}
+	result := database.DB.Raw(`
+		SELECT
+			vi.ingredient_id as ingredient_id,
+			vi.unit as unit,
+			COALESCE(SUM(oi.quantity * vi.quantity), 0) as quantity
+		FROM orders o
+		JOIN order_items oi ON oi.order_id = o.id AND oi.deleted_at IS NULL
+		JOIN recipe_version_ingredients vi ON vi.recipe_version_id = oi.recipe_version_id AND vi.deleted_at IS NULL
+		WHERE o.created_at >= ? AND o.created_at < ? AND o.status <> ? AND o.deleted_at IS NULL
+		GROUP BY vi.ingredient_id, vi.unit
+		UNION ALL
+		SELECT
+			ri.ingredient_id as ingredient_id,
+			ri.unit as unit,
+			COALESCE(SUM(oi.quantity * ri.quantity), 0) as quantity
+		FROM orders o
+		JOIN order_items oi ON oi.order_id = o.id AND oi.deleted_at IS NULL AND oi.recipe_version_id IS NULL
+		JOIN recipes r ON r.product_id = oi.product_id AND r.deleted_at IS NULL
+		JOIN recipe_ingredients ri ON ri.recipe_id = r.id AND ri.deleted_at IS NULL
+		WHERE o.created_at >= ? AND o.created_at < ? AND o.status <> ? AND o.deleted_at IS NULL
+		GROUP BY ri.ingredient_id, ri.unit
+	`, startDate, endDate, models.OrderStatusCancelled,
+		startDate, endDate, models.OrderStatusCancelled).Scan(&theoretical)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	for _, item := range theoretical {
+		ingredient, ok := byID[item.IngredientID]
+		if !ok {
+			continue
+		}
+		quantity, err := toStockQuantity(database.DB, ingredient, item.Quantity, item.Unit)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+		}
+		rows[item.IngredientID].TheoreticalQuantity += quantity
+	}
+
+	// ใช้จริงจากการเคลื่อนไหวสต๊อก ADJUST บันทึกเป็นส่วนต่าง มูลค่าจึงต้องใส่เครื่องหมายตามจำนวน
+	var movements []struct {
+		IngredientID string
+		Type         models.StockMovementType
+		Quantity     float64
+		TotalCost    float64
+	}
+	result = database.DB.Raw(`
+		SELECT
+			ingredient_id,
+			type,
+			COALESCE(SUM(quantity), 0) as quantity,
+			COALESCE(SUM(CASE WHEN quantity < 0 THEN -total_cost ELSE total_cost END), 0) as total_cost
+		FROM stock_movements
+		WHERE type IN ? AND created_at >= ? AND created_at < ? AND deleted_at IS NULL
+		GROUP BY ingredient_id, type
+	`, []models.StockMovementType{
+		models.StockMovementTypeOut,
+		models.StockMovementTypeWaste,
+		models.StockMovementTypeProductionOut,
+		models.StockMovementTypeAdjust,
+	}, startDate, endDate).Scan(&movements)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	for _, movement := range movements {
+		row, ok := rows[movement.IngredientID]
+		if !ok {
+			continue
+		}
+		switch movement.Type {
+		case models.StockMovementTypeOut:
+			row.SoldQuantity += movement.Quantity
+			row.ActualValue += movement.TotalCost
+		case models.StockMovementTypeWaste:
+			row.WasteQuantity += movement.Quantity
+			row.ActualValue += movement.TotalCost
+		case models.StockMovementTypeProductionOut:
+			// การผลิตตัดตามสูตรผลิตอยู่แล้ว นับเป็นทั้งปริมาณตามสูตรและที่ใช้จริง
+			row.ProductionQuantity += movement.Quantity
+			row.TheoreticalQuantity += movement.Quantity
+			row.ActualValue += movement.TotalCost
+		case models.StockMovementTypeAdjust:
+			row.AdjustedQuantity -= movement.Quantity
+			row.ActualValue -= movement.TotalCost
+		}
+	}
+
+	// การตรวจนับล่าสุดของแต่ละวัตถุดิบ
+	var counts []struct {
+		IngredientID   string
+		PostedAt       time.Time
+		CountsInPeriod int
+	}
+	result = database.DB.Raw(`
+		SELECT
+			sl.ingredient_id as ingredient_id,
+			MAX(s.posted_at) as posted_at,
+			SUM(CASE WHEN s.posted_at >= ? AND s.posted_at < ? THEN 1 ELSE 0 END) as counts_in_period
+		FROM stocktake_lines sl
+		JOIN stocktakes s ON s.id = sl.stocktake_id
+		WHERE s.status = ? AND sl.counted_quantity IS NOT NULL
+			AND s.deleted_at IS NULL AND sl.deleted_at IS NULL
+		GROUP BY sl.ingredient_id
+	`, startDate, endDate, models.StocktakeStatusPosted).Scan(&counts)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	for _, count := range counts {
+		if row, ok := rows[count.IngredientID]; ok {
+			postedAt := count.PostedAt
+			row.LastCountedAt = &postedAt
+			row.CountedInPeriod = count.CountsInPeriod > 0
+		}
+	}
+
+	report := make([]usageVariance, 0, len(rows))
+	totals := struct {
+		TheoreticalValue float64 `json:"theoretical_value"`
+		ActualValue      float64 `json:"actual_value"`
+		VarianceValue    float64 `json:"variance_value"`
+		WasteValue       float64 `json:"waste_value"`
+	}{}
+
+	for _, ingredient := range ingredients {
+		row := rows[ingredient.ID]
+		if row.TheoreticalQuantity == 0 && row.SoldQuantity == 0 && row.WasteQuantity == 0 && row.ProductionQuantity == 0 && row.AdjustedQuantity == 0 {
+			continue
+		}
+
+		row.ActualQuantity = row.SoldQuantity + row.WasteQuantity + row.ProductionQuantity + row.AdjustedQuantity
+		row.VarianceQuantity = roundCost(row.ActualQuantity - row.TheoreticalQuantity)
+		row.TheoreticalQuantity = roundCost(row.TheoreticalQuantity)
+		row.ActualQuantity = roundCost(row.ActualQuantity)
+		row.TheoreticalValue = roundBaht(row.TheoreticalQuantity * ingredient.CostPerUnit)
+		row.ActualValue = roundBaht(row.ActualValue)
+		row.VarianceValue = roundBaht(row.ActualValue - row.TheoreticalValue)
+
+		if row.TheoreticalQuantity > 0 {
+			percent := math.Round(row.VarianceQuantity/row.TheoreticalQuantity*10000) / 100
+			row.VariancePercent = &percent
+			row.Flagged = math.Abs(percent) > threshold
+		} else {
+			// มีการใช้แต่ไม่มีสูตรรองรับ
+			row.Flagged = row.ActualQuantity > 0
+		}
+
+		totals.TheoreticalValue += row.TheoreticalValue
+		totals.ActualValue += row.ActualValue
+		totals.VarianceValue += row.VarianceValue
+		report = append(report, *row)
+	}
+
+	for _, movement := range movements {
+		if movement.Type == models.StockMovementTypeWaste {
+			totals.WasteValue += movement.TotalCost
+		}
+	}
+	totals.TheoreticalValue = roundBaht(totals.TheoreticalValue)
+	totals.ActualValue = roundBaht(totals.ActualValue)
+	totals.VarianceValue = roundBaht(totals.VarianceValue)
+	totals.WasteValue = roundBaht(totals.WasteValue)
+
+	sort.Slice(report, func(i, j int) bool {
+		return math.Abs(report[i].VarianceValue) > math.Abs(report[j].VarianceValue)
+	})
+
+	return c.JSON(fiber.Map{
+		"start_date":        startDate.Format("2006-01-02"),
+		"end_date":          endDate.Add(-time.Nanosecond).Format("2006-01-02"),
+		"threshold_percent": threshold,
+		"totals":            totals,
+		"ingredients":       report,
+	})
+}
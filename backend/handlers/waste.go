@@ -0,0 +1,386 @@
+package handlers
+
+import (
+	"coffee-pula-backend/alerts"
+	"coffee-pula-backend/database"
+	"coffee-pula-backend/models"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+)
+
+// wasteReasonLabels รหัสเหตุผลของเสียที่รองรับ พร้อมชื่อที่แสดง
+var wasteReasonLabels = map[models.WasteReason]string{
+	models.WasteReasonSpoilage:   "เสีย/หมดอายุ",
+	models.WasteReasonSpill:      "หก",
+	models.WasteReasonStaffDrink: "เครื่องดื่มพนักงาน",
+	models.WasteReasonTasting:    "ชิม/ทดสอบรสชาติ",
+	models.WasteReasonRemake:     "ทำใหม่",
+	models.WasteReasonExpired:    "ล็อตหมดอายุ",
+}
+
+// GetWasteReasons ดึงรหัสเหตุผลของเสีย
+func GetWasteReasons(c *fiber.Ctx) error {
+	reasons := make([]fiber.Map, 0, len(wasteReasonLabels))
+	for _, code := range []models.WasteReason{
+		models.WasteReasonSpoilage,
+		models.WasteReasonSpill,
+		models.WasteReasonStaffDrink,
+		models.WasteReasonTasting,
+		models.WasteReasonRemake,
+		models.WasteReasonExpired,
+	} {
+		reasons = append(reasons, fiber.Map{"code": code, "label": wasteReasonLabels[code]})
+	}
+
+	return c.JSON(reasons)
+}
+
+// GetWasteEntries ดึงรายการของเสีย
+func GetWasteEntries(c *fiber.Ctx) error {
+	startDate, endDate, err := parseReportPeriod(c, 7)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	query := database.DB.Preload("Ingredient").Preload("Product").
+		Where("wasted_at >= ? AND wasted_at < ?", startDate, endDate)
+
+	if reason := c.Query("reason"); reason != "" {
+		query = query.Where("reason = ?", reason)
+	}
+	if recordedBy := c.Query("recorded_by"); recordedBy != "" {
+		query = query.Where("recorded_by = ?", recordedBy)
+	}
+	if ingredientID := c.Query("ingredient_id"); ingredientID != "" {
+		query = query.Where("ingredient_id = ?", ingredientID)
+	}
+	if productID := c.Query("product_id"); productID != "" {
+		query = query.Where("product_id = ?", productID)
+	}
+
+	var entries []models.WasteEntry
+	result := query.Order("wasted_at DESC").Find(&entries)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(entries)
+}
+
+// CreateWasteEntry บันทึกของเสีย ตัดสต๊อกเป็น StockMovement WASTE
+// ถ้าระบุสินค้า จะตัดวัตถุดิบทุกตัวตามสูตรของสินค้า
+func CreateWasteEntry(c *fiber.Ctx) error {
+	var request struct {
+		Reason       models.WasteReason `json:"reason"`
+		IngredientID *string            `json:"ingredient_id"`
+		ProductID    *string            `json:"product_id"`
+		Quantity     float64            `json:"quantity"`
+		RecordedBy   *string            `json:"recorded_by"`
+		Notes        *string            `json:"notes"`
+	}
+
+	if err := c.BodyParser(&request); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request body"})
+	}
+
+	if _, ok := wasteReasonLabels[request.Reason]; !ok {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid waste reason"})
+	}
+	if (request.IngredientID == nil) == (request.ProductID == nil) {
+		return c.Status(400).JSON(fiber.Map{"error": "Specify either ingredient_id or product_id"})
+	}
+	if request.Quantity <= 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "quantity must be positive"})
+	}
+
+	entry := models.WasteEntry{
+		Reason:       request.Reason,
+		IngredientID: request.IngredientID,
+		ProductID:    request.ProductID,
+		Quantity:     request.Quantity,
+		RecordedBy:   request.RecordedBy,
+		Notes:        request.Notes,
+		WastedAt:     time.Now(),
+	}
+
+	var lowStock []alerts.LowStockAlert
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&entry).Error; err != nil {
+			return err
+		}
+
+		totalCost, lows, err := recordWaste(tx, &entry)
+		if err != nil {
+			return err
+		}
+		lowStock = lows
+
+		entry.TotalCost = totalCost
+		return tx.Model(&entry).Update("total_cost", totalCost).Error
+	})
+	if err != nil {
+		return wasteError(c, err)
+	}
+
+	notifyLowStock(lowStock)
+	scheduleMenuRefresh()
+
+	database.DB.Preload("Ingredient").Preload("Product").First(&entry, "id = ?", entry.ID)
+
+	return c.Status(201).JSON(entry)
+}
+
+// recordWaste ตัดสต๊อกของรายการของเสีย คืนมูลค่ารวมและวัตถุดิบที่ต่ำกว่าขั้นต่ำ
+func recordWaste(tx *gorm.DB, entry *models.WasteEntry) (float64, []alerts.LowStockAlert, error) {
+	type wasteLine struct {
+		IngredientID string
+		Quantity     float64
+		Unit         *string
+	}
+
+	var lines []wasteLine
+	label := wasteReasonLabels[entry.Reason]
+
+	if entry.ProductID != nil {
+		var product models.Product
+		if err := tx.Preload("Recipe.Ingredients").First(&product, "id = ?", *entry.ProductID).Error; err != nil {
+			return 0, nil, invalidWaste("product not found")
+		}
+		if product.Recipe == nil || len(product.Recipe.Ingredients) == 0 {
+			return 0, nil, invalidWaste("product %s has no recipe", product.Name)
+		}
+
+		label = fmt.Sprintf("%s - %s", label, product.Name)
+		for _, recipeIngredient := range product.Recipe.Ingredients {
+			lines = append(lines, wasteLine{
+				IngredientID: recipeIngredient.IngredientID,
+				Quantity:     recipeIngredient.Quantity * entry.Quantity,
+				Unit:         recipeIngredient.Unit,
+			})
+		}
+	} else {
+		lines = append(lines, wasteLine{IngredientID: *entry.IngredientID, Quantity: entry.Quantity})
+	}
+
+	reason := fmt.Sprintf("ของเสีย (%s)", label)
+	totalCost := 0.0
+	var lowStock []alerts.LowStockAlert
+
+	ingredientIDs := make([]string, 0, len(lines))
+	for _, line := range lines {
+		ingredientIDs = append(ingredientIDs, line.IngredientID)
+	}
+	if err := lockIngredients(tx, ingredientIDs); errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil, invalidWaste("ingredient not found")
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	for _, line := range lines {
+		ingredient, err := lockIngredient(tx, line.IngredientID)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		quantity, err := toStockQuantity(tx, ingredient, line.Quantity, line.Unit)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		movement, err := issueStock(tx, ingredient, models.StockMovementTypeWaste, stockEntry{
+			Quantity:  quantity,
+			Reason:    &reason,
+			Reference: &entry.ID,
+		})
+		if errors.Is(err, errInsufficientStock) {
+			return 0, nil, insufficientStockError(tx, ingredient, quantity)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		totalCost += *movement.TotalCost
+
+		if alert := lowStockAlert(ingredient, quantity, &entry.ID); alert != nil {
+			lowStock = append(lowStock, *alert)
+		}
+	}
+
+	return roundCost(totalCost), lowStock, nil
+}
+
+// GetWasteReport รายงานของเสียเป็นจำนวนและมูลค่า แยกตามเหตุผล พนักงาน วัน วัตถุดิบ และสินค้า
+func GetWasteReport(c *fiber.Ctx) error {
+	startDate, endDate, err := parseReportPeriod(c, 30)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	type reasonRow struct {
+		Reason    models.WasteReason `json:"reason"`
+		Label     string             `json:"label"`
+		Entries   int                `json:"entries"`
+		TotalCost float64            `json:"total_cost"`
+	}
+	var byReason []reasonRow
+	err = database.DB.Model(&models.WasteEntry{}).
+		Select("reason, COUNT(*) AS entries, COALESCE(SUM(total_cost), 0) AS total_cost").
+		Where("wasted_at >= ? AND wasted_at < ?", startDate, endDate).
+		Group("reason").
+		Order("total_cost DESC").
+		Scan(&byReason).Error
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	total := 0.0
+	for i := range byReason {
+		byReason[i].Label = wasteReasonLabels[byReason[i].Reason]
+		total += byReason[i].TotalCost
+	}
+
+	var byStaff []struct {
+		RecordedBy string  `json:"recorded_by"`
+		Entries    int     `json:"entries"`
+		TotalCost  float64 `json:"total_cost"`
+	}
+	err = database.DB.Model(&models.WasteEntry{}).
+		Select("COALESCE(recorded_by, '') AS recorded_by, COUNT(*) AS entries, COALESCE(SUM(total_cost), 0) AS total_cost").
+		Where("wasted_at >= ? AND wasted_at < ?", startDate, endDate).
+		Group("COALESCE(recorded_by, '')").
+		Order("total_cost DESC").
+		Scan(&byStaff).Error
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var byDay []struct {
+		Date      string  `json:"date"`
+		Entries   int     `json:"entries"`
+		TotalCost float64 `json:"total_cost"`
+	}
+	err = database.DB.Model(&models.WasteEntry{}).
+		Select("DATE(wasted_at) AS date, COUNT(*) AS entries, COALESCE(SUM(total_cost), 0) AS total_cost").
+		Where("wasted_at >= ? AND wasted_at < ?", startDate, endDate).
+		Group("DATE(wasted_at)").
+		Order("date ASC").
+		Scan(&byDay).Error
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	var byIngredient []struct {
+		Reason         string  `json:"reason"`
+		IngredientID   string  `json:"ingredient_id"`
+		IngredientName string  `json:"ingredient_name"`
+		Unit           string  `json:"unit"`
+		Quantity       float64 `json:"quantity"`
+		TotalCost      float64 `json:"total_cost"`
+	}
+	result := database.DB.Raw(`
+		SELECT
+			we.reason as reason,
+			i.id as ingredient_id,
+			i.name as ingredient_name,
+			i.unit as unit,
+			COALESCE(SUM(sm.quantity), 0) as quantity,
+			COALESCE(SUM(sm.total_cost), 0) as total_cost
+		FROM stock_movements sm
+		JOIN waste_entries we ON we.id = sm.reference
+		JOIN ingredients i ON i.id = sm.ingredient_id
+		WHERE sm.type = ? AND we.wasted_at >= ? AND we.wasted_at < ?
+			AND sm.deleted_at IS NULL AND we.deleted_at IS NULL
+		GROUP BY we.reason, i.id, i.name, i.unit
+		ORDER BY total_cost DESC
+	`, models.StockMovementTypeWaste, startDate, endDate).Scan(&byIngredient)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	var byProduct []struct {
+		ProductID   string  `json:"product_id"`
+		ProductName string  `json:"product_name"`
+		Quantity    float64 `json:"quantity"`
+		TotalCost   float64 `json:"total_cost"`
+	}
+	result = database.DB.Raw(`
+		SELECT
+			p.id as product_id,
+			p.name as product_name,
+			COALESCE(SUM(we.quantity), 0) as quantity,
+			COALESCE(SUM(we.total_cost), 0) as total_cost
+		FROM waste_entries we
+		JOIN products p ON p.id = we.product_id
+		WHERE we.wasted_at >= ? AND we.wasted_at < ? AND we.deleted_at IS NULL
+		GROUP BY p.id, p.name
+		ORDER BY total_cost DESC
+	`, startDate, endDate).Scan(&byProduct)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": result.Error.Error()})
+	}
+
+	return c.JSON(fiber.Map{
+		"start_date":    startDate.Format("2006-01-02"),
+		"end_date":      endDate.Add(-time.Nanosecond).Format("2006-01-02"),
+		"total_cost":    roundBaht(total),
+		"by_reason":     byReason,
+		"by_staff":      byStaff,
+		"by_day":        byDay,
+		"by_ingredient": byIngredient,
+		"by_product":    byProduct,
+	})
+}
+
+// parseReportPeriod อ่านช่วงเวลาของรายงานจาก start_date/end_date หรือย้อนหลัง days วัน
+// end_date รวมทั้งวัน ช่วงที่ได้จึงเป็น [start, end)
+func parseReportPeriod(c *fiber.Ctx, defaultDays int) (time.Time, time.Time, error) {
+	endDate := time.Now()
+	startDate := endDate.AddDate(0, 0, -c.QueryInt("days", defaultDays))
+
+	if start := c.Query("start_date"); start != "" {
+		parsed, err := time.Parse("2006-01-02", start)
+		if err != nil {
+			return startDate, endDate, fmt.Errorf("Invalid start_date format")
+		}
+		startDate = parsed
+	}
+	if end := c.Query("end_date"); end != "" {
+		parsed, err := time.Parse("2006-01-02", end)
+		if err != nil {
+			return startDate, endDate, fmt.Errorf("Invalid end_date format")
+		}
+		endDate = parsed.Add(24 * time.Hour)
+	}
+
+	return startDate, endDate, nil
+}
+
+// wasteError แปลงข้อผิดพลาดเป็น HTTP response
+// ข้อมูลไม่ถูกต้องหรือสต๊อกไม่พอตอบ 400 ส่วนข้อผิดพลาดจากฐานข้อมูลตอบ 500
+func wasteError(c *fiber.Ctx, err error) error {
+	var invalid wasteInvalid
+	var shortage stockShortage
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		return c.Status(404).JSON(fiber.Map{"error": "Waste entry not found"})
+	case errors.As(err, &invalid), errors.As(err, &shortage), errors.Is(err, errUnitConversion):
+		return c.Status(400).JSON(fiber.Map{"error": err.Error()})
+	}
+	log.Println("Waste entry failed:", err)
+	return c.Status(500).JSON(fiber.Map{"error": "Failed to record waste"})
+}
+
+// wasteInvalid ข้อผิดพลาดจากข้อมูลของเสียที่ส่งมา ตอบกลับเป็น 400
+type wasteInvalid string
+
+func (e wasteInvalid) Error() string {
+	return string(e)
+}
+
+func invalidWaste(format string, args ...interface{}) error {
+	return wasteInvalid(fmt.Sprintf(format, args...))
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"coffee-pula-backend/alerts"
 	"coffee-pula-backend/database"
 	"coffee-pula-backend/handlers"
+	"coffee-pula-backend/sms"
 	"log"
 
 	"github.com/gofiber/fiber/v2"
@@ -16,6 +18,17 @@ func main() {
 	database.Migrate()
 	database.Seed()
 
+	// SMS provider for member OTP
+	handlers.SetSMSProvider(sms.NewFromEnv())
+
+	// Low stock notifier for inventory alerts
+	handlers.SetStockNotifier(alerts.NewFromEnv())
+
+	// Start background jobs
+	handlers.StartLoyaltyJobs()
+	handlers.StartInventoryJobs()
+	handlers.StartRecipeJobs()
+
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
@@ -59,6 +72,8 @@ func main() {
 	// Menu routes
 	api.Get("/categories", handlers.GetCategories)
 	api.Get("/menu", handlers.GetMenu)
+	api.Get("/menu/availability", handlers.GetMenuAvailability)
+	api.Get("/menu/stream", handlers.StreamMenuAvailability)
 	api.Post("/menu", handlers.CreateProduct)
 	api.Put("/menu/:id", handlers.UpdateProduct)
 	api.Delete("/menu/:id", handlers.DeleteProduct)
@@ -66,19 +81,80 @@ func main() {
 	// Order routes
 	api.Get("/orders", handlers.GetOrders)
 	api.Post("/orders", handlers.CreateOrder)
+	api.Post("/orders/:id/complete", handlers.CompleteOrder)
+	api.Post("/orders/:id/cancel", handlers.CancelOrder)
 
 	// Inventory routes
 	inventory := api.Group("/inventory")
 	inventory.Get("/ingredients", handlers.GetIngredients)
 	inventory.Post("/ingredients", handlers.CreateIngredient)
+	inventory.Put("/ingredients/:id", handlers.UpdateIngredient)
+	inventory.Get("/ingredients/:id/units", handlers.GetIngredientUnits)
+	inventory.Post("/ingredients/:id/units", handlers.SetIngredientUnit)
+	inventory.Delete("/ingredients/:id/units/:conversion_id", handlers.DeleteIngredientUnit)
+	inventory.Get("/ingredients/:id/convert", handlers.ConvertIngredientQuantity)
+	inventory.Get("/units", handlers.GetUnits)
+	inventory.Post("/units", handlers.CreateUnit)
+	inventory.Put("/units/:id", handlers.UpdateUnit)
+	inventory.Delete("/units/:id", handlers.DeleteUnit)
 	inventory.Get("/movements", handlers.GetStockMovements)
 	inventory.Post("/adjust-stock", handlers.AdjustStock)
+	inventory.Get("/cogs", handlers.GetCOGSReport)
+	inventory.Get("/usage-variance", handlers.GetUsageVarianceReport)
+	inventory.Get("/lots", handlers.GetIngredientLots)
+	inventory.Get("/lots/expiring", handlers.GetExpiringLots)
+	inventory.Post("/lots/expire", handlers.ExpireLots)
+	inventory.Get("/reservations", handlers.GetStockReservations)
+	inventory.Get("/low-stock", handlers.GetLowStockIngredients)
+	inventory.Get("/reorder-suggestions", handlers.GetReorderSuggestions)
+	inventory.Get("/stocktakes", handlers.GetStocktakes)
+	inventory.Get("/stocktakes/variance", handlers.GetStocktakeVarianceSummary)
+	inventory.Get("/stocktakes/:id", handlers.GetStocktake)
+	inventory.Post("/stocktakes", handlers.StartStocktake)
+	inventory.Post("/stocktakes/:id/counts", handlers.RecordStocktakeCounts)
+	inventory.Post("/stocktakes/:id/post", handlers.PostStocktake)
+	inventory.Post("/stocktakes/:id/cancel", handlers.CancelStocktake)
+	inventory.Get("/stocktakes/:id/variance", handlers.GetStocktakeVariance)
+	inventory.Get("/waste", handlers.GetWasteEntries)
+	inventory.Post("/waste", handlers.CreateWasteEntry)
+	inventory.Get("/waste/reasons", handlers.GetWasteReasons)
+	inventory.Get("/waste/report", handlers.GetWasteReport)
+	inventory.Get("/prep-recipes", handlers.GetPrepRecipes)
+	inventory.Get("/prep-recipes/:ingredient_id", handlers.GetPrepRecipe)
+	inventory.Put("/prep-recipes/:ingredient_id", handlers.SavePrepRecipe)
+	inventory.Delete("/prep-recipes/:ingredient_id", handlers.DeletePrepRecipe)
+	inventory.Get("/production", handlers.GetProductionBatches)
+	inventory.Post("/production", handlers.CreateProductionBatch)
+
+	// Purchasing routes
+	purchasing := api.Group("/purchasing")
+	purchasing.Get("/suppliers", handlers.GetSuppliers)
+	purchasing.Post("/suppliers", handlers.CreateSupplier)
+	purchasing.Put("/suppliers/:id", handlers.UpdateSupplier)
+	purchasing.Delete("/suppliers/:id", handlers.DeactivateSupplier)
+	purchasing.Get("/suppliers/:id/prices", handlers.GetSupplierPrices)
+	purchasing.Post("/suppliers/:id/prices", handlers.SetSupplierPrice)
+	purchasing.Get("/orders", handlers.GetPurchaseOrders)
+	purchasing.Get("/orders/outstanding", handlers.GetOutstandingPurchaseOrders)
+	purchasing.Get("/orders/:id", handlers.GetPurchaseOrder)
+	purchasing.Post("/orders", handlers.CreatePurchaseOrder)
+	purchasing.Put("/orders/:id", handlers.UpdatePurchaseOrder)
+	purchasing.Post("/orders/:id/submit", handlers.SubmitPurchaseOrder)
+	purchasing.Post("/orders/:id/receive", handlers.ReceivePurchaseOrder)
+	purchasing.Post("/orders/:id/cancel", handlers.CancelPurchaseOrder)
 
 	// Recipe routes
 	api.Get("/recipes", handlers.GetRecipes)
 	api.Post("/recipes", handlers.CreateRecipe)
 	api.Put("/recipes/:id", handlers.UpdateRecipe)
 	api.Delete("/recipes/:id", handlers.DeleteRecipe)
+	api.Get("/recipes/:id/versions", handlers.GetRecipeVersions)
+	api.Post("/recipes/:id/versions", handlers.CreateRecipeVersion)
+	api.Get("/recipes/:id/versions/diff", handlers.GetRecipeVersionDiff)
+	api.Get("/recipes/:id/versions/:version", handlers.GetRecipeVersion)
+	api.Delete("/recipes/:id/versions/:version", handlers.DeleteRecipeVersion)
+	api.Post("/recipes/:id/versions/:version/activate", handlers.ActivateRecipeVersion)
+	api.Get("/recipes/:id/versions/:version/cost-preview", handlers.PreviewRecipeVersionCost)
 
 	// Promotion routes
 	promotions := api.Group("/promotions")
@@ -121,30 +197,75 @@ func main() {
 	// Member management
 	members := loyalty.Group("/members")
 	members.Get("/", handlers.GetMembers)
+	members.Get("/lookup", handlers.LookupMemberByPhone)
+	members.Get("/duplicates", handlers.FindDuplicateMembers)
+	members.Get("/merges", handlers.GetMemberMerges)
+	members.Post("/merge", handlers.MergeMembers)
 	members.Get("/:id", handlers.GetMemberByID)
 	members.Get("/number/:number", handlers.GetMemberByNumber)
 	members.Post("/", handlers.CreateMember)
 	members.Put("/:id", handlers.UpdateMember)
 	members.Get("/:id/history", handlers.GetPointHistory)
+	members.Get("/:id/stamp-cards", handlers.GetStampCards)
+	members.Get("/:id/stamp-history", handlers.GetStampHistory)
+	members.Get("/:id/referral", handlers.GetReferral)
+	members.Post("/:id/otp", handlers.RequestMemberOTP)
+	members.Put("/:id/consent", handlers.UpdateMemberConsent)
+	members.Get("/:id/export", handlers.ExportMemberData)
+	members.Post("/:id/erase", handlers.EraseMemberData)
 
 	// Points management
 	loyalty.Post("/earn-points", handlers.EarnPoints)
 	loyalty.Post("/redeem-points", handlers.RedeemPoints)
+	loyalty.Get("/reconcile", handlers.ReconcilePoints)
+	loyalty.Post("/reconcile", handlers.ReconcilePoints)
 
 	// Rewards
 	rewards := loyalty.Group("/rewards")
 	rewards.Get("/", handlers.GetRewards)
+	rewards.Post("/", handlers.CreateReward)
+	rewards.Put("/:id", handlers.UpdateReward)
+	rewards.Delete("/:id", handlers.DeactivateReward)
+
+	// Point rules
+	pointRules := loyalty.Group("/point-rules")
+	pointRules.Get("/", handlers.GetPointRules)
+	pointRules.Post("/", handlers.CreatePointRule)
+	pointRules.Put("/:id", handlers.UpdatePointRule)
+	pointRules.Delete("/:id", handlers.DeactivatePointRule)
+
+	// Reward fulfilment at the till
+	redemptions := loyalty.Group("/redemptions")
+	redemptions.Get("/:code", handlers.GetRedemptionByCode)
+	redemptions.Post("/apply", handlers.ApplyRedemption)
+
+	// Tier program
+	tiers := loyalty.Group("/tiers")
+	tiers.Get("/", handlers.GetTiers)
+	tiers.Post("/", handlers.CreateTier)
+	tiers.Put("/:id", handlers.UpdateTier)
+	tiers.Post("/reevaluate", handlers.ReevaluateTiers)
 
 	// Statistics
 	loyalty.Get("/stats", handlers.GetMemberStats)
 
+	// Analytics
+	analytics := loyalty.Group("/analytics")
+	analytics.Get("/rfm", handlers.GetLoyaltyRFM)
+	analytics.Get("/inactive", handlers.GetInactiveMembers)
+	analytics.Get("/point-liability", handlers.GetPointLiability)
+
 	// Cost Management routes
 	cost := api.Group("/cost")
 	cost.Get("/products", handlers.GetProductCosts)
+	cost.Get("/products/theoretical", handlers.GetTheoreticalCosts)
+	cost.Post("/products/recompute", handlers.RecomputeRecipeCosts)
 	cost.Put("/products/:product_id", handlers.UpdateProductCost)
+	cost.Post("/products/:product_id/apply-recipe-cost", handlers.ApplyRecipeCost)
 	cost.Get("/reports/daily", handlers.GetDailyProfitReport)
 	cost.Get("/reports/products", handlers.GetProductProfitReport)
 	cost.Get("/analytics", handlers.GetProfitAnalytics)
+	cost.Post("/backfill-order-costs", handlers.BackfillOrderItemCosts)
 
 	// Health check
 	app.Get("/health", func(c *fiber.Ctx) error {
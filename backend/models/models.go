@@ -32,16 +32,20 @@ type Category struct {
 // Product model
 type Product struct {
 	BaseModel
-	Name        string      `json:"name" gorm:"not null"`
-	Description *string     `json:"description"`
-	Price       float64     `json:"price" gorm:"not null"`
-	Cost        float64     `json:"cost" gorm:"default:0"` // ต้นทุนต่อหน่วย
-	Image       *string     `json:"image"`
-	Available   bool        `json:"available" gorm:"default:true"`
-	CategoryID  string      `json:"category_id" gorm:"not null"`
-	Category    Category    `json:"category,omitempty" gorm:"foreignKey:CategoryID"`
-	OrderItems  []OrderItem `json:"order_items,omitempty" gorm:"foreignKey:ProductID"`
-	Recipe      *Recipe     `json:"recipe,omitempty" gorm:"foreignKey:ProductID"`
+	Name                string      `json:"name" gorm:"not null"`
+	Description         *string     `json:"description"`
+	Price               float64     `json:"price" gorm:"not null"`
+	Cost                float64     `json:"cost" gorm:"default:0"` // ต้นทุนต่อหน่วย
+	RecipeCost          *float64    `json:"recipe_cost"`           // ต้นทุนวัตถุดิบตามสูตร (คำนวณอัตโนมัติ)
+	RecipeCostUpdatedAt *time.Time  `json:"recipe_cost_updated_at"`
+	Image               *string     `json:"image"`
+	Available           bool        `json:"available" gorm:"default:true"`
+	SoldOut             bool        `json:"sold_out" gorm:"default:false"` // สต๊อกไม่พอทำแม้แต่แก้วเดียว (ตั้งอัตโนมัติ)
+	SoldOutAt           *time.Time  `json:"sold_out_at"`
+	CategoryID          string      `json:"category_id" gorm:"not null"`
+	Category            Category    `json:"category,omitempty" gorm:"foreignKey:CategoryID"`
+	OrderItems          []OrderItem `json:"order_items,omitempty" gorm:"foreignKey:ProductID"`
+	Recipe              *Recipe     `json:"recipe,omitempty" gorm:"foreignKey:ProductID"`
 }
 
 // Order model
@@ -52,9 +56,15 @@ type Order struct {
 	Status        OrderStatus    `json:"status" gorm:"default:'PENDING'"`
 	PaymentMethod *PaymentMethod `json:"payment_method"`
 	CustomerName  *string        `json:"customer_name"`
+	MemberID      *string        `json:"member_id" gorm:"index"` // สมาชิกที่สั่ง (ถ้ามี)
 	Notes         *string        `json:"notes"`
 	Items         []OrderItem    `json:"items,omitempty" gorm:"foreignKey:OrderID"`
 	Payment       *Payment       `json:"payment,omitempty" gorm:"foreignKey:OrderID"`
+
+	// โหมดจองสต๊อก: ตัดสต๊อกจริงเมื่อออเดอร์เสร็จ คืนเมื่อยกเลิกหรือเกินเวลาจอง
+	StockReserved        bool               `json:"stock_reserved" gorm:"default:false"`
+	ReservationExpiresAt *time.Time         `json:"reservation_expires_at"`
+	Reservations         []StockReservation `json:"reservations,omitempty" gorm:"foreignKey:OrderID"`
 }
 
 // OrderItem model
@@ -67,6 +77,16 @@ type OrderItem struct {
 	ProductID string  `json:"product_id" gorm:"not null"`
 	Order     Order   `json:"order,omitempty" gorm:"foreignKey:OrderID"`
 	Product   Product `json:"product,omitempty" gorm:"foreignKey:ProductID"`
+
+	// ต้นทุน ณ เวลาที่ขาย (nil = ยังไม่ได้บันทึก ใช้ต้นทุนปัจจุบันของสินค้าแทน)
+	UnitCost        *float64 `json:"unit_cost"`
+	RawMaterialCost *float64 `json:"raw_material_cost"`
+	LaborCost       *float64 `json:"labor_cost"`
+	OverheadCost    *float64 `json:"overhead_cost"`
+	ProductCostID   *string  `json:"product_cost_id"` // ProductCost ที่ใช้ (ถ้ามี)
+
+	// สูตรที่ใช้ตัดสต๊อก (nil = ขายก่อนมีระบบเวอร์ชัน หรือสินค้าไม่มีสูตร)
+	RecipeVersionID *string `json:"recipe_version_id" gorm:"index"`
 }
 
 // Payment model
@@ -84,12 +104,18 @@ type Payment struct {
 type Ingredient struct {
 	BaseModel
 	Name           string             `json:"name" gorm:"unique;not null"`
-	Unit           string             `json:"unit" gorm:"not null"` // มล., กรัม, ถ้วย, ช้อน
+	Unit           string             `json:"unit" gorm:"not null"` // หน่วยสต๊อก เช่น มล., กรัม, ถ้วย, ช้อน
+	PurchaseUnit   *string            `json:"purchase_unit"`        // หน่วยที่ใช้สั่งซื้อ (nil = หน่วยสต๊อก)
+	RecipeUnit     *string            `json:"recipe_unit"`          // หน่วยเริ่มต้นในสูตร (nil = หน่วยสต๊อก)
 	CostPerUnit    float64            `json:"cost_per_unit" gorm:"not null"`
+	CostingMethod  CostingMethod      `json:"costing_method" gorm:"default:'AVERAGE'"` // วิธีคิดต้นทุน: AVERAGE, FIFO
 	CurrentStock   float64            `json:"current_stock" gorm:"default:0"`
+	ReservedStock  float64            `json:"reserved_stock" gorm:"default:0"` // จองให้ออเดอร์ที่ยังไม่เสร็จ ขายได้จริง = current - reserved
 	MinStock       float64            `json:"min_stock" gorm:"default:0"`
 	MaxStock       *float64           `json:"max_stock"`
-	Supplier       *string            `json:"supplier"`
+	ShelfLifeDays  *int               `json:"shelf_life_days"` // อายุการเก็บ ใช้กำหนดวันหมดอายุเมื่อรับเข้าโดยไม่ระบุ
+	Supplier       *string            `json:"supplier"`        // ชื่อผู้จำหน่าย (ข้อความเดิม)
+	SupplierID     *string            `json:"supplier_id"`     // ผู้จำหน่ายหลัก
 	Description    *string            `json:"description"`
 	Recipes        []RecipeIngredient `json:"recipes,omitempty" gorm:"foreignKey:IngredientID"`
 	StockMovements []StockMovement    `json:"stock_movements,omitempty" gorm:"foreignKey:IngredientID"`
@@ -103,6 +129,35 @@ type Recipe struct {
 	PrepTime     *int               `json:"prep_time"` // เวลาในการเตรียม (นาที)
 	Product      Product            `json:"product,omitempty" gorm:"foreignKey:ProductID"`
 	Ingredients  []RecipeIngredient `json:"ingredients,omitempty" gorm:"foreignKey:RecipeID"`
+
+	// เวอร์ชันที่ใช้อยู่ ส่วนผสมด้านบนเป็นสำเนาของเวอร์ชันนี้
+	ActiveVersionID *string `json:"active_version_id"`
+}
+
+// RecipeVersion สูตรของสินค้าแต่ละเวอร์ชัน แก้ไขไม่ได้หลังเปิดใช้ เก็บไว้ดูย้อนหลังว่าขายด้วยสูตรไหน
+type RecipeVersion struct {
+	BaseModel
+	RecipeID      string                    `json:"recipe_id" gorm:"not null;uniqueIndex:idx_recipe_version"`
+	VersionNumber int                       `json:"version_number" gorm:"not null;uniqueIndex:idx_recipe_version"`
+	Status        RecipeVersionStatus       `json:"status" gorm:"not null;default:'DRAFT'"`
+	Instructions  *string                   `json:"instructions"`
+	PrepTime      *int                      `json:"prep_time"`
+	Notes         *string                   `json:"notes"` // เหตุผลที่เปลี่ยนสูตร
+	CreatedBy     *string                   `json:"created_by"`
+	EffectiveFrom *time.Time                `json:"effective_from" gorm:"index"` // วันที่เริ่มใช้ (SCHEDULED = กำหนดล่วงหน้า)
+	EffectiveTo   *time.Time                `json:"effective_to"`                // วันที่เลิกใช้
+	RecipeCost    *float64                  `json:"recipe_cost"`                 // ต้นทุนตามสูตร ณ วันที่เริ่มใช้
+	Ingredients   []RecipeVersionIngredient `json:"ingredients,omitempty" gorm:"foreignKey:RecipeVersionID"`
+}
+
+// RecipeVersionIngredient ส่วนผสมของสูตรเวอร์ชันหนึ่ง
+type RecipeVersionIngredient struct {
+	BaseModel
+	RecipeVersionID string     `json:"recipe_version_id" gorm:"not null;index"`
+	IngredientID    string     `json:"ingredient_id" gorm:"not null"`
+	Quantity        float64    `json:"quantity" gorm:"not null"`
+	Unit            *string    `json:"unit"` // nil = หน่วยสต๊อกของวัตถุดิบ
+	Ingredient      Ingredient `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
 }
 
 // RecipeIngredient model
@@ -111,6 +166,7 @@ type RecipeIngredient struct {
 	RecipeID     string     `json:"recipe_id" gorm:"not null"`
 	IngredientID string     `json:"ingredient_id" gorm:"not null"`
 	Quantity     float64    `json:"quantity" gorm:"not null"` // ปริมาณที่ใช้
+	Unit         *string    `json:"unit"`                     // หน่วยของปริมาณ (nil = หน่วยสต๊อกของวัตถุดิบ)
 	Recipe       Recipe     `json:"recipe,omitempty" gorm:"foreignKey:RecipeID"`
 	Ingredient   Ingredient `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
 }
@@ -120,12 +176,88 @@ type StockMovement struct {
 	BaseModel
 	IngredientID string            `json:"ingredient_id" gorm:"not null"`
 	Type         StockMovementType `json:"type" gorm:"not null"`
-	Quantity     float64           `json:"quantity" gorm:"not null"`
-	Reason       *string           `json:"reason"`    // เหตุผล เช่น "ขาย", "เสียหาย", "เติมสต๊อก"
-	Reference    *string           `json:"reference"` // อ้างอิง เช่น OrderID
+	Quantity     float64           `json:"quantity" gorm:"not null"` // ADJUST บันทึกส่วนต่าง (ติดลบได้)
+	Reason       *string           `json:"reason"`                   // เหตุผล เช่น "ขาย", "เสียหาย", "เติมสต๊อก"
+	Reference    *string           `json:"reference"`                // อ้างอิง เช่น OrderID
+	UnitCost     *float64          `json:"unit_cost"`                // ราคาซื้อต่อหน่วย (IN) หรือต้นทุนต่อหน่วยที่ตัดออก (OUT)
+	TotalCost    *float64          `json:"total_cost"`               // มูลค่ารับเข้า หรือต้นทุนขาย (COGS)
 	Ingredient   Ingredient        `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
 }
 
+// IngredientCostLayer ล็อตของวัตถุดิบแต่ละครั้งที่รับเข้า ใช้เป็นชั้นต้นทุนและติดตามวันหมดอายุ
+// ตัดออกตามวันหมดอายุก่อน (FEFO) ล็อตที่ไม่มีวันหมดอายุตัดตามลำดับการรับเข้า
+type IngredientCostLayer struct {
+	BaseModel
+	IngredientID string      `json:"ingredient_id" gorm:"not null;index"`
+	Ingredient   *Ingredient `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
+	MovementID   *string     `json:"movement_id"` // StockMovement ที่รับเข้า
+	LotNumber    *string     `json:"lot_number"`
+	ReceivedAt   time.Time   `json:"received_at" gorm:"not null;index"`
+	ExpiryDate   *time.Time  `json:"expiry_date" gorm:"index"`
+	Quantity     float64     `json:"quantity" gorm:"not null"`  // จำนวนที่รับเข้า
+	Remaining    float64     `json:"remaining" gorm:"not null"` // จำนวนคงเหลือในล็อตนี้
+	UnitCost     float64     `json:"unit_cost" gorm:"not null"`
+}
+
+// PrepRecipe สูตรผลิตวัตถุดิบกึ่งสำเร็จรูป เช่น cold brew, ไซรัป ส่วนผสมเป็นวัตถุดิบที่ผลิตเองได้อีกชั้น
+type PrepRecipe struct {
+	BaseModel
+	IngredientID  string                `json:"ingredient_id" gorm:"unique;not null"` // วัตถุดิบที่ได้จากการผลิต
+	Ingredient    Ingredient            `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
+	YieldQuantity float64               `json:"yield_quantity" gorm:"not null"` // ปริมาณที่ได้ต่อรอบการผลิต (หน่วยสต๊อก)
+	Instructions  *string               `json:"instructions"`
+	Components    []PrepRecipeComponent `json:"components,omitempty" gorm:"foreignKey:PrepRecipeID"`
+}
+
+// PrepRecipeComponent ส่วนผสมในสูตรผลิตต่อหนึ่งรอบ
+type PrepRecipeComponent struct {
+	BaseModel
+	PrepRecipeID string     `json:"prep_recipe_id" gorm:"not null;index"`
+	IngredientID string     `json:"ingredient_id" gorm:"not null;index"`
+	Ingredient   Ingredient `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
+	Quantity     float64    `json:"quantity" gorm:"not null"`
+	Unit         *string    `json:"unit"` // nil = หน่วยสต๊อกของส่วนผสม
+}
+
+// ProductionBatch บันทึกการผลิตวัตถุดิบกึ่งสำเร็จรูปหนึ่งครั้ง
+type ProductionBatch struct {
+	BaseModel
+	IngredientID string     `json:"ingredient_id" gorm:"not null;index"`
+	Ingredient   Ingredient `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
+	Batches      float64    `json:"batches" gorm:"not null"`  // จำนวนรอบตามสูตร
+	Quantity     float64    `json:"quantity" gorm:"not null"` // ปริมาณที่ได้จริง (หน่วยสต๊อก)
+	TotalCost    float64    `json:"total_cost" gorm:"not null"`
+	UnitCost     float64    `json:"unit_cost" gorm:"not null"`
+	ProducedBy   *string    `json:"produced_by"`
+	Notes        *string    `json:"notes"`
+	ProducedAt   time.Time  `json:"produced_at" gorm:"not null;index"`
+}
+
+// UnitOfMeasure หน่วยวัดในทะเบียนหน่วย แปลงกันได้ภายในมิติเดียวกันผ่านหน่วยฐาน
+type UnitOfMeasure struct {
+	BaseModel
+	Code      string        `json:"code" gorm:"unique;not null"` // เช่น g, kg, ml, L
+	Name      string        `json:"name" gorm:"unique;not null"` // ชื่อที่ใช้ในวัตถุดิบ เช่น กรัม, มล.
+	Dimension UnitDimension `json:"dimension" gorm:"not null"`
+	ToBase    float64       `json:"to_base" gorm:"not null"` // 1 หน่วยนี้เท่ากับกี่หน่วยฐาน (g, ml, ชิ้น)
+}
+
+// IngredientUnitConversion หน่วยเฉพาะของวัตถุดิบ เช่น 1 แพ็ค = 12 ขวด, 1 ขวด = 1000 มล.
+type IngredientUnitConversion struct {
+	BaseModel
+	IngredientID string  `json:"ingredient_id" gorm:"not null;index"`
+	Unit         string  `json:"unit" gorm:"not null"`
+	Factor       float64 `json:"factor" gorm:"not null"` // 1 หน่วยนี้เท่ากับกี่หน่วยสต๊อก
+}
+
+type UnitDimension string
+
+const (
+	UnitDimensionMass   UnitDimension = "MASS"   // น้ำหนัก ฐานเป็นกรัม
+	UnitDimensionVolume UnitDimension = "VOLUME" // ปริมาตร ฐานเป็นมิลลิลิตร
+	UnitDimensionCount  UnitDimension = "COUNT"  // จำนวนชิ้น
+)
+
 // Enums
 type OrderStatus string
 
@@ -163,6 +295,197 @@ const (
 	StockMovementTypeIn     StockMovementType = "IN"     // เข้า
 	StockMovementTypeOut    StockMovementType = "OUT"    // ออก
 	StockMovementTypeAdjust StockMovementType = "ADJUST" // ปรับปรุง
+	StockMovementTypeWaste  StockMovementType = "WASTE"  // ของเสีย
+
+	StockMovementTypeProductionIn  StockMovementType = "PRODUCTION_IN"  // ได้จากการผลิต
+	StockMovementTypeProductionOut StockMovementType = "PRODUCTION_OUT" // ใช้เป็นส่วนผสมในการผลิต
+)
+
+// ผู้จำหน่ายวัตถุดิบ
+type Supplier struct {
+	BaseModel
+	Name            string  `json:"name" gorm:"unique;not null"`
+	ContactName     *string `json:"contact_name"`
+	Phone           *string `json:"phone"`
+	Email           *string `json:"email"`
+	Address         *string `json:"address"`
+	TaxID           *string `json:"tax_id"`
+	LeadTimeDays    int     `json:"lead_time_days" gorm:"default:0"`    // ระยะเวลาตั้งแต่สั่งจนได้รับของ (วัน)
+	PaymentTerms    *string `json:"payment_terms"`                      // เงื่อนไขการชำระเงิน เช่น เงินสด, เครดิต 30 วัน
+	PaymentTermDays int     `json:"payment_term_days" gorm:"default:0"` // จำนวนวันเครดิต
+	Notes           *string `json:"notes"`
+	IsActive        bool    `json:"is_active" gorm:"default:true"`
+}
+
+// ราคาวัตถุดิบตามรายการราคาของผู้จำหน่าย
+type SupplierPrice struct {
+	BaseModel
+	SupplierID       string     `json:"supplier_id" gorm:"not null;index"`
+	Supplier         Supplier   `json:"supplier,omitempty" gorm:"foreignKey:SupplierID"`
+	IngredientID     string     `json:"ingredient_id" gorm:"not null;index"`
+	Ingredient       Ingredient `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
+	UnitPrice        float64    `json:"unit_price" gorm:"not null"` // ราคาต่อหน่วยของวัตถุดิบ
+	MinOrderQuantity *float64   `json:"min_order_quantity"`         // จำนวนสั่งขั้นต่ำ
+	Unit             *string    `json:"unit"`                       // หน่วยของราคาและจำนวนสั่ง (nil = หน่วยสต๊อก)
+	EffectiveDate    time.Time  `json:"effective_date" gorm:"not null"`
+	IsActive         bool       `json:"is_active" gorm:"default:true"`
+}
+
+// เลขที่เอกสารล่าสุดของแต่ละประเภทต่อวัน ล็อกแถวนี้ก่อนออกเลขที่ เอกสารที่สร้างพร้อมกันจึงได้เลขไม่ซ้ำ
+type DocumentSequence struct {
+	BaseModel
+	Prefix    string `json:"prefix" gorm:"size:10;not null;uniqueIndex:idx_document_sequence"` // PO, ST
+	Period    string `json:"period" gorm:"size:10;not null;uniqueIndex:idx_document_sequence"` // วันที่ (060102)
+	LastValue int    `json:"last_value" gorm:"not null"`                                       // ลำดับล่าสุดที่ออกไปแล้ว
+}
+
+// ใบสั่งซื้อ
+type PurchaseOrder struct {
+	BaseModel
+	PONumber     string              `json:"po_number" gorm:"unique;not null"`
+	SupplierID   string              `json:"supplier_id" gorm:"not null;index"`
+	Supplier     Supplier            `json:"supplier,omitempty" gorm:"foreignKey:SupplierID"`
+	Status       PurchaseOrderStatus `json:"status" gorm:"default:'DRAFT'"`
+	OrderDate    *time.Time          `json:"order_date"`    // วันที่ส่งใบสั่งซื้อ
+	ExpectedDate *time.Time          `json:"expected_date"` // วันที่คาดว่าจะได้รับ
+	ReceivedDate *time.Time          `json:"received_date"` // วันที่รับครบ
+	TotalAmount  float64             `json:"total_amount"`
+	Notes        *string             `json:"notes"`
+	Lines        []PurchaseOrderLine `json:"lines,omitempty" gorm:"foreignKey:PurchaseOrderID"`
+}
+
+// รายการในใบสั่งซื้อ
+type PurchaseOrderLine struct {
+	BaseModel
+	PurchaseOrderID  string     `json:"purchase_order_id" gorm:"not null;index"`
+	IngredientID     string     `json:"ingredient_id" gorm:"not null"`
+	Ingredient       Ingredient `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
+	Quantity         float64    `json:"quantity" gorm:"not null"`           // จำนวนที่สั่ง
+	ReceivedQuantity float64    `json:"received_quantity" gorm:"default:0"` // จำนวนที่รับแล้ว
+	Unit             *string    `json:"unit"`                               // หน่วยของจำนวนและราคา (nil = หน่วยสต๊อก)
+	UnitPrice        float64    `json:"unit_price" gorm:"not null"`
+	Subtotal         float64    `json:"subtotal" gorm:"not null"`
+}
+
+type PurchaseOrderStatus string
+
+const (
+	PurchaseOrderStatusDraft     PurchaseOrderStatus = "DRAFT"     // ร่าง
+	PurchaseOrderStatusOrdered   PurchaseOrderStatus = "ORDERED"   // ส่งใบสั่งซื้อแล้ว
+	PurchaseOrderStatusPartial   PurchaseOrderStatus = "PARTIAL"   // รับของบางส่วน
+	PurchaseOrderStatusReceived  PurchaseOrderStatus = "RECEIVED"  // รับครบ
+	PurchaseOrderStatusCancelled PurchaseOrderStatus = "CANCELLED" // ยกเลิก
+)
+
+// CostingMethod วิธีคิดต้นทุนวัตถุดิบ
+type CostingMethod string
+
+const (
+	CostingMethodAverage CostingMethod = "AVERAGE" // ถัวเฉลี่ยถ่วงน้ำหนักเคลื่อนที่
+	CostingMethodFIFO    CostingMethod = "FIFO"    // เข้าก่อนออกก่อน
+)
+
+// การตรวจนับสต๊อก
+type Stocktake struct {
+	BaseModel
+	StocktakeNumber string          `json:"stocktake_number" gorm:"unique;not null"`
+	Status          StocktakeStatus `json:"status" gorm:"default:'OPEN'"`
+	StartedAt       time.Time       `json:"started_at" gorm:"not null"` // เวลาที่บันทึกยอดตามระบบ
+	PostedAt        *time.Time      `json:"posted_at"`
+	StartedBy       *string         `json:"started_by"`
+	PostedBy        *string         `json:"posted_by"`
+	Notes           *string         `json:"notes"`
+	Lines           []StocktakeLine `json:"lines,omitempty" gorm:"foreignKey:StocktakeID"`
+}
+
+// รายการวัตถุดิบในการตรวจนับ
+type StocktakeLine struct {
+	BaseModel
+	StocktakeID      string           `json:"stocktake_id" gorm:"not null;index"`
+	IngredientID     string           `json:"ingredient_id" gorm:"not null"`
+	Ingredient       Ingredient       `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
+	ExpectedQuantity float64          `json:"expected_quantity" gorm:"not null"` // ยอดตามระบบตอนเริ่มนับ
+	UnitCost         float64          `json:"unit_cost" gorm:"not null"`         // ต้นทุนต่อหน่วยตอนเริ่มนับ
+	CountedQuantity  *float64         `json:"counted_quantity"`                  // ยอดนับได้รวมทุกคน (nil = ยังไม่นับ)
+	VarianceQuantity *float64         `json:"variance_quantity"`                 // นับได้ - ตามระบบ
+	VarianceValue    *float64         `json:"variance_value"`                    // มูลค่าส่วนต่าง (ติดลบ = ของหาย)
+	MovementID       *string          `json:"movement_id"`                       // StockMovement ADJUST ที่บันทึกส่วนต่าง
+	Counts           []StocktakeCount `json:"counts,omitempty" gorm:"foreignKey:StocktakeLineID"`
+}
+
+// ยอดนับของผู้นับแต่ละคน แยกตามจุดจัดเก็บ
+type StocktakeCount struct {
+	BaseModel
+	StocktakeLineID string    `json:"stocktake_line_id" gorm:"not null;index"`
+	CountedBy       string    `json:"counted_by" gorm:"not null"`
+	Location        string    `json:"location"` // จุดจัดเก็บ เช่น หน้าร้าน, ห้องเก็บของ
+	Quantity        float64   `json:"quantity" gorm:"not null"`
+	CountedAt       time.Time `json:"counted_at" gorm:"not null"`
+}
+
+type RecipeVersionStatus string
+
+const (
+	RecipeVersionStatusDraft     RecipeVersionStatus = "DRAFT"     // ร่าง ยังแก้ไขหรือลบได้
+	RecipeVersionStatusScheduled RecipeVersionStatus = "SCHEDULED" // รอถึงวันที่เริ่มใช้
+	RecipeVersionStatusActive    RecipeVersionStatus = "ACTIVE"    // ใช้อยู่
+	RecipeVersionStatusRetired   RecipeVersionStatus = "RETIRED"   // เลิกใช้แล้ว
+)
+
+// StockReservation สต๊อกที่จองไว้ให้ออเดอร์ ต่อวัตถุดิบหนึ่งรายการ
+type StockReservation struct {
+	BaseModel
+	OrderID      string                 `json:"order_id" gorm:"not null;index"`
+	IngredientID string                 `json:"ingredient_id" gorm:"not null;index"`
+	Ingredient   *Ingredient            `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
+	Quantity     float64                `json:"quantity" gorm:"not null"` // หน่วยสต๊อก
+	Status       StockReservationStatus `json:"status" gorm:"not null;index"`
+	ExpiresAt    time.Time              `json:"expires_at" gorm:"not null;index"`
+	CommittedAt  *time.Time             `json:"committed_at"`
+	ReleasedAt   *time.Time             `json:"released_at"`
+	MovementID   *string                `json:"movement_id"` // StockMovement ที่ตัดออกเมื่อออเดอร์เสร็จ
+}
+
+type StockReservationStatus string
+
+const (
+	StockReservationStatusReserved  StockReservationStatus = "RESERVED"  // จองอยู่
+	StockReservationStatusCommitted StockReservationStatus = "COMMITTED" // ตัดสต๊อกแล้ว
+	StockReservationStatusReleased  StockReservationStatus = "RELEASED"  // คืนแล้ว (ยกเลิก/หมดเวลา)
+)
+
+type StocktakeStatus string
+
+const (
+	StocktakeStatusOpen      StocktakeStatus = "OPEN"      // กำลังนับ
+	StocktakeStatusPosted    StocktakeStatus = "POSTED"    // บันทึกส่วนต่างแล้ว
+	StocktakeStatusCancelled StocktakeStatus = "CANCELLED" // ยกเลิก
+)
+
+// บันทึกของเสีย ระบุวัตถุดิบโดยตรง หรือสินค้าที่ทำเสร็จแล้ว (ตัดวัตถุดิบตามสูตร)
+type WasteEntry struct {
+	BaseModel
+	Reason       WasteReason `json:"reason" gorm:"not null;index"`
+	IngredientID *string     `json:"ingredient_id"`
+	Ingredient   *Ingredient `json:"ingredient,omitempty" gorm:"foreignKey:IngredientID"`
+	ProductID    *string     `json:"product_id"`
+	Product      *Product    `json:"product,omitempty" gorm:"foreignKey:ProductID"`
+	Quantity     float64     `json:"quantity" gorm:"not null"`   // หน่วยของวัตถุดิบ หรือจำนวนแก้วของสินค้า
+	TotalCost    float64     `json:"total_cost" gorm:"not null"` // มูลค่าวัตถุดิบที่เสีย
+	RecordedBy   *string     `json:"recorded_by" gorm:"index"`
+	Notes        *string     `json:"notes"`
+	WastedAt     time.Time   `json:"wasted_at" gorm:"not null;index"`
+}
+
+type WasteReason string
+
+const (
+	WasteReasonSpoilage   WasteReason = "SPOILAGE"    // เสีย/หมดอายุ
+	WasteReasonSpill      WasteReason = "SPILL"       // หก
+	WasteReasonStaffDrink WasteReason = "STAFF_DRINK" // เครื่องดื่มพนักงาน
+	WasteReasonTasting    WasteReason = "TASTING"     // ชิม/ทดสอบรสชาติ
+	WasteReasonRemake     WasteReason = "REMAKE"      // ทำใหม่
+	WasteReasonExpired    WasteReason = "EXPIRED"     // ล็อตหมดอายุ (บันทึกอัตโนมัติ)
 )
 
 // Promotion System Models
@@ -376,8 +699,22 @@ type Member struct {
 	LastVisit   *time.Time `json:"last_visit"`                    // การเยี่ยมชมครั้งล่าสุด
 
 	// การตั้งค่า
-	Tier     string `json:"tier" gorm:"default:BRONZE"`    // ระดับสมาชิก: BRONZE, SILVER, GOLD, PLATINUM
-	IsActive bool   `json:"is_active" gorm:"default:true"` // สถานะสมาชิก
+	Tier           string     `json:"tier" gorm:"default:BRONZE"`    // ระดับสมาชิก: BRONZE, SILVER, GOLD, PLATINUM
+	TierReviewDate *time.Time `json:"tier_review_date"`              // วันที่ประเมินระดับครั้งถัดไป
+	IsActive       bool       `json:"is_active" gorm:"default:true"` // สถานะสมาชิก
+
+	// การแนะนำเพื่อน
+	ReferralCode *string `json:"referral_code" gorm:"unique"` // รหัสแนะนำของสมาชิก
+	ReferredByID *string `json:"referred_by_id"`              // สมาชิกที่แนะนำ
+
+	// ความยินยอมตาม PDPA
+	PrivacyConsent     bool       `json:"privacy_consent" gorm:"default:false"`   // ยินยอมให้เก็บและใช้ข้อมูลส่วนบุคคล
+	PrivacyConsentAt   *time.Time `json:"privacy_consent_at"`                     // วันที่ให้/ถอนความยินยอม
+	MarketingConsent   bool       `json:"marketing_consent" gorm:"default:false"` // ยินยอมรับข่าวสารการตลาด
+	MarketingConsentAt *time.Time `json:"marketing_consent_at"`
+	ErasedAt           *time.Time `json:"erased_at"` // วันที่ลบข้อมูลส่วนบุคคล
+
+	MergedIntoID *string `json:"merged_into_id"` // สมาชิกปลายทางที่บัญชีนี้ถูกรวมเข้าไป
 
 	// ความสัมพันธ์
 	PointHistories    []PointHistory     `json:"point_histories" gorm:"foreignKey:MemberID"`
@@ -393,9 +730,10 @@ type PointHistory struct {
 	OrderID *string `json:"order_id"` // อ้างอิงจากออเดอร์
 	Order   *Order  `json:"order" gorm:"foreignKey:OrderID"`
 
-	Type        string `json:"type" gorm:"not null"`   // EARN, REDEEM, EXPIRE, BONUS, ADJUST
-	Points      int    `json:"points" gorm:"not null"` // จำนวนคะแนน (+/-)
-	Description string `json:"description"`            // รายละเอียด
+	Type        string   `json:"type" gorm:"not null"`   // EARN, REDEEM, EXPIRE, BONUS, ADJUST
+	Points      int      `json:"points" gorm:"not null"` // จำนวนคะแนน (+/-)
+	Description string   `json:"description"`            // รายละเอียด
+	SpentAmount *float64 `json:"spent_amount"`           // ยอดใช้จ่ายของการมาใช้บริการครั้งนี้ (ใช้ประเมินระดับ)
 
 	// สำหรับคะแนนที่มีวันหมดอายุ
 	ExpiresAt *time.Time `json:"expires_at"`
@@ -411,7 +749,7 @@ type Reward struct {
 	BaseModel
 	Name        string  `json:"name" gorm:"not null"` // ชื่อรางวัล
 	Description *string `json:"description"`          // รายละเอียด
-	Type        string  `json:"type" gorm:"not null"` // FREE_ITEM, DISCOUNT, BUY_X_GET_Y
+	Type        string  `json:"type" gorm:"not null"` // FREE_ITEM, DISCOUNT, BUY_X_GET_Y, PHYSICAL
 
 	// เงื่อนไขการแลก
 	PointCost    int     `json:"point_cost" gorm:"default:0"` // คะแนนที่ต้องใช้
@@ -424,13 +762,14 @@ type Reward struct {
 	DiscountPercent *float64 `json:"discount_percent"` // เปอร์เซ็นต์ลด
 
 	// Buy X Get Y
-	BuyQuantity        *int     `json:"buy_quantity"`                         // ซื้อกี่ชิ้น
-	GetQuantity        *int     `json:"get_quantity"`                         // แถมกี่ชิ้น
-	ApplicableProducts []string `json:"applicable_products" gorm:"type:json"` // สินค้าที่ใช้ได้
+	BuyQuantity        *int     `json:"buy_quantity"`                                         // ซื้อกี่ชิ้น
+	GetQuantity        *int     `json:"get_quantity"`                                         // แถมกี่ชิ้น
+	ApplicableProducts []string `json:"applicable_products" gorm:"type:json;serializer:json"` // สินค้าที่ใช้ได้
 
 	// การตั้งค่า
-	IsActive   bool       `json:"is_active" gorm:"default:true"`
+	IsActive   bool       `json:"is_active"`   // ค่าเริ่มต้นตั้งใน CreateReward เพื่อให้บันทึก false ได้
 	UsageLimit *int       `json:"usage_limit"` // จำกัดการใช้ต่อคน
+	Stock      *int       `json:"stock"`       // จำนวนของรางวัลคงเหลือ (nil = ไม่จำกัด)
 	StartDate  *time.Time `json:"start_date"`
 	EndDate    *time.Time `json:"end_date"`
 
@@ -453,8 +792,11 @@ type RewardRedemption struct {
 	OrderID *string `json:"order_id"` // ออเดอร์ที่ใช้รางวัล
 	Order   *Order  `json:"order" gorm:"foreignKey:OrderID"`
 
-	PointsUsed int    `json:"points_used" gorm:"not null"`   // คะแนนที่ใช้
-	Status     string `json:"status" gorm:"default:PENDING"` // PENDING, USED, EXPIRED, CANCELLED
+	Code       *string `json:"code" gorm:"unique"`            // รหัสสำหรับใช้รางวัลที่จุดขาย
+	PointsUsed int     `json:"points_used" gorm:"not null"`   // คะแนนที่ใช้
+	Status     string  `json:"status" gorm:"default:PENDING"` // PENDING, USED, EXPIRED, CANCELLED
+
+	DiscountApplied *float64 `json:"discount_applied"` // ส่วนลดที่หักจากออเดอร์จริง
 
 	UsedAt    *time.Time `json:"used_at"`    // วันที่ใช้
 	ExpiresAt *time.Time `json:"expires_at"` // วันหมดอายุ
@@ -462,6 +804,37 @@ type RewardRedemption struct {
 	Notes *string `json:"notes"`
 }
 
+// บัตรสะสมแสตมป์ของสมาชิก (หนึ่งใบต่อสมาชิกต่อรางวัลประเภท BUY_X_GET_Y)
+type StampCard struct {
+	BaseModel
+	MemberID string `json:"member_id" gorm:"not null;uniqueIndex:idx_stamp_card_member_reward"`
+	Member   Member `json:"member" gorm:"foreignKey:MemberID"`
+
+	RewardID string `json:"reward_id" gorm:"not null;uniqueIndex:idx_stamp_card_member_reward"`
+	Reward   Reward `json:"reward" gorm:"foreignKey:RewardID"`
+
+	Stamps         int        `json:"stamps" gorm:"default:0"`          // แสตมป์ในบัตรปัจจุบัน
+	StampsRequired int        `json:"stamps_required" gorm:"not null"`  // จำนวนแสตมป์ที่ต้องสะสม
+	CompletedCount int        `json:"completed_count" gorm:"default:0"` // จำนวนบัตรที่สะสมครบแล้ว
+	LastStampAt    *time.Time `json:"last_stamp_at"`
+
+	Histories []StampHistory `json:"histories,omitempty" gorm:"foreignKey:StampCardID"`
+}
+
+// ประวัติการได้รับและใช้แสตมป์
+type StampHistory struct {
+	BaseModel
+	StampCardID string `json:"stamp_card_id" gorm:"not null;index"`
+	MemberID    string `json:"member_id" gorm:"not null;index"`
+
+	Type        string `json:"type" gorm:"not null"`   // EARN, COMPLETE, ADJUST
+	Stamps      int    `json:"stamps" gorm:"not null"` // จำนวนแสตมป์ (+/-)
+	Description string `json:"description"`
+
+	OrderID      *string `json:"order_id"`      // ออเดอร์ที่ได้แสตมป์
+	RedemptionID *string `json:"redemption_id"` // รางวัลที่ออกให้เมื่อสะสมครบ
+}
+
 // กฎการให้คะแนน
 type PointRule struct {
 	BaseModel
@@ -474,21 +847,86 @@ type PointRule struct {
 	EarnPoints  *int     `json:"earn_points"`  // ได้กี่คะแนน
 
 	// กฎพิเศษ
-	BonusMultiplier      *float64 `json:"bonus_multiplier"`                       // ตัวคูณคะแนน
-	SpecialDays          []string `json:"special_days" gorm:"type:json"`          // วันพิเศษ
-	ApplicableCategories []string `json:"applicable_categories" gorm:"type:json"` // หมวดหมู่ที่ใช้ได้
-	ApplicableProducts   []string `json:"applicable_products" gorm:"type:json"`   // สินค้าที่ใช้ได้
+	BonusMultiplier      *float64 `json:"bonus_multiplier"`                                       // ตัวคูณคะแนน
+	SpecialDays          []string `json:"special_days" gorm:"type:json;serializer:json"`          // วันพิเศษ
+	ApplicableCategories []string `json:"applicable_categories" gorm:"type:json;serializer:json"` // หมวดหมู่ที่ใช้ได้
+	ApplicableProducts   []string `json:"applicable_products" gorm:"type:json;serializer:json"`   // สินค้าที่ใช้ได้
 
 	// ระดับสมาชิก
-	ApplicableTiers []string `json:"applicable_tiers" gorm:"type:json"` // ระดับที่ใช้ได้
+	ApplicableTiers []string `json:"applicable_tiers" gorm:"type:json;serializer:json"` // ระดับที่ใช้ได้
 
 	// การตั้งค่า
-	IsActive  bool       `json:"is_active" gorm:"default:true"`
+	IsActive  bool       `json:"is_active"`                 // ค่าเริ่มต้นตั้งใน CreatePointRule เพื่อให้บันทึก false ได้
 	Priority  int        `json:"priority" gorm:"default:0"` // ลำดับความสำคัญ
 	StartDate *time.Time `json:"start_date"`
 	EndDate   *time.Time `json:"end_date"`
 }
 
+// ระดับสมาชิกและเงื่อนไขการได้รับ
+type MemberTier struct {
+	BaseModel
+	Name        string  `json:"name" gorm:"unique;not null"` // รหัสระดับ เช่น BRONZE, SILVER
+	DisplayName *string `json:"display_name"`                // ชื่อที่แสดง
+	Rank        int     `json:"rank" gorm:"not null"`        // ลำดับระดับ (มากกว่า = สูงกว่า)
+
+	// เงื่อนไขการได้รับระดับ (ต้องผ่านทั้งยอดใช้จ่ายและจำนวนออเดอร์)
+	QualifyingSpend     float64 `json:"qualifying_spend" gorm:"default:0"`  // ยอดใช้จ่ายขั้นต่ำ
+	QualifyingOrders    int     `json:"qualifying_orders" gorm:"default:0"` // จำนวนออเดอร์ขั้นต่ำ
+	QualificationMonths int     `json:"qualification_months"`               // นับยอดย้อนหลังกี่เดือน (0 = ตลอดอายุสมาชิก)
+
+	// สิทธิประโยชน์
+	UpgradeBonus   int     `json:"upgrade_bonus" gorm:"default:0"` // คะแนนโบนัสเมื่ออัพเกรด
+	EarnMultiplier float64 `json:"earn_multiplier"`                // ตัวคูณคะแนนจากการซื้อ
+
+	IsActive bool `json:"is_active"` // ค่าเริ่มต้นตั้งใน CreateTier เพื่อให้บันทึก false ได้
+}
+
+// ประวัติการให้และถอนความยินยอมของสมาชิก
+type MemberConsentLog struct {
+	BaseModel
+	MemberID    string  `json:"member_id" gorm:"not null;index"`
+	ConsentType string  `json:"consent_type" gorm:"not null"` // PRIVACY, MARKETING
+	Granted     bool    `json:"granted"`                      // true = ให้ความยินยอม, false = ถอน
+	Source      *string `json:"source"`                       // ช่องทาง เช่น POS, WEB
+}
+
+// ประวัติการรวมบัญชีสมาชิก
+type MemberMerge struct {
+	BaseModel
+	SourceMemberID string  `json:"source_member_id" gorm:"not null;index"` // บัญชีที่ถูกรวม
+	TargetMemberID string  `json:"target_member_id" gorm:"not null;index"` // บัญชีที่เก็บไว้
+	SourceSnapshot string  `json:"source_snapshot" gorm:"type:text"`       // ข้อมูลบัญชีที่ถูกรวมก่อนรวม (JSON)
+	PointsMoved    int     `json:"points_moved"`                           // คะแนนที่ใช้ได้ที่ย้ายมา
+	SpendMoved     float64 `json:"spend_moved"`                            // ยอดใช้จ่ายที่ย้ายมา
+	RecordsMoved   string  `json:"records_moved" gorm:"type:text"`         // จำนวนรายการที่ย้ายแยกตามประเภท (JSON)
+	FromTier       string  `json:"from_tier"`                              // ระดับของบัญชีปลายทางก่อนรวม
+	ToTier         string  `json:"to_tier"`                                // ระดับของบัญชีปลายทางหลังรวม
+	Reason         *string `json:"reason"`
+	MergedBy       *string `json:"merged_by"`
+}
+
+// รหัส OTP สำหรับยืนยันตัวตนสมาชิกที่จุดขาย
+type MemberOTP struct {
+	BaseModel
+	MemberID string `json:"member_id" gorm:"not null;index"`
+	Purpose  string `json:"purpose" gorm:"not null"` // REDEEM
+	CodeHash string `json:"-" gorm:"not null"`       // เก็บเฉพาะ hash ของรหัส
+
+	ExpiresAt  time.Time  `json:"expires_at" gorm:"not null"`
+	Attempts   int        `json:"attempts" gorm:"default:0"` // จำนวนครั้งที่กรอกผิด
+	VerifiedAt *time.Time `json:"verified_at"`
+}
+
+// การให้คะแนนพิเศษที่ให้ได้ครั้งเดียว (วันเกิดต่อปี, การแนะนำเพื่อน)
+type LoyaltyAward struct {
+	BaseModel
+	MemberID       string  `json:"member_id" gorm:"not null;uniqueIndex:idx_loyalty_award"`
+	Type           string  `json:"type" gorm:"not null;uniqueIndex:idx_loyalty_award"`      // BIRTHDAY, REFERRAL
+	AwardKey       string  `json:"award_key" gorm:"not null;uniqueIndex:idx_loyalty_award"` // ปีเกิด หรือ ID ของเพื่อนที่แนะนำ
+	Points         int     `json:"points"`
+	PointHistoryID *string `json:"point_history_id"`
+}
+
 // การอัพเกรดระดับสมาชิก
 type TierUpgrade struct {
 	BaseModel
@@ -544,8 +982,8 @@ type DailyProfitReport struct {
 	AverageOrderValue float64 `json:"average_order_value"` // ยอดเฉลี่ยต่อออเดอร์
 
 	// รายละเอียดเพิ่มเติม
-	TopSellingProducts  []string `json:"top_selling_products" gorm:"type:json"`  // สินค้าขายดี
-	ProductSalesDetails []byte   `json:"product_sales_details" gorm:"type:json"` // รายละเอียดการขายแต่ละสินค้า
+	TopSellingProducts  []string `json:"top_selling_products" gorm:"type:json;serializer:json"` // สินค้าขายดี
+	ProductSalesDetails []byte   `json:"product_sales_details" gorm:"type:json"`                // รายละเอียดการขายแต่ละสินค้า
 
 	GeneratedAt time.Time `json:"generated_at" gorm:"autoCreateTime"`
 }
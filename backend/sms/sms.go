@@ -0,0 +1,31 @@
+package sms
+
+import (
+	"log"
+	"os"
+)
+
+// Provider ผู้ให้บริการส่ง SMS
+type Provider interface {
+	Send(phone, message string) error
+}
+
+// LogProvider ผู้ให้บริการจำลองสำหรับการพัฒนา พิมพ์ข้อความลง log แทนการส่งจริง
+type LogProvider struct{}
+
+// Send พิมพ์ข้อความที่จะส่งลง log
+func (LogProvider) Send(phone, message string) error {
+	log.Printf("📱 SMS to %s: %s", phone, message)
+	return nil
+}
+
+// NewFromEnv เลือกผู้ให้บริการตาม SMS_PROVIDER (ค่าเริ่มต้นคือ log)
+func NewFromEnv() Provider {
+	switch os.Getenv("SMS_PROVIDER") {
+	case "", "log":
+		return LogProvider{}
+	default:
+		log.Printf("Warning: unknown SMS_PROVIDER %q, using log provider", os.Getenv("SMS_PROVIDER"))
+		return LogProvider{}
+	}
+}